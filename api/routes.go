@@ -2,49 +2,118 @@ package api
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ARED-Group/dynamic-token-manager/internal/config"
 	"github.com/ARED-Group/dynamic-token-manager/internal/handlers"
 	"github.com/ARED-Group/dynamic-token-manager/internal/middleware"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/registry"
 	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
 )
 
-// SetupRoutes configures all API routes
-func SetupRoutes(router *mux.Router, cfg *config.Config) error {
+// SetupRoutes configures all API routes. The returned function releases the
+// services' resources, such as the device store, once the server has stopped.
+func SetupRoutes(router *mux.Router, cfg *config.Config) (func() error, error) {
 	// Initialize services
 	tokenService, err := services.NewTokenService(cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	deviceService := services.NewDeviceService(cfg)
+	deviceStore, err := store.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	deviceService := services.NewDeviceService(cfg, deviceStore)
+	registryService, err := services.NewRegistryService(cfg, tokenService)
+	if err != nil {
+		deviceService.Close()
+		return nil, err
+	}
+
+	// Revoke outstanding GitHub tokens as soon as a device loses full access
+	deviceService.OnDeactivate(func(serialNumber string) {
+		revoked, evicted, err := tokenService.RevokeDeviceTokens(serialNumber, deviceService.HoldsAccess)
+		if err != nil {
+			log.Printf("Failed to revoke tokens for deactivated device %s: %v", serialNumber, err)
+			return
+		}
+		log.Printf("Revoked %d and evicted %d shared token(s) for deactivated device %s", revoked, evicted, serialNumber)
+	})
+
+	// Likewise withdraw tokens issued under a fleet policy that no longer applies
+	deviceService.OnScopeChange(func(affected func(string) bool) {
+		revoked, evicted, err := tokenService.RevokeTokens(affected, deviceService.HoldsAccess)
+		if err != nil {
+			log.Printf("Failed to revoke tokens after a fleet change: %v", err)
+			return
+		}
+		log.Printf("Revoked %d and evicted %d shared token(s) after a fleet change", revoked, evicted)
+	})
 
 	// Initialize handlers
 	tokenHandler := handlers.NewTokenHandler(tokenService, deviceService)
-	githubHandler := handlers.NewGitHubRegistryHandler(cfg, tokenService, deviceService)
+	githubHandler := handlers.NewGitHubRegistryHandler(cfg, tokenService, deviceService, registryService)
+	registryHandler := handlers.NewRegistryHandler(registryService, deviceService)
+	deviceHandler := handlers.NewDeviceHandler(deviceService)
+	sessionHandler := handlers.NewDeviceSessionHandler(deviceService, tokenService)
 	healthHandler := handlers.NewHealthHandler()
 	
+	// Registry proxy: devices pull through this service and never see GitHub tokens
+	var registryProxy *registry.Proxy
+	var registryTokenHandler *handlers.RegistryTokenHandler
+	if cfg.RegistryProxyEnabled {
+		if err := cfg.ValidateRegistryProxyConfig(); err != nil {
+			deviceService.Close()
+			return nil, err
+		}
+		issuer := registry.NewTokenIssuer(cfg.JWTSecret, cfg.RegistryTokenService, cfg.RegistryTokenExpiration)
+		registryProxy = registry.NewProxy(cfg.RegistryURL, cfg.RegistryRealm(), issuer, registryUpstreamCredentials(tokenService, deviceService), cfg.RegistryProxyWriteTimeout)
+		registryTokenHandler = handlers.NewRegistryTokenHandler(tokenService, deviceService, issuer, cfg.RegistryTokenExpiration)
+	}
+	
 	// Initialize middleware
-	authMiddleware := middleware.NewAuthMiddleware(cfg, tokenService, deviceService)
+	trustedProxies, err := cfg.TrustedProxyNetworks()
+	if err != nil {
+		deviceService.Close()
+		return nil, err
+	}
+	clientIP := middleware.NewClientIPResolver(trustedProxies)
+	authMiddleware := middleware.NewAuthMiddleware(cfg, tokenService, deviceService, clientIP)
 	rateLimiter := middleware.NewRateLimiter(time.Minute, time.Hour)
+	deviceRateLimit := middleware.NewRateLimiter(time.Minute, time.Hour).DeviceRateLimitMiddleware(func(access *models.DeviceAccess) int {
+		if access.Policy != nil && access.Policy.RateLimitPerMinute > 0 {
+			return access.Policy.RateLimitPerMinute
+		}
+		return cfg.DeviceRateLimitPerMinute
+	})
 	
 	// Global middleware
 	corsConfig := middleware.CORSConfig{
 		AllowedOrigins: cfg.CORSAllowedOrigins,
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization", "X-Device-Serial"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-Device-Serial", "X-Device-Timestamp", "X-Device-Nonce", "X-Device-Signature", "X-Client-Version"},
 	}
 	router.Use(middleware.CORSWithConfig(corsConfig))
 	router.Use(middleware.Logging())
-	router.Use(rateLimiter.RateLimitMiddleware(cfg.RateLimitPerMinute))
+	router.Use(rateLimiter.RateLimitMiddleware(cfg.RateLimitPerMinute, clientIP))
 	router.Use(middleware.RequestID())
 	
 	// Health check endpoints (no auth required)
 	router.HandleFunc("/health", healthHandler.Health).Methods("GET")
 	router.HandleFunc("/ready", healthHandler.Ready).Methods("GET")
 	
+	// Docker Registry v2 token endpoint and pull-through proxy
+	if registryProxy != nil {
+		router.HandleFunc("/registry/token", registryTokenHandler.Token).Methods("GET")
+		router.PathPrefix("/v2/").Handler(registryProxy)
+	}
+	
 	// Global OPTIONS handler for CORS preflight
 	router.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// CORS headers are already set by the middleware
@@ -60,6 +129,7 @@ func SetupRoutes(router *mux.Router, cfg *config.Config) error {
 	// Token management endpoints (require device auth)
 	tokenRoutes := api.PathPrefix("/tokens").Subrouter()
 	tokenRoutes.Use(authMiddleware.DeviceAuthMiddleware)
+	tokenRoutes.Use(deviceRateLimit)
 	tokenRoutes.HandleFunc("", tokenHandler.GenerateToken).Methods("POST")
 	tokenRoutes.HandleFunc("/refresh", tokenHandler.RefreshToken).Methods("POST")
 	tokenRoutes.HandleFunc("/validate", tokenHandler.ValidateToken).Methods("POST")
@@ -67,6 +137,7 @@ func SetupRoutes(router *mux.Router, cfg *config.Config) error {
 	// GitHub Registry endpoints (require device auth) - CRITICAL FOR sync_containers.py
 	githubRoutes := api.PathPrefix("/github").Subrouter()
 	githubRoutes.Use(authMiddleware.DeviceAuthMiddleware)
+	githubRoutes.Use(deviceRateLimit)
 	
 	// Main endpoint your Python script needs
 	githubRoutes.HandleFunc("/registry-token", githubHandler.GetRegistryToken).Methods("GET")
@@ -74,6 +145,50 @@ func SetupRoutes(router *mux.Router, cfg *config.Config) error {
 	githubRoutes.HandleFunc("/token/refresh", githubHandler.RefreshGitHubToken).Methods("POST")
 	githubRoutes.HandleFunc("/token/validate", githubHandler.ValidateGitHubToken).Methods("POST")
 	
+	// Device enrollment (authenticated by the enrollment token)
+	api.HandleFunc("/devices/enroll", deviceHandler.Enroll).Methods("POST")
+	
+	// Challenge-response sessions (authenticated by the signed challenge)
+	api.HandleFunc("/devices/challenge", sessionHandler.GetChallenge).Methods("GET")
+	api.HandleFunc("/devices/session", sessionHandler.CreateSession).Methods("POST")
+	
+	// Device-facing endpoints (require device auth)
+	deviceRoutes := api.PathPrefix("/devices").Subrouter()
+	deviceRoutes.Use(authMiddleware.DeviceAuthMiddleware)
+	deviceRoutes.Use(deviceRateLimit)
+	deviceRoutes.HandleFunc("/status", deviceHandler.GetStatus).Methods("GET")
+	deviceRoutes.HandleFunc("/heartbeat", deviceHandler.Heartbeat).Methods("POST")
+	
+	// Registry credential endpoints for every configured registry (require device auth)
+	registryRoutes := api.PathPrefix("/registries").Subrouter()
+	registryRoutes.Use(authMiddleware.DeviceAuthMiddleware)
+	registryRoutes.Use(deviceRateLimit)
+	registryRoutes.HandleFunc("", registryHandler.ListRegistries).Methods("GET")
+	registryRoutes.HandleFunc("/{name}/credentials", registryHandler.GetCredentials).Methods("GET")
+	
+	// Admin endpoints (require ADMIN_API_KEY)
+	adminRoutes := api.PathPrefix("/admin").Subrouter()
+	adminRoutes.Use(authMiddleware.AdminAuthMiddleware)
+	adminRoutes.HandleFunc("/devices", deviceHandler.RegisterDevice).Methods("POST")
+	adminRoutes.HandleFunc("/devices", deviceHandler.ListDevices).Methods("GET")
+	adminRoutes.HandleFunc("/devices/{serial}", deviceHandler.GetDevice).Methods("GET")
+	adminRoutes.HandleFunc("/devices/{serial}", deviceHandler.UpdateDevice).Methods("PATCH")
+	adminRoutes.HandleFunc("/devices/{serial}", deviceHandler.DeleteDevice).Methods("DELETE")
+	adminRoutes.HandleFunc("/devices/{serial}/suspend", deviceHandler.SuspendDevice).Methods("POST")
+	adminRoutes.HandleFunc("/devices/{serial}/reactivate", deviceHandler.ReactivateDevice).Methods("POST")
+	adminRoutes.HandleFunc("/devices/{serial}/quarantine", deviceHandler.QuarantineDevice).Methods("POST")
+	adminRoutes.HandleFunc("/devices/{serial}/decommission", deviceHandler.DecommissionDevice).Methods("POST")
+	adminRoutes.HandleFunc("/devices/{serial}/status-history", deviceHandler.GetStatusHistory).Methods("GET")
+	adminRoutes.HandleFunc("/devices/{serial}/revoke-tokens", githubHandler.RevokeDeviceTokens).Methods("POST")
+	adminRoutes.HandleFunc("/enrollment-tokens", deviceHandler.CreateEnrollmentToken).Methods("POST")
+	adminRoutes.HandleFunc("/enrollment-tokens", deviceHandler.ListEnrollmentTokens).Methods("GET")
+	adminRoutes.HandleFunc("/enrollment-tokens/{id}", deviceHandler.DeleteEnrollmentToken).Methods("DELETE")
+	adminRoutes.HandleFunc("/fleets", deviceHandler.CreateFleet).Methods("POST")
+	adminRoutes.HandleFunc("/fleets", deviceHandler.ListFleets).Methods("GET")
+	adminRoutes.HandleFunc("/fleets/{name}", deviceHandler.GetFleet).Methods("GET")
+	adminRoutes.HandleFunc("/fleets/{name}", deviceHandler.UpdateFleet).Methods("PUT")
+	adminRoutes.HandleFunc("/fleets/{name}", deviceHandler.DeleteFleet).Methods("DELETE")
+	
 	// Protected endpoints (require JWT authentication)
 	protected := api.PathPrefix("/").Subrouter()
 	protected.Use(middleware.JWTAuth(cfg.JWTSecret))
@@ -87,7 +202,27 @@ func SetupRoutes(router *mux.Router, cfg *config.Config) error {
 	// 404 handler
 	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
 	
-	return nil
+	return deviceService.Close, nil
+}
+
+// registryUpstreamCredentials pulls from the upstream registry with the
+// device's GitHub installation token
+func registryUpstreamCredentials(tokenService *services.TokenService, deviceService *services.DeviceService) registry.UpstreamCredentialsFunc {
+	return func(deviceSerial, repository string) (string, string, error) {
+		org, _, _ := strings.Cut(repository, "/")
+		access := deviceService.LoadAccess(deviceSerial)
+		token, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{
+			DeviceSerial: deviceSerial,
+			Organization: org,
+			Group:        access.Group,
+			Quarantined:  access.Quarantined(),
+			Policy:       access.Policy,
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return token.Username, token.Token, nil
+	}
 }
 
 // metricsHandler serves Prometheus metrics
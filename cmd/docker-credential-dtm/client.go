@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+)
+
+// registryCredentials is the token manager's JSON credentials document
+type registryCredentials struct {
+	Registry  string    `json:"registry"`
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// registryInfo is one entry of the token manager's registry list
+type registryInfo struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// client talks to the token manager as this device
+type client struct {
+	baseURL      string
+	deviceSerial string
+	signingKey   *devicesig.SigningKey
+	useSession   bool   // answer a challenge instead of signing each request
+	sessionToken string // set once a session is open
+	http         *http.Client
+}
+
+// newClientFromEnv configures a client from DTM_* environment variables
+func newClientFromEnv() (*client, error) {
+	baseURL := strings.TrimRight(os.Getenv("DTM_URL"), "/")
+	if baseURL == "" {
+		return nil, fmt.Errorf("DTM_URL is not set")
+	}
+
+	serial := os.Getenv("DTM_DEVICE_SERIAL")
+	if serial == "" {
+		if path := os.Getenv("DTM_DEVICE_SERIAL_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read device serial: %w", err)
+			}
+			serial = strings.TrimSpace(string(data))
+		}
+	}
+	if serial == "" && os.Getenv("DTM_CLIENT_CERT") == "" {
+		return nil, fmt.Errorf("DTM_DEVICE_SERIAL, DTM_DEVICE_SERIAL_FILE or DTM_CLIENT_CERT is required")
+	}
+
+	signingKey, err := signingKeyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	useSession := os.Getenv("DTM_SESSION_AUTH") == "true"
+	if useSession && (signingKey == nil || serial == "") {
+		return nil, fmt.Errorf("DTM_SESSION_AUTH requires a device serial and signing key")
+	}
+
+	timeout := 15 * time.Second
+	if value := os.Getenv("DTM_TIMEOUT"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			timeout = parsed
+		}
+	}
+
+	tlsConfig, err := tlsConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{
+		baseURL:      baseURL,
+		deviceSerial: serial,
+		signingKey:   signingKey,
+		useSession:   useSession,
+		http: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// tlsConfigFromEnv configures the device's client certificate and, for a
+// private CA, the CA that signed the token manager's certificate
+func tlsConfigFromEnv() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	certFile, keyFile := os.Getenv("DTM_CLIENT_CERT"), os.Getenv("DTM_CLIENT_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile := os.Getenv("DTM_CA_FILE"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// signingKeyFromEnv reads the device signing key, if one is configured
+func signingKeyFromEnv() (*devicesig.SigningKey, error) {
+	value := os.Getenv("DTM_DEVICE_KEY")
+	if value == "" {
+		if path := os.Getenv("DTM_DEVICE_KEY_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read device key: %w", err)
+			}
+			value = strings.TrimSpace(string(data))
+		}
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := devicesig.ParseSigningKey(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device key: %w", err)
+	}
+	return key, nil
+}
+
+// registries lists the registries the token manager serves
+func (c *client) registries() ([]registryInfo, error) {
+	var result struct {
+		Registries []registryInfo `json:"registries"`
+	}
+	if err := c.getJSON("/api/v1/registries", &result); err != nil {
+		return nil, err
+	}
+	return result.Registries, nil
+}
+
+// registryCredentials fetches fresh credentials for the named registry
+func (c *client) registryCredentials(name string) (*registryCredentials, error) {
+	var creds registryCredentials
+	if err := c.getJSON("/api/v1/registries/"+url.PathEscape(name)+"/credentials?format=json", &creds); err != nil {
+		return nil, err
+	}
+	if creds.Registry == "" || creds.Token == "" {
+		return nil, fmt.Errorf("incomplete credentials response")
+	}
+	return &creds, nil
+}
+
+// getJSON performs an authenticated GET and decodes the JSON response into v
+func (c *client) getJSON(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.deviceSerial != "" {
+		req.Header.Set("X-Device-Serial", c.deviceSerial)
+	}
+
+	switch {
+	case c.useSession:
+		if c.sessionToken == "" {
+			if err := c.openSession(); err != nil {
+				return err
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+c.sessionToken)
+	case c.signingKey != nil:
+		if err := c.signingKey.SignRequest(req, nil); err != nil {
+			return fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+
+	return c.do(req, v)
+}
+
+// openSession answers a challenge with the device key to obtain a session
+// token, which needs no clock on the device
+func (c *client) openSession() error {
+	req, err := http.NewRequest("GET", c.baseURL+"/api/v1/devices/challenge?serial_number="+url.QueryEscape(c.deviceSerial), nil)
+	if err != nil {
+		return err
+	}
+	var challenge struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := c.do(req, &challenge); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"serial_number": c.deviceSerial,
+		"challenge":     challenge.Challenge,
+		"signature":     c.signingKey.Sign(devicesig.ChallengeMessage(c.deviceSerial, challenge.Challenge)),
+	})
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequest("POST", c.baseURL+"/api/v1/devices/session", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(req, &session); err != nil {
+		return err
+	}
+	if session.Token == "" {
+		return fmt.Errorf("token manager returned no session token")
+	}
+	c.sessionToken = session.Token
+	return nil
+}
+
+// do sends req and decodes the JSON response into v
+func (c *client) do(req *http.Request, v interface{}) error {
+	req.Header.Set("X-Client-Version", version)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach token manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return fmt.Errorf("token manager returned %s: %s", resp.Status, errResp.Message)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Command docker-credential-dtm is a Docker credential helper that fetches
+// short-lived registry credentials from the dynamic token manager on demand,
+// authenticating with the device identity. Enable it on a device with
+//
+//	{"credHelpers": {"ghcr.io": "dtm"}}
+//
+// in ~/.docker/config.json (or the balena-engine equivalent) and configure it
+// through the environment:
+//
+//	DTM_URL                 base URL of the token manager (required)
+//	DTM_DEVICE_SERIAL       device serial number, or
+//	DTM_DEVICE_SERIAL_FILE  file containing the serial number (optional
+//	                        with a client certificate)
+//	DTM_DEVICE_KEY          device signing key, "ed25519:<base64 seed>" or
+//	                        "hmac:<base64 secret>", or
+//	DTM_DEVICE_KEY_FILE     file containing the signing key
+//	DTM_SESSION_AUTH        "true" to sign a server challenge for a session
+//	                        token instead of signing each request, for
+//	                        devices without a reliable clock
+//	DTM_CLIENT_CERT         client certificate for mutual TLS, with
+//	DTM_CLIENT_KEY          its private key
+//	DTM_CA_FILE             CA bundle for the token manager's certificate
+//	DTM_TIMEOUT             request timeout (default 15s)
+//
+// "docker-credential-dtm public-key" prints the key to register for the device.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errCredentialsNotFound is the message Docker recognises as "no credentials"
+const errCredentialsNotFound = "credentials not found in native keychain"
+
+// version is reported to the token manager with every request
+const version = "docker-credential-dtm 1.0.0"
+
+// credentials is the helper protocol's credential document
+type credentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <get|store|erase|list|version|public-key>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if err := run(os.Args[1], os.Stdin, os.Stdout); err != nil {
+		// The protocol reports errors on stdout
+		fmt.Fprintln(os.Stdout, err)
+		os.Exit(1)
+	}
+}
+
+// run executes a credential helper action
+func run(action string, in io.Reader, out io.Writer) error {
+	switch action {
+	case "get":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+		return get(serverURL, out)
+	case "store", "erase":
+		// Credentials are minted on demand and never stored on the device
+		io.Copy(io.Discard, in)
+		return nil
+	case "list":
+		return list(out)
+	case "public-key":
+		key, err := signingKeyFromEnv()
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("DTM_DEVICE_KEY or DTM_DEVICE_KEY_FILE is required")
+		}
+		fmt.Fprintln(out, key.VerifyKeyString())
+		return nil
+	case "version":
+		fmt.Fprintln(out, version)
+		return nil
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+// get prints credentials for serverURL if the token manager serves it
+func get(serverURL string, out io.Writer) error {
+	client, err := newClientFromEnv()
+	if err != nil {
+		return err
+	}
+
+	registries, err := client.registries()
+	if err != nil {
+		return err
+	}
+	name := ""
+	for _, registry := range registries {
+		if normalizeRegistry(registry.URL) == normalizeRegistry(serverURL) {
+			name = registry.Name
+			break
+		}
+	}
+	if name == "" {
+		return errors.New(errCredentialsNotFound)
+	}
+
+	creds, err := client.registryCredentials(name)
+	if err != nil {
+		return err
+	}
+	if creds.TokenType == "bearer" {
+		// Credential helpers can only return a username and password
+		return fmt.Errorf("registry %s issues bearer tokens, use the docker-config format instead", name)
+	}
+
+	return json.NewEncoder(out).Encode(credentials{
+		ServerURL: serverURL,
+		Username:  creds.Username,
+		Secret:    creds.Token,
+	})
+}
+
+// list prints the registries this helper serves. Usernames are not known
+// without fetching credentials, so they are left empty.
+func list(out io.Writer) error {
+	registries := map[string]string{}
+
+	client, err := newClientFromEnv()
+	if err == nil {
+		if infos, err := client.registries(); err == nil {
+			for _, info := range infos {
+				registries[info.URL] = ""
+			}
+		}
+	}
+
+	return json.NewEncoder(out).Encode(registries)
+}
+
+// readServerURL reads the server URL Docker writes to stdin
+func readServerURL(in io.Reader) (string, error) {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	serverURL := strings.TrimSpace(line)
+	if serverURL == "" {
+		return "", fmt.Errorf("no server URL given")
+	}
+	return serverURL, nil
+}
+
+// normalizeRegistry reduces "https://ghcr.io/v2/" and "ghcr.io" to "ghcr.io"
+func normalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	if i := strings.Index(registry, "/"); i >= 0 {
+		registry = registry[:i]
+	}
+	return strings.ToLower(registry)
+}
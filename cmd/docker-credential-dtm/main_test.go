@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+)
+
+// fakeTokenManager serves the endpoints the helper uses to device SN1,
+// which must sign each request or present the session token it obtained
+func fakeTokenManager(t *testing.T, verifyKey *devicesig.VerifyKey) *httptest.Server {
+	t.Helper()
+
+	authorized := func(r *http.Request) bool {
+		if r.Header.Get("X-Device-Serial") != "SN1" || r.Header.Get("X-Client-Version") != version {
+			return false
+		}
+		if r.Header.Get("Authorization") == "Bearer session-token" {
+			return true
+		}
+		message := devicesig.CanonicalRequest(r.Method, r.URL.RequestURI(), r.Header.Get(devicesig.HeaderTimestamp),
+			r.Header.Get(devicesig.HeaderNonce), devicesig.BodyHash(nil))
+		return verifyKey.Verify(message, r.Header.Get(devicesig.HeaderSignature))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/devices/challenge":
+			json.NewEncoder(w).Encode(map[string]string{"challenge": "challenge-1"})
+			return
+		case "/api/v1/devices/session":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["serial_number"] != "SN1" || req["challenge"] != "challenge-1" ||
+				!verifyKey.Verify(devicesig.ChallengeMessage("SN1", "challenge-1"), req["signature"]) {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"message": "Invalid challenge response"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "session-token"})
+			return
+		}
+
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Invalid device signature"})
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/registries":
+			json.NewEncoder(w).Encode(map[string]interface{}{"registries": []registryInfo{
+				{Name: "ghcr", URL: "ghcr.io"},
+				{Name: "hub", URL: "registry-1.docker.io"},
+			}})
+		case "/api/v1/registries/ghcr/credentials":
+			json.NewEncoder(w).Encode(map[string]string{"registry": "ghcr.io", "username": "ared-group", "token": "ghs_test"})
+		case "/api/v1/registries/hub/credentials":
+			json.NewEncoder(w).Encode(map[string]string{"registry": "registry-1.docker.io", "token": "bearer", "token_type": "bearer"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// setupHelper points the helper at a fake token manager as device SN1 and
+// returns the device key's string form
+func setupHelper(t *testing.T) string {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyString := "ed25519:" + base64.StdEncoding.EncodeToString(private.Seed())
+	key, err := devicesig.ParseSigningKey(keyString)
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	verifyKey, err := devicesig.ParseVerifyKey(key.VerifyKeyString())
+	if err != nil {
+		t.Fatalf("ParseVerifyKey: %v", err)
+	}
+
+	server := fakeTokenManager(t, verifyKey)
+	t.Setenv("DTM_URL", server.URL+"/")
+	t.Setenv("DTM_DEVICE_SERIAL", "SN1")
+	t.Setenv("DTM_DEVICE_KEY", keyString)
+	t.Setenv("DTM_SESSION_AUTH", "")
+	return keyString
+}
+
+func TestGet(t *testing.T) {
+	for _, session := range []string{"", "true"} {
+		setupHelper(t)
+		t.Setenv("DTM_SESSION_AUTH", session)
+
+		var out bytes.Buffer
+		if err := run("get", strings.NewReader("https://ghcr.io/v2/\n"), &out); err != nil {
+			t.Fatalf("get (session auth %q): %v", session, err)
+		}
+		var creds credentials
+		if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
+			t.Fatalf("invalid output %q: %v", out.String(), err)
+		}
+		want := credentials{ServerURL: "https://ghcr.io/v2/", Username: "ared-group", Secret: "ghs_test"}
+		if creds != want {
+			t.Errorf("get (session auth %q) = %+v, want %+v", session, creds, want)
+		}
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	setupHelper(t)
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"harbor.example.com\n", errCredentialsNotFound},
+		{"registry-1.docker.io", "bearer tokens"},
+		{"", "no server URL"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := run("get", strings.NewReader(tt.input), &out); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("get %q error = %v, want %q", tt.input, err, tt.want)
+		}
+		if out.Len() != 0 {
+			t.Errorf("get %q wrote %q", tt.input, out.String())
+		}
+	}
+
+	// A key the token manager does not know is refused with its message
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	t.Setenv("DTM_DEVICE_KEY", "ed25519:"+base64.StdEncoding.EncodeToString(private.Seed()))
+	if err := run("get", strings.NewReader("ghcr.io"), &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "Invalid device signature") {
+		t.Errorf("get with an unknown key error = %v, want the token manager's message", err)
+	}
+}
+
+func TestListStoreErase(t *testing.T) {
+	setupHelper(t)
+
+	var out bytes.Buffer
+	if err := run("list", strings.NewReader(""), &out); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var registries map[string]string
+	if err := json.Unmarshal(out.Bytes(), &registries); err != nil {
+		t.Fatalf("invalid output %q: %v", out.String(), err)
+	}
+	if _, ok := registries["ghcr.io"]; !ok || len(registries) != 2 {
+		t.Errorf("list = %v, want both registries", registries)
+	}
+
+	// Nothing is stored on the device
+	for _, action := range []string{"store", "erase"} {
+		out.Reset()
+		if err := run(action, strings.NewReader(`{"ServerURL":"ghcr.io","Username":"u","Secret":"s"}`), &out); err != nil || out.Len() != 0 {
+			t.Errorf("%s = %q, %v; want a silent no-op", action, out.String(), err)
+		}
+	}
+
+	// Without configuration the helper lists nothing rather than failing
+	t.Setenv("DTM_URL", "")
+	out.Reset()
+	if err := run("list", strings.NewReader(""), &out); err != nil || strings.TrimSpace(out.String()) != "{}" {
+		t.Errorf("unconfigured list = %q, %v; want {}", out.String(), err)
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	keyString := setupHelper(t)
+	key, _ := devicesig.ParseSigningKey(keyString)
+
+	var out bytes.Buffer
+	if err := run("public-key", nil, &out); err != nil {
+		t.Fatalf("public-key: %v", err)
+	}
+	if strings.TrimSpace(out.String()) != key.VerifyKeyString() {
+		t.Errorf("public-key = %q, want %q", out.String(), key.VerifyKeyString())
+	}
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	setupHelper(t)
+
+	t.Setenv("DTM_SESSION_AUTH", "true")
+	t.Setenv("DTM_DEVICE_KEY", "")
+	if _, err := newClientFromEnv(); err == nil {
+		t.Error("session auth accepted without a signing key")
+	}
+
+	t.Setenv("DTM_SESSION_AUTH", "")
+	t.Setenv("DTM_DEVICE_SERIAL", "")
+	if _, err := newClientFromEnv(); err == nil {
+		t.Error("client configured without a device identity")
+	}
+
+	t.Setenv("DTM_URL", "")
+	if _, err := newClientFromEnv(); err == nil {
+		t.Error("client configured without DTM_URL")
+	}
+}
+
+func TestNormalizeRegistry(t *testing.T) {
+	for _, registry := range []string{"ghcr.io", "https://ghcr.io/v2/", "http://GHCR.io", "ghcr.io/ared-group"} {
+		if got := normalizeRegistry(registry); got != "ghcr.io" {
+			t.Errorf("normalizeRegistry(%q) = %q, want ghcr.io", registry, got)
+		}
+	}
+}
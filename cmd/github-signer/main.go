@@ -0,0 +1,114 @@
+// Command github-signer holds the GitHub App private key and signs App JWTs
+// for the token server over a unix or TCP socket, so the key never has to be
+// present on the token server itself. Point the server at it with
+// GITHUB_PRIVATE_KEY_SOURCE=remote and GITHUB_SIGNER_ADDRESS. TCP listeners
+// require GITHUB_SIGNER_SECRET, set to the same value on both sides.
+package main
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+func main() {
+	keyPath := getEnv("GITHUB_PRIVATE_KEY_PATH", "/etc/secrets/github-app-private-key.pem")
+	address := getEnv("GITHUB_SIGNER_ADDRESS", "unix:///run/github-signer/signer.sock")
+	secret := os.Getenv("GITHUB_SIGNER_SECRET")
+
+	privateKey, err := github.LoadPrivateKey(keyPath)
+	if err != nil {
+		log.Fatalf("Failed to load private key: %v", err)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		log.Fatalf("Invalid signer address: %v", err)
+	}
+
+	var listener net.Listener
+	switch u.Scheme {
+	case "unix":
+		listener, err = listenUnix(u.Path)
+	case "tcp":
+		// Anyone who can reach a TCP port could otherwise mint App JWTs
+		if secret == "" {
+			log.Fatalf("GITHUB_SIGNER_SECRET is required for tcp listeners")
+		}
+		listener, err = net.Listen("tcp", u.Host)
+	default:
+		log.Fatalf("Unsupported signer address scheme: %q", u.Scheme)
+	}
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		listener.Close()
+	}()
+
+	log.Printf("GitHub App signer listening on %s", address)
+	if err := github.ServeSigner(listener, privateKey, []byte(secret)); err != nil {
+		log.Fatalf("Signer failed: %v", err)
+	}
+	log.Println("Signer exited")
+}
+
+// listenUnix listens on a unix socket at path that only this user can connect
+// to. The socket is created inside a private 0700 directory, restricted to
+// 0600 and only then moved into place, so it is never reachable with looser
+// permissions.
+func listenUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".signer-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "signer.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is unlinked at its final path on shutdown instead
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	os.Remove(path)
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: listener, path: path}, nil
+}
+
+// unixListener removes its socket file when closed
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	os.Remove(l.path)
+	return l.Listener.Close()
+}
+
+// getEnv gets an environment variable with a fallback value
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -21,14 +24,21 @@ type Config struct {
 	// Database Configuration
 	DatabaseURL             string
 	RedisURL                string
+	DeviceStore             string
 
 	// JWT Configuration
 	JWTSecret               string
 	TokenExpiration         time.Duration
 	RefreshTokenExpiration  time.Duration
 
+	// Admin API
+	AdminAPIKey             string
+	AdminAPIKeys            []AdminAPIKey
+
 	// Rate Limiting
 	RateLimitPerMinute      int
+	DeviceRateLimitPerMinute int
+	TrustedProxies          []string
 
 	// Monitoring
 	EnableMetrics           bool
@@ -37,26 +47,110 @@ type Config struct {
 	// TLS Configuration
 	TLSCertFile             string
 	TLSKeyFile              string
+	TLSClientCAFile         string
+	TLSClientAuth           string
+	TLSClientSerialField    string
 
 	// GitHub App Configuration - NEW SECTION
 	GitHubAppID             string
 	GitHubInstallationID    string
+	GitHubOrganization      string
+	GitHubOrganizations     []string
+	GitHubGroupOrganizations map[string]string
+	GitHubInstallationCacheTTL time.Duration
 	GitHubPrivateKeyPath    string
+	GitHubPrivateKeySource  string
+	GitHubKeyReloadInterval time.Duration
+	GitHubPrivateKey        string
+	GitHubSignerAddress     string
+	GitHubSignerTimeout     time.Duration
+	GitHubSignerSecret      string
 	GitHubTokenCacheTTL     time.Duration
+	GitHubTokenCacheMaxEntries int
+	GitHubTokenRefreshBefore time.Duration
+	GitHubRefreshCooldown   time.Duration
+	GitHubTokenPermissions  map[string]string
+	GitHubTokenRepositories []string
+	GitHubGroupRepositories map[string][]string
+	GitHubQuarantineRepositories []string
+	GitHubAPIURL            string
+	GitHubHTTPTimeout       time.Duration
+	GitHubUserAgent         string
+	GitHubMaxRetries        int
+	GitHubRetryBaseDelay    time.Duration
+	GitHubMaxRetryWait      time.Duration
+	GitHubRetryBudget       time.Duration
 
 	// Device Authentication - NEW SECTION
 	DeviceAuthEnabled       bool
 	DeviceValidationURL     string
+	DeviceValidationToken   string
+	DeviceValidationCacheTTL time.Duration
+	DeviceValidationNegativeCacheTTL time.Duration
+	DeviceValidationFailOpen bool
 	DeviceAuthTimeout       time.Duration
+	DeviceGroupPatterns     []DeviceGroupPattern
+	DeviceSignatureRequired bool
+	DeviceSignatureMaxSkew  time.Duration
+	EnrollmentTokenTTL      time.Duration
+	DeviceChallengeTTL      time.Duration
+	DeviceSessionTTL        time.Duration
+	DeviceLastSeenFlushInterval time.Duration
 
 	// Container Registry Configuration - NEW SECTION
 	RegistryURL             string
 	RegistryUsername        string
+	Registries              []RegistryConfig
+	DefaultRegistry         string
+
+	// Registry Proxy Configuration
+	RegistryProxyEnabled    bool
+	RegistryProxyHost       string
+	RegistryTokenRealm      string
+	RegistryTokenService    string
+	RegistryTokenExpiration time.Duration
+	RegistryProxySessionTTL time.Duration
+	RegistryProxyWriteTimeout time.Duration
 	
 	// CORS Configuration
 	CORSAllowedOrigins      []string
 }
 
+// Registry backend types
+const (
+	RegistryTypeGitHubApp     = "github-app"
+	RegistryTypeStatic        = "static"
+	RegistryTypeTokenExchange = "token-exchange"
+)
+
+// RegistryConfig describes one container registry devices can get credentials
+// for. It is read from REGISTRY_<NAME>_* variables for every name in REGISTRIES.
+type RegistryConfig struct {
+	Name          string
+	Type          string
+	URL           string
+	Username      string
+	Password      string
+	AuthURL       string        // token-exchange: the registry's token endpoint
+	Service       string        // token-exchange: the service parameter
+	Repositories  []string      // token-exchange: repositories the token may pull
+	QuarantineRepositories []string // token-exchange: repositories quarantined devices may pull
+	CredentialTTL time.Duration // static: how long devices may cache credentials
+}
+
+// DeviceGroupPattern assigns devices whose serial matches Pattern to Group
+type DeviceGroupPattern struct {
+	Group   string
+	Pattern string
+}
+
+// AdminAPIKey is an admin API key and the name of the admin holding it, which
+// is recorded as the actor of the changes made with it
+type AdminAPIKey struct {
+	Name string
+	Key  string
+}
+
 // Load reads configuration from environment variables with defaults
 func Load() *Config {
 	return &Config{
@@ -71,14 +165,21 @@ func Load() *Config {
 		// Database Configuration
 		DatabaseURL:            getEnv("DATABASE_URL", "postgres://localhost/token_manager?sslmode=disable"),
 		RedisURL:               getEnv("REDIS_URL", "redis://localhost:6379"),
+		DeviceStore:            getEnv("DEVICE_STORE", "postgres"), // postgres or memory
 
 		// JWT Configuration
 		JWTSecret:              getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
 		TokenExpiration:        getDurationEnv("TOKEN_EXPIRATION", 15*time.Minute),
 		RefreshTokenExpiration: getDurationEnv("REFRESH_TOKEN_EXPIRATION", 24*time.Hour),
 
+		// Admin API (disabled when empty)
+		AdminAPIKey:            getEnv("ADMIN_API_KEY", ""),
+		AdminAPIKeys:           getAdminAPIKeysEnv("ADMIN_API_KEYS"),
+
 		// Rate Limiting
 		RateLimitPerMinute:     getIntEnv("RATE_LIMIT_PER_MINUTE", 100),
+		DeviceRateLimitPerMinute: getIntEnv("DEVICE_RATE_LIMIT_PER_MINUTE", 0), // per device; 0 disables, fleet policies override
+		TrustedProxies:         getStringSliceEnv("TRUSTED_PROXIES", nil), // addresses or CIDRs whose X-Forwarded-For is believed
 
 		// Monitoring
 		EnableMetrics:          getBoolEnv("ENABLE_METRICS", true),
@@ -87,21 +188,70 @@ func Load() *Config {
 		// TLS Configuration
 		TLSCertFile:            getEnv("TLS_CERT_FILE", ""),
 		TLSKeyFile:             getEnv("TLS_KEY_FILE", ""),
+		TLSClientCAFile:        getEnv("TLS_CLIENT_CA_FILE", ""),             // device CA; enables client certificates
+		TLSClientAuth:          getEnv("TLS_CLIENT_AUTH", "verify-if-given"), // verify-if-given or require
+		TLSClientSerialField:   getEnv("TLS_CLIENT_SERIAL_FIELD", "cn"),      // cn, dns or uri
 
 		// GitHub App Configuration - NEW
 		GitHubAppID:            getEnv("GITHUB_APP_ID", ""),
 		GitHubInstallationID:   getEnv("GITHUB_INSTALLATION_ID", ""),
-		GitHubPrivateKeyPath:   getEnv("GITHUB_PRIVATE_KEY_PATH", "/etc/secrets/github-app-private-key.pem"),
+		GitHubOrganization:     getEnv("GITHUB_ORGANIZATION", ""), // default org when GITHUB_INSTALLATION_ID is unset
+		GitHubOrganizations:    getStringSliceEnv("GITHUB_ORGANIZATIONS", nil), // orgs devices may select per request
+		GitHubGroupOrganizations: getMapEnv("GITHUB_GROUP_ORGANIZATIONS", map[string]string{}),
+		GitHubInstallationCacheTTL: getDurationEnv("GITHUB_INSTALLATION_CACHE_TTL", 10*time.Minute),
+		GitHubPrivateKeyPath:   getEnv("GITHUB_PRIVATE_KEY_PATH", "/etc/secrets/github-app-private-key.pem"), // file or directory of *.pem
+		GitHubKeyReloadInterval: getDurationEnv("GITHUB_KEY_RELOAD_INTERVAL", 30*time.Second),
+		GitHubPrivateKeySource: getEnv("GITHUB_PRIVATE_KEY_SOURCE", "file"), // file, env or remote
+		GitHubPrivateKey:       getEnv("GITHUB_PRIVATE_KEY", ""),             // base64 PEM, for source "env"
+		GitHubSignerAddress:    getEnv("GITHUB_SIGNER_ADDRESS", ""),          // unix:///path or tcp://host:port, for source "remote"
+		GitHubSignerTimeout:    getDurationEnv("GITHUB_SIGNER_TIMEOUT", 5*time.Second),
+		GitHubSignerSecret:     getEnv("GITHUB_SIGNER_SECRET", ""),           // shared with the signer, required for tcp://
 		GitHubTokenCacheTTL:    getDurationEnv("GITHUB_TOKEN_CACHE_TTL", 50*time.Minute), // GitHub tokens last ~60min
+		GitHubTokenCacheMaxEntries: getIntEnv("GITHUB_TOKEN_CACHE_MAX_ENTRIES", 1000),
+		GitHubTokenRefreshBefore: getDurationEnv("GITHUB_TOKEN_REFRESH_BEFORE", 5*time.Minute),
+		GitHubRefreshCooldown:  getDurationEnv("GITHUB_REFRESH_COOLDOWN", time.Minute), // per-scope force refresh limit
+		GitHubTokenPermissions: getMapEnv("GITHUB_TOKEN_PERMISSIONS", map[string]string{"packages": "read"}),
+		GitHubTokenRepositories: getStringSliceEnv("GITHUB_TOKEN_REPOSITORIES", nil),
+		GitHubGroupRepositories: getListMapEnv("GITHUB_GROUP_REPOSITORIES"),
+		GitHubQuarantineRepositories: getStringSliceEnv("GITHUB_QUARANTINE_REPOSITORIES", nil), // e.g. a recovery image
+		GitHubAPIURL:           getEnv("GITHUB_API_URL", "https://api.github.com"), // e.g. https://github.example.com/api/v3 for GHES
+		GitHubHTTPTimeout:      getDurationEnv("GITHUB_HTTP_TIMEOUT", 10*time.Second),
+		GitHubUserAgent:        getEnv("GITHUB_USER_AGENT", "dynamic-token-manager"),
+		GitHubMaxRetries:       getIntEnv("GITHUB_MAX_RETRIES", 3),
+		GitHubRetryBaseDelay:   getDurationEnv("GITHUB_RETRY_BASE_DELAY", 500*time.Millisecond),
+		GitHubMaxRetryWait:     getDurationEnv("GITHUB_MAX_RETRY_WAIT", 5*time.Second),
+		GitHubRetryBudget:      getDurationEnv("GITHUB_RETRY_BUDGET", 12*time.Second), // keep below SERVER_WRITE_TIMEOUT
 
 		// Device Authentication - NEW
 		DeviceAuthEnabled:      getBoolEnv("DEVICE_AUTH_ENABLED", true),
 		DeviceValidationURL:    getEnv("DEVICE_VALIDATION_URL", ""),
+		DeviceValidationToken:  getEnv("DEVICE_VALIDATION_TOKEN", ""),
+		DeviceValidationCacheTTL:         getDurationEnv("DEVICE_VALIDATION_CACHE_TTL", 5*time.Minute),
+		DeviceValidationNegativeCacheTTL: getDurationEnv("DEVICE_VALIDATION_NEGATIVE_CACHE_TTL", 30*time.Second),
+		DeviceValidationFailOpen:         getBoolEnv("DEVICE_VALIDATION_FAIL_OPEN", false),
 		DeviceAuthTimeout:      getDurationEnv("DEVICE_AUTH_TIMEOUT", 10*time.Second),
+		DeviceGroupPatterns:    getDeviceGroupPatternsEnv("DEVICE_GROUPS"),
+		DeviceSignatureRequired: getBoolEnv("DEVICE_SIGNATURE_REQUIRED", true), // false admits unsigned requests from keyless legacy devices
+		DeviceSignatureMaxSkew:  getDurationEnv("DEVICE_SIGNATURE_MAX_SKEW", 5*time.Minute),
+		EnrollmentTokenTTL:      getDurationEnv("ENROLLMENT_TOKEN_TTL", 24*time.Hour),
+		DeviceChallengeTTL:      getDurationEnv("DEVICE_CHALLENGE_TTL", 2*time.Minute),
+		DeviceSessionTTL:        getDurationEnv("DEVICE_SESSION_TTL", time.Hour),
+		DeviceLastSeenFlushInterval: getDurationEnv("DEVICE_LAST_SEEN_FLUSH_INTERVAL", 30*time.Second),
 
 		// Container Registry Configuration - NEW
 		RegistryURL:            getEnv("REGISTRY_URL", "ghcr.io"),
 		RegistryUsername:       getEnv("REGISTRY_USERNAME", "ared-group"),
+		Registries:             getRegistriesEnv("REGISTRIES"),
+		DefaultRegistry:        getEnv("REGISTRY_DEFAULT", ""), // defaults to the first registry
+
+		// Registry Proxy Configuration
+		RegistryProxyEnabled:    getBoolEnv("REGISTRY_PROXY_ENABLED", false),
+		RegistryProxyHost:       getEnv("REGISTRY_PROXY_HOST", ""),  // public host devices pull from
+		RegistryTokenRealm:      getEnv("REGISTRY_TOKEN_REALM", ""), // defaults to https://REGISTRY_PROXY_HOST/registry/token
+		RegistryTokenService:    getEnv("REGISTRY_TOKEN_SERVICE", "dynamic-token-manager"),
+		RegistryTokenExpiration: getDurationEnv("REGISTRY_TOKEN_EXPIRATION", 5*time.Minute),
+		RegistryProxySessionTTL: getDurationEnv("REGISTRY_PROXY_SESSION_TTL", time.Hour),
+		RegistryProxyWriteTimeout: getDurationEnv("REGISTRY_PROXY_WRITE_TIMEOUT", 30*time.Minute), // replaces SERVER_WRITE_TIMEOUT for /v2/ pulls
 		
 		// CORS Configuration
 		CORSAllowedOrigins:     getStringSliceEnv("CORS_ALLOWED_ORIGINS", []string{"*"}),
@@ -113,21 +263,189 @@ func (c *Config) ValidateGitHubConfig() error {
 	if c.GitHubAppID == "" {
 		return fmt.Errorf("GITHUB_APP_ID is required")
 	}
-	if c.GitHubInstallationID == "" {
-		return fmt.Errorf("GITHUB_INSTALLATION_ID is required")
+	if c.GitHubInstallationID == "" && c.GitHubOrganization == "" {
+		return fmt.Errorf("GITHUB_INSTALLATION_ID or GITHUB_ORGANIZATION is required")
+	}
+
+	switch c.GitHubPrivateKeySource {
+	case "file":
+		if c.GitHubPrivateKeyPath == "" {
+			return fmt.Errorf("GITHUB_PRIVATE_KEY_PATH is required")
+		}
+
+		// Check if private key file exists
+		if _, err := os.Stat(c.GitHubPrivateKeyPath); os.IsNotExist(err) {
+			return fmt.Errorf("GitHub private key file not found at: %s", c.GitHubPrivateKeyPath)
+		}
+	case "env":
+		if c.GitHubPrivateKey == "" {
+			return fmt.Errorf("GITHUB_PRIVATE_KEY is required")
+		}
+	case "remote":
+		if c.GitHubSignerAddress == "" {
+			return fmt.Errorf("GITHUB_SIGNER_ADDRESS is required")
+		}
+		if strings.HasPrefix(c.GitHubSignerAddress, "tcp://") && c.GitHubSignerSecret == "" {
+			return fmt.Errorf("GITHUB_SIGNER_SECRET is required for a tcp:// signer")
+		}
+	default:
+		return fmt.Errorf("unknown GITHUB_PRIVATE_KEY_SOURCE: %s", c.GitHubPrivateKeySource)
+	}
+
+	return nil
+}
+
+// ValidateRegistryProxyConfig checks the registry proxy configuration
+func (c *Config) ValidateRegistryProxyConfig() error {
+	if c.RegistryProxyHost == "" {
+		return fmt.Errorf("REGISTRY_PROXY_HOST is required when REGISTRY_PROXY_ENABLED is set")
+	}
+	if c.RegistryURL == "" {
+		return fmt.Errorf("REGISTRY_URL is required when REGISTRY_PROXY_ENABLED is set")
+	}
+	return nil
+}
+
+// RegistryRealm returns the token endpoint URL advertised by the registry proxy
+func (c *Config) RegistryRealm() string {
+	if c.RegistryTokenRealm != "" {
+		return c.RegistryTokenRealm
 	}
-	if c.GitHubPrivateKeyPath == "" {
-		return fmt.Errorf("GITHUB_PRIVATE_KEY_PATH is required")
+	return "https://" + c.RegistryProxyHost + "/registry/token"
+}
+
+// RegistryConfigs returns the configured registries. Without REGISTRIES the
+// service serves a single "ghcr" registry backed by the GitHub App.
+func (c *Config) RegistryConfigs() []RegistryConfig {
+	if len(c.Registries) > 0 {
+		return c.Registries
 	}
+	return []RegistryConfig{{
+		Name:     "ghcr",
+		Type:     RegistryTypeGitHubApp,
+		URL:      c.RegistryURL,
+		Username: c.RegistryUsername,
+	}}
+}
 
-	// Check if private key file exists
-	if _, err := os.Stat(c.GitHubPrivateKeyPath); os.IsNotExist(err) {
-		return fmt.Errorf("GitHub private key file not found at: %s", c.GitHubPrivateKeyPath)
+// AdminKeys returns the admin API keys: ADMIN_API_KEYS plus ADMIN_API_KEY,
+// which acts as "admin"
+func (c *Config) AdminKeys() []AdminAPIKey {
+	keys := c.AdminAPIKeys
+	if c.AdminAPIKey != "" {
+		keys = append(keys[:len(keys):len(keys)], AdminAPIKey{Name: "admin", Key: c.AdminAPIKey})
 	}
+	return keys
+}
 
+// ValidateRegistries checks that every configured registry is usable
+func (c *Config) ValidateRegistries() error {
+	registries := c.RegistryConfigs()
+	defaultFound := c.DefaultRegistry == ""
+	for _, reg := range registries {
+		prefix := registryEnvPrefix(reg.Name)
+		if reg.URL == "" {
+			return fmt.Errorf("%sURL is required", prefix)
+		}
+		switch reg.Type {
+		case RegistryTypeGitHubApp:
+		case RegistryTypeStatic:
+			if reg.Username == "" || reg.Password == "" {
+				return fmt.Errorf("%sUSERNAME and %sPASSWORD are required", prefix, prefix)
+			}
+		case RegistryTypeTokenExchange:
+			if reg.AuthURL == "" {
+				return fmt.Errorf("%sAUTH_URL is required", prefix)
+			}
+			// Devices may only pull what is listed, never arbitrary repositories
+			if len(reg.Repositories) == 0 {
+				return fmt.Errorf("%sREPOSITORIES is required", prefix)
+			}
+		default:
+			return fmt.Errorf("unknown %sTYPE: %s", prefix, reg.Type)
+		}
+		if reg.Name == c.DefaultRegistry {
+			defaultFound = true
+		}
+	}
+	if !defaultFound {
+		return fmt.Errorf("REGISTRY_DEFAULT %q is not listed in REGISTRIES", c.DefaultRegistry)
+	}
 	return nil
 }
 
+// TLSConfig builds the server's TLS configuration, or returns nil when TLS is
+// not configured. With TLS_CLIENT_CA_FILE set, devices may (or, with
+// TLS_CLIENT_AUTH=require, must) present a certificate issued by the device CA.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	switch c.TLSClientSerialField {
+	case "cn", "dns", "uri":
+	default:
+		return nil, fmt.Errorf("unknown TLS_CLIENT_SERIAL_FIELD: %s", c.TLSClientSerialField)
+	}
+
+	caPEM, err := os.ReadFile(c.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE")
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch c.TLSClientAuth {
+	case "verify-if-given":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown TLS_CLIENT_AUTH: %s", c.TLSClientAuth)
+	}
+	return tlsConfig, nil
+}
+
+// TrustedProxyNetworks parses TRUSTED_PROXIES. A bare address trusts that
+// address alone.
+func (c *Config) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range c.TrustedProxies {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 // IsProduction returns true if running in production environment
 func (c *Config) IsProduction() bool {
 	return c.Environment == "production"
@@ -192,4 +510,93 @@ func getStringSliceEnv(key string, fallback []string) []string {
 		}
 	}
 	return fallback
-}
\ No newline at end of file
+}
+
+// getMapEnv gets a map environment variable formatted as "key=value,key=value"
+func getMapEnv(key string, fallback map[string]string) map[string]string {
+	if value := os.Getenv(key); value != "" {
+		result := make(map[string]string)
+		for _, item := range strings.Split(value, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if ok && strings.TrimSpace(k) != "" {
+				result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+		if len(result) > 0 {
+			return result
+		}
+	}
+	return fallback
+}
+
+// getListMapEnv gets a map of lists formatted as "key=a|b,key=c"
+func getListMapEnv(key string) map[string][]string {
+	result := make(map[string][]string)
+	for k, v := range getMapEnv(key, nil) {
+		for _, item := range strings.Split(v, "|") {
+			if trimmed := strings.TrimSpace(item); trimmed != "" {
+				result[k] = append(result[k], trimmed)
+			}
+		}
+	}
+	return result
+}
+
+// getDeviceGroupPatternsEnv gets ordered device group patterns formatted as
+// "group=pattern|pattern,group=pattern". The first matching pattern wins.
+func getDeviceGroupPatternsEnv(key string) []DeviceGroupPattern {
+	var result []DeviceGroupPattern
+	for _, item := range getStringSliceEnv(key, nil) {
+		group, patterns, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(group) == "" {
+			continue
+		}
+		for _, pattern := range strings.Split(patterns, "|") {
+			if trimmed := strings.TrimSpace(pattern); trimmed != "" {
+				result = append(result, DeviceGroupPattern{Group: strings.TrimSpace(group), Pattern: trimmed})
+			}
+		}
+	}
+	return result
+}
+
+// getAdminAPIKeysEnv reads named admin keys, e.g. ADMIN_API_KEYS=alice=key1,bob=key2
+func getAdminAPIKeysEnv(key string) []AdminAPIKey {
+	var result []AdminAPIKey
+	for _, item := range getStringSliceEnv(key, nil) {
+		name, secret, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" || secret == "" {
+			continue
+		}
+		result = append(result, AdminAPIKey{Name: strings.TrimSpace(name), Key: secret})
+	}
+	return result
+}
+
+// getRegistriesEnv reads the registries named in key, e.g. REGISTRIES=ghcr,harbor,
+// from their REGISTRY_<NAME>_* variables
+func getRegistriesEnv(key string) []RegistryConfig {
+	var result []RegistryConfig
+	for _, name := range getStringSliceEnv(key, nil) {
+		prefix := registryEnvPrefix(name)
+		result = append(result, RegistryConfig{
+			Name:          name,
+			Type:          getEnv(prefix+"TYPE", RegistryTypeStatic),
+			URL:           getEnv(prefix+"URL", ""),
+			Username:      getEnv(prefix+"USERNAME", ""),
+			Password:      getEnv(prefix+"PASSWORD", ""),
+			AuthURL:       getEnv(prefix+"AUTH_URL", ""),
+			Service:       getEnv(prefix+"SERVICE", ""),
+			Repositories:  getStringSliceEnv(prefix+"REPOSITORIES", nil),
+			QuarantineRepositories: getStringSliceEnv(prefix+"QUARANTINE_REPOSITORIES", nil),
+			CredentialTTL: getDurationEnv(prefix+"CREDENTIAL_TTL", time.Hour),
+		})
+	}
+	return result
+}
+
+// registryEnvPrefix returns the variable prefix for a registry name, e.g.
+// "docker-hub" reads REGISTRY_DOCKER_HUB_*
+func registryEnvPrefix(name string) string {
+	return "REGISTRY_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+}
@@ -0,0 +1,186 @@
+// Package devicesig signs and verifies device requests.
+//
+// A device signs every request with its own key. The signature covers the
+// canonical request: the method, the request URI, the timestamp, a nonce and
+// the SHA-256 of the body, each on its own line. Keys are strings prefixed
+// with their algorithm, "ed25519:" or "hmac:", followed by base64 key bytes.
+package devicesig
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request headers carrying the signature
+const (
+	HeaderTimestamp = "X-Device-Timestamp"
+	HeaderNonce     = "X-Device-Nonce"
+	HeaderSignature = "X-Device-Signature"
+)
+
+// Key algorithms
+const (
+	AlgorithmEd25519 = "ed25519"
+	AlgorithmHMAC    = "hmac"
+)
+
+// BodyHash returns the hex SHA-256 of a request body
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// CanonicalRequest builds the string a device signs
+func CanonicalRequest(method, requestURI, timestamp, nonce, bodyHash string) string {
+	return strings.Join([]string{strings.ToUpper(method), requestURI, timestamp, nonce, bodyHash}, "\n")
+}
+
+// ChallengeMessage builds the string a device signs to answer a server
+// challenge. It needs no clock on the device.
+func ChallengeMessage(serialNumber, challenge string) string {
+	return strings.Join([]string{"device-challenge", serialNumber, challenge}, "\n")
+}
+
+// ParseTimestamp parses a timestamp header, in Unix seconds
+func ParseTimestamp(value string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// VerifyKey verifies signatures with a device's registered key
+type VerifyKey struct {
+	algorithm string
+	key       []byte
+}
+
+// ParseVerifyKey parses a key stored in the device registry: an Ed25519 public
+// key or an HMAC secret
+func ParseVerifyKey(value string) (*VerifyKey, error) {
+	algorithm, key, err := parseKey(value)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == AlgorithmEd25519 && len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ed25519 public key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return &VerifyKey{algorithm: algorithm, key: key}, nil
+}
+
+// Verify checks a base64 signature over message
+func (k *VerifyKey) Verify(message, signature string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	switch k.algorithm {
+	case AlgorithmEd25519:
+		return ed25519.Verify(ed25519.PublicKey(k.key), []byte(message), sig)
+	case AlgorithmHMAC:
+		return hmac.Equal(sig, hmacSum(k.key, message))
+	}
+	return false
+}
+
+// SigningKey signs requests on the device
+type SigningKey struct {
+	algorithm string
+	key       []byte
+}
+
+// ParseSigningKey parses a device's private key: an Ed25519 seed or private
+// key, or an HMAC secret
+func ParseSigningKey(value string) (*SigningKey, error) {
+	algorithm, key, err := parseKey(value)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == AlgorithmEd25519 {
+		switch len(key) {
+		case ed25519.SeedSize:
+			key = ed25519.NewKeyFromSeed(key)
+		case ed25519.PrivateKeySize:
+		default:
+			return nil, fmt.Errorf("ed25519 private key must be a %d byte seed or %d byte key", ed25519.SeedSize, ed25519.PrivateKeySize)
+		}
+	}
+	return &SigningKey{algorithm: algorithm, key: key}, nil
+}
+
+// VerifyKeyString returns the key to register for this device: the Ed25519
+// public key, or the HMAC secret itself
+func (k *SigningKey) VerifyKeyString() string {
+	key := k.key
+	if k.algorithm == AlgorithmEd25519 {
+		key = ed25519.PrivateKey(k.key).Public().(ed25519.PublicKey)
+	}
+	return k.algorithm + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+// Sign returns the base64 signature of message
+func (k *SigningKey) Sign(message string) string {
+	var sig []byte
+	switch k.algorithm {
+	case AlgorithmEd25519:
+		sig = ed25519.Sign(ed25519.PrivateKey(k.key), []byte(message))
+	case AlgorithmHMAC:
+		sig = hmacSum(k.key, message)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// SignRequest sets the signature headers on req. body must be the request's body.
+func (k *SigningKey) SignRequest(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceString := hex.EncodeToString(nonce)
+	message := CanonicalRequest(req.Method, req.URL.RequestURI(), timestamp, nonceString, BodyHash(body))
+
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonceString)
+	req.Header.Set(HeaderSignature, k.Sign(message))
+	return nil
+}
+
+// parseKey splits "algorithm:base64" into the algorithm and key bytes
+func parseKey(value string) (string, []byte, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		return "", nil, fmt.Errorf("key must be prefixed with ed25519: or hmac:")
+	}
+	if algorithm != AlgorithmEd25519 && algorithm != AlgorithmHMAC {
+		return "", nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid %s key: %w", algorithm, err)
+	}
+	if len(key) == 0 {
+		return "", nil, fmt.Errorf("empty %s key", algorithm)
+	}
+	return algorithm, key, nil
+}
+
+// hmacSum returns the HMAC-SHA256 of message
+func hmacSum(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
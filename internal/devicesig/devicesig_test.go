@@ -0,0 +1,133 @@
+package devicesig
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	keys := map[string]string{
+		"ed25519 seed":        "ed25519:" + base64.StdEncoding.EncodeToString(private.Seed()),
+		"ed25519 private key": "ed25519:" + base64.StdEncoding.EncodeToString(private),
+		"hmac":                "hmac:" + base64.StdEncoding.EncodeToString([]byte("device-secret")),
+	}
+	for name, value := range keys {
+		t.Run(name, func(t *testing.T) {
+			signing, err := ParseSigningKey(value)
+			if err != nil {
+				t.Fatalf("ParseSigningKey: %v", err)
+			}
+			verify, err := ParseVerifyKey(signing.VerifyKeyString())
+			if err != nil {
+				t.Fatalf("ParseVerifyKey: %v", err)
+			}
+
+			signature := signing.Sign("message")
+			if !verify.Verify("message", signature) {
+				t.Error("signature does not verify")
+			}
+			if verify.Verify("other message", signature) {
+				t.Error("signature verifies for another message")
+			}
+			if verify.Verify("message", "not base64!") {
+				t.Error("malformed signature verifies")
+			}
+		})
+	}
+
+	// Only the public half of an Ed25519 key is registered
+	signing, _ := ParseSigningKey(keys["ed25519 seed"])
+	public := base64.StdEncoding.EncodeToString(private.Public().(ed25519.PublicKey))
+	if got := signing.VerifyKeyString(); got != "ed25519:"+public {
+		t.Errorf("VerifyKeyString = %s, want the public key", got)
+	}
+}
+
+func TestParseKeyErrors(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"c2VjcmV0",
+		"rsa:c2VjcmV0",
+		"hmac:not base64!",
+		"hmac:",
+		"ed25519:c2VjcmV0",
+	} {
+		if _, err := ParseSigningKey(value); err == nil {
+			t.Errorf("ParseSigningKey(%q) succeeded", value)
+		}
+		if _, err := ParseVerifyKey(value); err == nil {
+			t.Errorf("ParseVerifyKey(%q) succeeded", value)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	signing, err := ParseSigningKey("hmac:" + base64.StdEncoding.EncodeToString([]byte("device-secret")))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	verify, _ := ParseVerifyKey(signing.VerifyKeyString())
+
+	body := []byte(`{"uptime_seconds": 60}`)
+	req := httptest.NewRequest("post", "/api/v1/devices/heartbeat?verbose=1", nil)
+	if err := signing.SignRequest(req, body); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+
+	timestamp, err := ParseTimestamp(req.Header.Get(HeaderTimestamp))
+	if err != nil || time.Since(timestamp) > time.Minute {
+		t.Errorf("timestamp = %v, %v; want now", timestamp, err)
+	}
+	nonce := req.Header.Get(HeaderNonce)
+	if len(nonce) != 32 {
+		t.Errorf("nonce = %q, want 16 hex-encoded bytes", nonce)
+	}
+
+	// The server rebuilds the canonical request from what it received
+	message := CanonicalRequest("POST", "/api/v1/devices/heartbeat?verbose=1", req.Header.Get(HeaderTimestamp), nonce, BodyHash(body))
+	if !verify.Verify(message, req.Header.Get(HeaderSignature)) {
+		t.Error("request signature does not verify")
+	}
+	if strings.Count(message, "\n") != 4 {
+		t.Errorf("canonical request has %d lines, want 5", strings.Count(message, "\n")+1)
+	}
+
+	tampered := CanonicalRequest("POST", "/api/v1/devices/heartbeat?verbose=1", req.Header.Get(HeaderTimestamp), nonce, BodyHash([]byte("{}")))
+	if verify.Verify(tampered, req.Header.Get(HeaderSignature)) {
+		t.Error("signature verifies for another body")
+	}
+
+	if _, err := ParseTimestamp("yesterday"); err == nil {
+		t.Error("ParseTimestamp accepted a non-numeric timestamp")
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := NewNonceCache(time.Hour)
+
+	if !cache.Use("nonce-1", time.Now().Add(time.Minute)) {
+		t.Fatal("first use of a nonce refused")
+	}
+	if cache.Use("nonce-1", time.Now().Add(time.Minute)) {
+		t.Error("nonce replayed")
+	}
+	if !cache.Use("nonce-2", time.Now().Add(time.Minute)) {
+		t.Error("a different nonce was refused")
+	}
+
+	// Expired nonces are forgotten; the stale timestamp refuses their requests
+	cache.Use("nonce-3", time.Now().Add(-time.Second))
+	if !cache.Use("nonce-3", time.Now().Add(time.Minute)) {
+		t.Error("expired nonce still blocks")
+	}
+}
@@ -0,0 +1,53 @@
+package devicesig
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers nonces until their signatures expire, so a captured
+// request cannot be replayed. Nonces live only in this process, so replicas
+// behind a load balancer each accept a given nonce once
+type NonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// NewNonceCache creates a nonce cache that forgets expired nonces every interval
+func NewNonceCache(interval time.Duration) *NonceCache {
+	c := &NonceCache{
+		nonces: make(map[string]time.Time),
+	}
+	go c.cleanupExpired(interval)
+	return c
+}
+
+// Use records nonce until expiresAt. It returns false if the nonce was
+// already used.
+func (c *NonceCache) Use(nonce string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expiry, ok := c.nonces[nonce]; ok && time.Now().Before(expiry) {
+		return false
+	}
+	c.nonces[nonce] = expiresAt
+	return true
+}
+
+// cleanupExpired periodically forgets nonces whose signatures have expired
+func (c *NonceCache) cleanupExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		c.mu.Lock()
+		for nonce, expiry := range c.nonces {
+			if now.After(expiry) {
+				delete(c.nonces, nonce)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
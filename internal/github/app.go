@@ -1,11 +1,15 @@
 package github
 
 import (
+    "bytes"
+    "crypto"
     "crypto/rsa"
     "encoding/json"
+    "errors"
     "fmt"
-    "io/ioutil"
+    "log"
     "net/http"
+    "sync"
     "time"
 
     "github.com/golang-jwt/jwt/v5"
@@ -14,38 +18,152 @@ import (
 type App struct {
     AppID          string
     InstallationID string
-    PrivateKey     *rsa.PrivateKey
+    BaseURL        string
+    HTTPClient     *http.Client
+    UserAgent      string
+
+    // Retry policy for transient failures, see WithRetry
+    MaxRetries     int
+    RetryBaseDelay time.Duration
+    MaxRetryWait   time.Duration
+    RetryBudget    time.Duration
+
+    // InstallationCacheTTL bounds how long ResolveInstallation trusts its cache
+    InstallationCacheTTL time.Duration
+
+    mu                     sync.Mutex
+    installations          map[string]string
+    installationsFetchedAt time.Time
+    installationsListing   *installationListing
+
+    // signers holds the App's private keys, active key first
+    keyMu   sync.RWMutex
+    signers []crypto.Signer
 }
 
-// NewApp creates a new GitHub App instance
-func NewApp(appID, installationID, privateKeyPath string) (*App, error) {
-    privateKey, err := LoadPrivateKey(privateKeyPath)
-    if err != nil {
-        return nil, fmt.Errorf("failed to load private key: %w", err)
-    }
-    
-    return &App{
+// NewApp creates a new GitHub App instance. signer holds the App's RSA private
+// key: an *rsa.PrivateKey from LoadPrivateKey or ParsePrivateKeyBase64, or a
+// RemoteSigner.
+func NewApp(appID, installationID string, signer crypto.Signer, opts ...Option) (*App, error) {
+    app := &App{
         AppID:          appID,
         InstallationID: installationID,
-        PrivateKey:     privateKey,
-    }, nil
+        BaseURL:        DefaultBaseURL,
+        HTTPClient:     NewHTTPClient(DefaultTimeout),
+        UserAgent:      DefaultUserAgent,
+        MaxRetries:     DefaultMaxRetries,
+        RetryBaseDelay: DefaultRetryBaseDelay,
+        MaxRetryWait:   DefaultMaxRetryWait,
+        RetryBudget:    DefaultRetryBudget,
+        InstallationCacheTTL: DefaultInstallationCacheTTL,
+    }
+    for _, opt := range opts {
+        opt(app)
+    }
+    if err := app.SetSigners(signer); err != nil {
+        return nil, err
+    }
+    return app, nil
 }
 
-// LoadPrivateKey loads the private key from a file.
-func LoadPrivateKey(filePath string) (*rsa.PrivateKey, error) {
-    keyData, err := ioutil.ReadFile(filePath)
-    if err != nil {
-        return nil, err
+// SetSigners replaces the App's keys. The first signer becomes the active key;
+// the others are tried in order when GitHub rejects it, which lets a key be
+// rotated while both the old and the new key are registered with GitHub.
+func (app *App) SetSigners(signers ...crypto.Signer) error {
+    if len(signers) == 0 {
+        return fmt.Errorf("at least one GitHub App key is required")
     }
-    privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
-    if err != nil {
-        return nil, err
+    for _, signer := range signers {
+        if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+            return fmt.Errorf("GitHub App key must be RSA, got %T", signer.Public())
+        }
     }
-    return privateKey, nil
+
+    app.keyMu.Lock()
+    app.signers = append([]crypto.Signer(nil), signers...)
+    app.keyMu.Unlock()
+    return nil
 }
 
-// GenerateJWT generates a JWT token for the GitHub App.
+// Signers returns the App's keys, active key first
+func (app *App) Signers() []crypto.Signer {
+    app.keyMu.RLock()
+    defer app.keyMu.RUnlock()
+
+    return append([]crypto.Signer(nil), app.signers...)
+}
+
+// KeyFingerprints returns the fingerprints of the App's keys, active key first,
+// in the "SHA256:..." format GitHub shows in the App settings.
+func (app *App) KeyFingerprints() []string {
+    signers := app.Signers()
+    fingerprints := make([]string, 0, len(signers))
+    for _, signer := range signers {
+        fingerprints = append(fingerprints, KeyFingerprint(signer))
+    }
+    return fingerprints
+}
+
+// promoteSigner makes signer the active key after GitHub accepted it
+func (app *App) promoteSigner(signer crypto.Signer) {
+    app.keyMu.Lock()
+    defer app.keyMu.Unlock()
+
+    for i, candidate := range app.signers {
+        if candidate == signer && i > 0 {
+            copy(app.signers[1:i+1], app.signers[:i])
+            app.signers[0] = signer
+            log.Printf("GitHub App key %s is now active", KeyFingerprint(signer))
+            return
+        }
+    }
+}
+
+// doWithAppJWT performs an App-authenticated request, falling back to older
+// keys when GitHub rejects the active key's JWT
+func (app *App) doWithAppJWT(build func(jwtToken string) (*http.Request, error), expected ...int) (*http.Response, error) {
+    signers := app.Signers()
+
+    var lastErr error
+    for i, signer := range signers {
+        jwtToken, err := app.signJWT(signer)
+        if err != nil {
+            return nil, err
+        }
+
+        resp, err := app.do(func() (*http.Request, error) {
+            return build(jwtToken)
+        }, expected...)
+        if err == nil {
+            if i > 0 {
+                app.promoteSigner(signer)
+            }
+            return resp, nil
+        }
+
+        var apiErr *APIError
+        if !errors.As(err, &apiErr) || apiErr.Kind != ErrorKindBadCredentials {
+            return nil, err
+        }
+        if i+1 < len(signers) {
+            log.Printf("GitHub rejected App key %s, trying previous key", KeyFingerprint(signer))
+        }
+        lastErr = err
+    }
+    return nil, lastErr
+}
+
+// GenerateJWT generates a JWT token for the GitHub App with the active key.
 func (app *App) GenerateJWT() (string, error) {
+    signers := app.Signers()
+    if len(signers) == 0 {
+        return "", fmt.Errorf("no GitHub App key configured")
+    }
+    return app.signJWT(signers[0])
+}
+
+// signJWT generates an App JWT signed by signer.
+func (app *App) signJWT(signer crypto.Signer) (string, error) {
     now := time.Now()
     claims := &jwt.RegisteredClaims{
         IssuedAt:  jwt.NewNumericDate(now),
@@ -53,68 +171,158 @@ func (app *App) GenerateJWT() (string, error) {
         Subject:   app.AppID,
     }
 
-    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-    signedToken, err := token.SignedString(app.PrivateKey)
+    token := jwt.NewWithClaims(rs256Signer, claims)
+    signedToken, err := token.SignedString(signer)
     if err != nil {
         return "", err
     }
     return signedToken, nil
 }
 
+// InstallationToken is GitHub's response to an access_tokens request
+type InstallationToken struct {
+    Token               string            `json:"token"`
+    ExpiresAt           time.Time         `json:"expires_at"`
+    Permissions         map[string]string `json:"permissions,omitempty"`
+    RepositorySelection string            `json:"repository_selection,omitempty"`
+    Repositories        []Repository      `json:"repositories,omitempty"`
+}
+
+// Repository is the subset of a GitHub repository we care about
+type Repository struct {
+    ID       int64  `json:"id"`
+    Name     string `json:"name"`
+    FullName string `json:"full_name"`
+    Private  bool   `json:"private"`
+}
+
+// TokenScope restricts an installation token to a subset of the installation's
+// repositories and permissions. Empty fields inherit the installation's access.
+type TokenScope struct {
+    Repositories []string          `json:"repositories,omitempty"`
+    Permissions  map[string]string `json:"permissions,omitempty"`
+}
+
 // FetchInstallationToken retrieves the installation token for the GitHub App.
-func (app *App) FetchInstallationToken(installationID string) (string, error) {
-    jwtToken, err := app.GenerateJWT()
-    if err != nil {
-        return "", err
+// A nil scope requests a token with the installation's full access.
+func (app *App) FetchInstallationToken(installationID string, scope *TokenScope) (*InstallationToken, error) {
+    if scope == nil {
+        scope = &TokenScope{}
     }
-
-    url := fmt.Sprintf("https://api.github.com/app/installations/%s/access_tokens", installationID)
-    req, err := http.NewRequest("POST", url, nil)
+    body, err := json.Marshal(scope)
     if err != nil {
-        return "", err
+        return nil, err
     }
-    req.Header.Set("Authorization", "Bearer "+jwtToken)
-    req.Header.Set("Accept", "application/vnd.github.v3+json")
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
+    path := fmt.Sprintf("/app/installations/%s/access_tokens", installationID)
+    resp, err := app.doWithAppJWT(func(jwtToken string) (*http.Request, error) {
+        req, err := app.newRequest("POST", path, bytes.NewReader(body))
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Authorization", "Bearer "+jwtToken)
+        return req, nil
+    }, http.StatusCreated)
     if err != nil {
-        return "", err
+        var apiErr *APIError
+        if errors.As(err, &apiErr) && apiErr.Kind == ErrorKindNotFound {
+            apiErr.Kind = ErrorKindInstallationNotFound
+        }
+        return nil, fmt.Errorf("failed to fetch installation token: %w", err)
     }
     defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusCreated {
-        return "", fmt.Errorf("failed to fetch installation token: %s", resp.Status)
-    }
-
-    var result map[string]interface{}
+    var result InstallationToken
     if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-        return "", err
+        return nil, err
     }
 
-    token, ok := result["token"].(string)
-    if !ok {
-        return "", fmt.Errorf("token not found in response")
+    if result.Token == "" {
+        return nil, fmt.Errorf("token not found in response")
     }
-    return token, nil
+    return &result, nil
 }
 
 // GitHubTokenResponse represents a GitHub token response
 type GitHubTokenResponse struct {
-    Token     string    `json:"token"`
-    ExpiresAt time.Time `json:"expires_at"`
+    Token               string            `json:"token"`
+    ExpiresAt           time.Time         `json:"expires_at"`
+    Permissions         map[string]string `json:"permissions,omitempty"`
+    RepositorySelection string            `json:"repository_selection,omitempty"`
+    Repositories        []string          `json:"repositories,omitempty"`
 }
 
-// GetInstallationToken gets the installation token with structured response
-func (app *App) GetInstallationToken() (*GitHubTokenResponse, error) {
-    token, err := app.FetchInstallationToken(app.InstallationID)
+// GetInstallationToken gets the installation token with structured response.
+// An empty installationID uses the App's default installation.
+func (app *App) GetInstallationToken(installationID string, scope *TokenScope) (*GitHubTokenResponse, error) {
+    if installationID == "" {
+        installationID = app.InstallationID
+    }
+    token, err := app.FetchInstallationToken(installationID, scope)
     if err != nil {
         return nil, err
     }
-    
-    // GitHub tokens typically expire in 1 hour
+
+    expiresAt := token.ExpiresAt
+    if expiresAt.IsZero() {
+        // GitHub always sends expires_at, but never hand out a token without one
+        expiresAt = time.Now().Add(time.Hour)
+    }
+
+    repositories := make([]string, 0, len(token.Repositories))
+    for _, repo := range token.Repositories {
+        repositories = append(repositories, repo.FullName)
+    }
+
     return &GitHubTokenResponse{
-        Token:     token,
-        ExpiresAt: time.Now().Add(time.Hour),
+        Token:               token.Token,
+        ExpiresAt:           expiresAt,
+        Permissions:         token.Permissions,
+        RepositorySelection: token.RepositorySelection,
+        Repositories:        repositories,
     }, nil
-}
\ No newline at end of file
+}
+
+// CheckInstallationToken asks GitHub whether an installation token is still
+// accepted, using the cheapest call available to installation tokens.
+func (app *App) CheckInstallationToken(token string) (bool, error) {
+    resp, err := app.do(func() (*http.Request, error) {
+        req, err := app.newRequest("GET", "/installation/repositories?per_page=1", nil)
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Authorization", "token "+token)
+        return req, nil
+    }, http.StatusOK)
+    if err != nil {
+        var apiErr *APIError
+        if errors.As(err, &apiErr) && apiErr.Kind == ErrorKindBadCredentials {
+            return false, nil
+        }
+        return false, fmt.Errorf("failed to check installation token: %w", err)
+    }
+    resp.Body.Close()
+    return true, nil
+}
+
+// RevokeInstallationToken revokes an installation token before it expires.
+// Tokens GitHub no longer accepts are treated as already revoked.
+func (app *App) RevokeInstallationToken(token string) error {
+    resp, err := app.do(func() (*http.Request, error) {
+        req, err := app.newRequest("DELETE", "/installation/token", nil)
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Authorization", "token "+token)
+        return req, nil
+    }, http.StatusNoContent)
+    if err != nil {
+        var apiErr *APIError
+        if errors.As(err, &apiErr) && apiErr.Kind == ErrorKindBadCredentials {
+            return nil
+        }
+        return fmt.Errorf("failed to revoke installation token: %w", err)
+    }
+    resp.Body.Close()
+    return nil
+}
@@ -0,0 +1,156 @@
+package github
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestKey returns a fresh RSA key for signing App JWTs
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+// newTestApp returns an App with key talking to an httptest server running
+// handler. Retries are off unless opts turn them on.
+func newTestApp(t *testing.T, key *rsa.PrivateKey, handler http.HandlerFunc, opts ...Option) *App {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	opts = append([]Option{WithBaseURL(server.URL + "/"), WithRetry(0, 0, 0)}, opts...)
+	app, err := NewApp("123", "42", key, opts...)
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	return app
+}
+
+// appJWTSubject returns the App ID of a request's App JWT if it verifies
+// under key, or ""
+func appJWTSubject(r *http.Request, key *rsa.PrivateKey) string {
+	raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token, err := jwt.ParseWithClaims(raw, &jwt.RegisteredClaims{}, func(*jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	if err != nil {
+		return ""
+	}
+	subject, _ := token.Claims.GetSubject()
+	return subject
+}
+
+func TestGetInstallationToken(t *testing.T) {
+	key := newTestKey(t)
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	var scope TokenScope
+	app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+			t.Errorf("request = %s %s, want POST /app/installations/42/access_tokens", r.Method, r.URL.Path)
+		}
+		if ua := r.Header.Get("User-Agent"); ua != "fleet-tokens/1.0" {
+			t.Errorf("User-Agent = %q, want fleet-tokens/1.0", ua)
+		}
+		if subject := appJWTSubject(r, key); subject != "123" {
+			t.Errorf("App JWT subject = %q, want a valid JWT for App 123", subject)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&scope); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":                "ghs_test",
+			"expires_at":           expiresAt,
+			"permissions":          map[string]string{"packages": "read"},
+			"repository_selection": "selected",
+			"repositories":         []map[string]interface{}{{"id": 1, "name": "app", "full_name": "ared-group/app"}},
+		})
+	}, WithUserAgent("fleet-tokens/1.0"))
+
+	// An empty installation ID selects the App's default installation
+	token, err := app.GetInstallationToken("", &TokenScope{
+		Repositories: []string{"app"},
+		Permissions:  map[string]string{"packages": "read"},
+	})
+	if err != nil {
+		t.Fatalf("GetInstallationToken: %v", err)
+	}
+
+	if !reflect.DeepEqual(scope.Repositories, []string{"app"}) || scope.Permissions["packages"] != "read" {
+		t.Errorf("requested scope = %+v, want repository app with packages: read", scope)
+	}
+	want := &GitHubTokenResponse{
+		Token:               "ghs_test",
+		ExpiresAt:           expiresAt,
+		Permissions:         map[string]string{"packages": "read"},
+		RepositorySelection: "selected",
+		Repositories:        []string{"ared-group/app"},
+	}
+	if !token.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", token.ExpiresAt, want.ExpiresAt)
+	}
+	token.ExpiresAt = want.ExpiresAt
+	if !reflect.DeepEqual(token, want) {
+		t.Errorf("token = %+v, want %+v", token, want)
+	}
+}
+
+func TestNewHTTPClientTimeout(t *testing.T) {
+	if client := NewHTTPClient(0); client.Timeout != DefaultTimeout {
+		t.Errorf("default timeout = %v, want %v", client.Timeout, DefaultTimeout)
+	}
+	if client := NewHTTPClient(3 * time.Second); client.Timeout != 3*time.Second {
+		t.Errorf("timeout = %v, want 3s", client.Timeout)
+	}
+}
+
+func TestKeyFallback(t *testing.T) {
+	newKey, oldKey := newTestKey(t), newTestKey(t)
+
+	// GitHub only knows the old key until the new one is registered
+	app := newTestApp(t, oldKey, func(w http.ResponseWriter, r *http.Request) {
+		if appJWTSubject(r, oldKey) == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_test"}`))
+	})
+	if err := app.SetSigners(newKey, oldKey); err != nil {
+		t.Fatalf("SetSigners: %v", err)
+	}
+
+	if _, err := app.FetchInstallationToken("42", nil); err != nil {
+		t.Fatalf("FetchInstallationToken: %v", err)
+	}
+	if active := app.KeyFingerprints()[0]; active != KeyFingerprint(oldKey) {
+		t.Errorf("active key = %s, want the accepted old key %s", active, KeyFingerprint(oldKey))
+	}
+
+	// Once neither key is accepted the error is bad credentials
+	if err := app.SetSigners(newKey); err != nil {
+		t.Fatalf("SetSigners: %v", err)
+	}
+	var apiErr *APIError
+	if _, err := app.FetchInstallationToken("42", nil); !errors.As(err, &apiErr) || apiErr.Kind != ErrorKindBadCredentials {
+		t.Errorf("error = %v, want bad credentials", err)
+	}
+}
@@ -0,0 +1,189 @@
+package github
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the public GitHub REST API endpoint
+	DefaultBaseURL = "https://api.github.com"
+
+	// DefaultUserAgent identifies this service to GitHub
+	DefaultUserAgent = "dynamic-token-manager"
+
+	// DefaultTimeout bounds a single request to the GitHub API
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultMaxRetries is how many times a transient failure is retried
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBaseDelay is the first backoff delay; later delays double
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+
+	// DefaultMaxRetryWait caps how long a single retry may wait, including
+	// waits requested by GitHub through Retry-After or X-RateLimit-Reset
+	DefaultMaxRetryWait = 5 * time.Second
+
+	// DefaultRetryBudget caps a call including all of its retries, so a
+	// retried call still finishes within the server's write timeout
+	DefaultRetryBudget = 12 * time.Second
+)
+
+// Option configures an App
+type Option func(*App)
+
+// WithBaseURL points the App at a different API endpoint, e.g. GitHub
+// Enterprise Server ("https://github.example.com/api/v3"), an internal proxy or
+// an httptest server.
+func WithBaseURL(baseURL string) Option {
+	return func(app *App) {
+		if baseURL != "" {
+			app.BaseURL = strings.TrimRight(baseURL, "/")
+		}
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for GitHub API calls
+func WithHTTPClient(client *http.Client) Option {
+	return func(app *App) {
+		if client != nil {
+			app.HTTPClient = client
+		}
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent to GitHub
+func WithUserAgent(userAgent string) Option {
+	return func(app *App) {
+		if userAgent != "" {
+			app.UserAgent = userAgent
+		}
+	}
+}
+
+// WithRetry configures retries of transient failures and short rate limits
+func WithRetry(maxRetries int, baseDelay, maxWait time.Duration) Option {
+	return func(app *App) {
+		if maxRetries >= 0 {
+			app.MaxRetries = maxRetries
+		}
+		if baseDelay > 0 {
+			app.RetryBaseDelay = baseDelay
+		}
+		if maxWait > 0 {
+			app.MaxRetryWait = maxWait
+		}
+	}
+}
+
+// WithRetryBudget caps the total time a call may spend on attempts and retry
+// waits. A retry is only started when it can finish, HTTP client timeout
+// included, within the budget.
+func WithRetryBudget(budget time.Duration) Option {
+	return func(app *App) {
+		if budget > 0 {
+			app.RetryBudget = budget
+		}
+	}
+}
+
+// NewHTTPClient returns an HTTP client with timeouts suitable for the GitHub API
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   10,
+		},
+	}
+}
+
+// newRequest builds a request against the App's API base URL
+func (app *App) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, app.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("User-Agent", app.UserAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// do sends the request produced by build and returns the response if its
+// status is one of expected. Network errors and 5xx responses are retried with
+// jittered exponential backoff; rate limits are retried only when GitHub asks
+// us to wait no longer than MaxRetryWait, and no retry is started that could
+// run past RetryBudget. Any other failure is returned as an *APIError. build is
+// called for every attempt so request bodies are fresh.
+func (app *App) do(build func() (*http.Request, error), expected ...int) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+
+		var apiErr *APIError
+		resp, err := app.HTTPClient.Do(req)
+		if err != nil {
+			apiErr = &APIError{Kind: ErrorKindTransient, Err: err}
+		} else {
+			for _, status := range expected {
+				if resp.StatusCode == status {
+					return resp, nil
+				}
+			}
+			apiErr = newAPIError(resp)
+			resp.Body.Close()
+		}
+
+		if !apiErr.Temporary() || attempt >= app.MaxRetries {
+			return nil, apiErr
+		}
+
+		wait := apiErr.RetryAfter
+		if wait <= 0 {
+			wait = app.backoff(attempt)
+		}
+		if wait > app.MaxRetryWait {
+			return nil, apiErr
+		}
+		if app.RetryBudget > 0 && time.Since(start)+wait+app.HTTPClient.Timeout > app.RetryBudget {
+			return nil, apiErr
+		}
+
+		log.Printf("GitHub %s %s failed (attempt %d/%d), retrying in %v: %v",
+			req.Method, req.URL.Path, attempt+1, app.MaxRetries+1, wait, apiErr)
+		time.Sleep(wait)
+	}
+}
+
+// backoff returns the jittered exponential delay before retry attempt+1
+func (app *App) backoff(attempt int) time.Duration {
+	delay := app.RetryBaseDelay << uint(attempt)
+	if delay <= 0 || delay > app.MaxRetryWait {
+		delay = app.MaxRetryWait
+	}
+	// Full jitter in [delay/2, delay) keeps a rebooting fleet from retrying in lockstep
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
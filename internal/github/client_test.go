@@ -0,0 +1,164 @@
+package github
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetriesTransientFailures(t *testing.T) {
+	key := newTestKey(t)
+
+	var attempts atomic.Int32
+	app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"token": "ghs_test"}`))
+	}, WithRetry(3, time.Millisecond, 10*time.Millisecond))
+
+	token, err := app.FetchInstallationToken("42", nil)
+	if err != nil {
+		t.Fatalf("FetchInstallationToken: %v", err)
+	}
+	if token.Token != "ghs_test" || attempts.Load() != 3 {
+		t.Errorf("got %q after %d attempts, want ghs_test after 3", token.Token, attempts.Load())
+	}
+}
+
+func TestRetryLimits(t *testing.T) {
+	key := newTestKey(t)
+
+	tests := []struct {
+		name     string
+		respond  func(w http.ResponseWriter)
+		opts     []Option
+		attempts int32
+		kind     ErrorKind
+	}{
+		{
+			name:     "retries exhausted",
+			respond:  func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			opts:     []Option{WithRetry(2, time.Millisecond, 10*time.Millisecond)},
+			attempts: 3,
+			kind:     ErrorKindTransient,
+		},
+		{
+			name: "rate limit reset too far away",
+			respond: func(w http.ResponseWriter) {
+				w.Header().Set("X-RateLimit-Remaining", "0")
+				w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"message": "API rate limit exceeded"}`))
+			},
+			opts:     []Option{WithRetry(3, time.Millisecond, time.Second)},
+			attempts: 1,
+			kind:     ErrorKindRateLimited,
+		},
+		{
+			name:    "retry would overrun the budget",
+			respond: func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) },
+			opts: []Option{
+				WithRetry(3, time.Millisecond, 10*time.Millisecond),
+				WithHTTPClient(&http.Client{Timeout: time.Second}),
+				WithRetryBudget(500 * time.Millisecond),
+			},
+			attempts: 1,
+			kind:     ErrorKindTransient,
+		},
+		{
+			name:     "bad credentials are not retried",
+			respond:  func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) },
+			opts:     []Option{WithRetry(3, time.Millisecond, 10*time.Millisecond)},
+			attempts: 1,
+			kind:     ErrorKindBadCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				tt.respond(w)
+			}, tt.opts...)
+
+			_, err := app.FetchInstallationToken("42", nil)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Kind != tt.kind {
+				t.Fatalf("error = %v, want a %s APIError", err, tt.kind)
+			}
+			if n := attempts.Load(); n != tt.attempts {
+				t.Errorf("attempts = %d, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	app := &App{RetryBaseDelay: 100 * time.Millisecond, MaxRetryWait: time.Second}
+
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 20; i++ {
+			if delay := app.backoff(attempt); delay < max/2 || delay > max {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", attempt, delay, max/2, max)
+			}
+		}
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		headers    map[string]string
+		body       string
+		kind       ErrorKind
+		retryAfter time.Duration
+	}{
+		{"server error", http.StatusBadGateway, nil, "", ErrorKindTransient, 0},
+		{"server error with retry hint", http.StatusServiceUnavailable, map[string]string{"Retry-After": "7"}, "", ErrorKindTransient, 7 * time.Second},
+		{"too many requests", http.StatusTooManyRequests, map[string]string{"Retry-After": "3"}, "", ErrorKindRateLimited, 3 * time.Second},
+		{"secondary rate limit", http.StatusForbidden, nil, `{"message": "You have exceeded a secondary rate limit"}`, ErrorKindRateLimited, 0},
+		{"bad credentials", http.StatusUnauthorized, nil, `{"message": "Bad credentials"}`, ErrorKindBadCredentials, 0},
+		{"suspended", http.StatusForbidden, nil, `{"message": "This installation has been suspended"}`, ErrorKindAppSuspended, 0},
+		{"not found", http.StatusNotFound, nil, `{"message": "Not Found"}`, ErrorKindNotFound, 0},
+		{"other client error", http.StatusUnprocessableEntity, nil, `{"message": "Validation Failed"}`, ErrorKindRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			for key, value := range tt.headers {
+				rec.Header().Set(key, value)
+			}
+			rec.WriteHeader(tt.status)
+			rec.WriteString(tt.body)
+
+			apiErr := newAPIError(rec.Result())
+			if apiErr.Kind != tt.kind || apiErr.StatusCode != tt.status || apiErr.RetryAfter != tt.retryAfter {
+				t.Errorf("newAPIError = %+v, want kind %s, status %d, retry after %v", apiErr, tt.kind, tt.status, tt.retryAfter)
+			}
+			if apiErr.Temporary() != (tt.kind == ErrorKindTransient || tt.kind == ErrorKindRateLimited) {
+				t.Errorf("Temporary() = %v for kind %s", apiErr.Temporary(), tt.kind)
+			}
+		})
+	}
+}
+
+func TestInstallationNotFound(t *testing.T) {
+	key := newTestKey(t)
+	app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	if _, err := app.FetchInstallationToken("42", nil); !errors.Is(err, ErrInstallationNotFound) {
+		t.Errorf("error = %v, want ErrInstallationNotFound", err)
+	}
+}
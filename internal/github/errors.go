@@ -0,0 +1,134 @@
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorKind classifies failures returned by the GitHub API
+type ErrorKind string
+
+const (
+	// ErrorKindTransient covers network errors and 5xx responses worth retrying
+	ErrorKindTransient ErrorKind = "transient"
+	// ErrorKindRateLimited means GitHub throttled the App; see RetryAfter
+	ErrorKindRateLimited ErrorKind = "rate_limited"
+	// ErrorKindBadCredentials means GitHub rejected the App JWT or token
+	ErrorKindBadCredentials ErrorKind = "bad_credentials"
+	// ErrorKindAppSuspended means the App or installation has been suspended
+	ErrorKindAppSuspended ErrorKind = "app_suspended"
+	// ErrorKindInstallationNotFound means the installation was removed
+	ErrorKindInstallationNotFound ErrorKind = "installation_not_found"
+	// ErrorKindNotFound is a 404 on anything other than an installation
+	ErrorKindNotFound ErrorKind = "not_found"
+	// ErrorKindRequest covers any other client error
+	ErrorKindRequest ErrorKind = "request"
+)
+
+// APIError is a classified failure talking to the GitHub API
+type APIError struct {
+	Kind       ErrorKind
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("github %s error: %v", e.Kind, e.Err)
+	case e.Message != "":
+		return fmt.Sprintf("github %s error (%d): %s", e.Kind, e.StatusCode, e.Message)
+	default:
+		return fmt.Sprintf("github %s error (%d)", e.Kind, e.StatusCode)
+	}
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets errors.Is match ErrInstallationNotFound against classified 404s
+func (e *APIError) Is(target error) bool {
+	return target == ErrInstallationNotFound && e.Kind == ErrorKindInstallationNotFound
+}
+
+// Temporary reports whether the request may succeed if retried later
+func (e *APIError) Temporary() bool {
+	return e.Kind == ErrorKindTransient || e.Kind == ErrorKindRateLimited
+}
+
+// newAPIError classifies a non-successful GitHub response. The body is read
+// but not closed.
+func newAPIError(resp *http.Response) *APIError {
+	var payload struct {
+		Message string `json:"message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &payload) != nil {
+		payload.Message = strings.TrimSpace(string(body))
+	}
+
+	apiErr := &APIError{
+		Kind:       ErrorKindRequest,
+		StatusCode: resp.StatusCode,
+		Message:    payload.Message,
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = resp.Status
+	}
+
+	message := strings.ToLower(payload.Message)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusForbidden && isRateLimited(resp, message):
+		apiErr.Kind = ErrorKindRateLimited
+		apiErr.RetryAfter = retryAfter(resp)
+	case resp.StatusCode == http.StatusUnauthorized:
+		apiErr.Kind = ErrorKindBadCredentials
+	case resp.StatusCode == http.StatusForbidden && strings.Contains(message, "suspended"):
+		apiErr.Kind = ErrorKindAppSuspended
+	case resp.StatusCode == http.StatusNotFound:
+		apiErr.Kind = ErrorKindNotFound
+	case resp.StatusCode >= 500:
+		apiErr.Kind = ErrorKindTransient
+		apiErr.RetryAfter = retryAfter(resp)
+	}
+
+	return apiErr
+}
+
+// isRateLimited detects primary and secondary rate limits on a 403
+func isRateLimited(resp *http.Response, message string) bool {
+	return resp.Header.Get("X-RateLimit-Remaining") == "0" ||
+		resp.Header.Get("Retry-After") != "" ||
+		strings.Contains(message, "rate limit")
+}
+
+// retryAfter reads Retry-After or X-RateLimit-Reset from a response
+func retryAfter(resp *http.Response) time.Duration {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return time.Until(at)
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+				return wait
+			}
+		}
+	}
+
+	return 0
+}
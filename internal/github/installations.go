@@ -0,0 +1,173 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInstallationNotFound is returned when the App is not installed on an account
+var ErrInstallationNotFound = errors.New("GitHub App installation not found")
+
+// DefaultInstallationCacheTTL is how long discovered installations are cached
+const DefaultInstallationCacheTTL = 10 * time.Minute
+
+// installationNegativeCacheTTL is how long an unknown login is answered from
+// the last listing before the installations are listed again
+const installationNegativeCacheTTL = 30 * time.Second
+
+// Installation is a GitHub App installation on a user or organization account
+type Installation struct {
+	ID          int64      `json:"id"`
+	Account     Account    `json:"account"`
+	TargetType  string     `json:"target_type"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+}
+
+// installationListing is an in-flight ListInstallations shared by concurrent
+// ResolveInstallation calls
+type installationListing struct {
+	done    chan struct{}
+	mapping map[string]string
+	err     error
+}
+
+// Account is the user or organization an installation belongs to
+type Account struct {
+	Login string `json:"login"`
+	Type  string `json:"type"`
+}
+
+// WithInstallationCacheTTL sets how long the login to installation mapping is cached
+func WithInstallationCacheTTL(ttl time.Duration) Option {
+	return func(app *App) {
+		if ttl > 0 {
+			app.InstallationCacheTTL = ttl
+		}
+	}
+}
+
+// ListInstallations lists every installation of the App, following pagination
+func (app *App) ListInstallations() ([]Installation, error) {
+	const perPage = 100
+	var installations []Installation
+	for page := 1; ; page++ {
+		path := fmt.Sprintf("/app/installations?per_page=%d&page=%d", perPage, page)
+		resp, err := app.doWithAppJWT(func(jwtToken string) (*http.Request, error) {
+			req, err := app.newRequest("GET", path, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+jwtToken)
+			return req, nil
+		}, http.StatusOK)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list installations: %w", err)
+		}
+
+		var batch []Installation
+		err = json.NewDecoder(resp.Body).Decode(&batch)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		installations = append(installations, batch...)
+		if len(batch) < perPage {
+			return installations, nil
+		}
+	}
+}
+
+// GetInstallation fetches a single installation of the App
+func (app *App) GetInstallation(installationID string) (*Installation, error) {
+	resp, err := app.doWithAppJWT(func(jwtToken string) (*http.Request, error) {
+		req, err := app.newRequest("GET", "/app/installations/"+installationID, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+jwtToken)
+		return req, nil
+	}, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get installation %s: %w", installationID, err)
+	}
+	defer resp.Body.Close()
+
+	var installation Installation
+	if err := json.NewDecoder(resp.Body).Decode(&installation); err != nil {
+		return nil, err
+	}
+	return &installation, nil
+}
+
+// ResolveInstallation returns the installation ID for an account login. The
+// mapping is cached and re-listed when stale or when the login is unknown;
+// unknown logins are not re-listed more than once per
+// installationNegativeCacheTTL, and concurrent re-lists share one call.
+func (app *App) ResolveInstallation(login string) (string, error) {
+	key := strings.ToLower(login)
+
+	app.mu.Lock()
+	id, ok := app.installations[key]
+	age := time.Since(app.installationsFetchedAt)
+	app.mu.Unlock()
+
+	if ok && age < app.InstallationCacheTTL {
+		return id, nil
+	}
+	if !ok && age < installationNegativeCacheTTL {
+		return "", fmt.Errorf("%w for account %s", ErrInstallationNotFound, login)
+	}
+
+	mapping, err := app.relistInstallations()
+	if err != nil {
+		return "", err
+	}
+
+	id, ok = mapping[key]
+	if !ok {
+		return "", fmt.Errorf("%w for account %s", ErrInstallationNotFound, login)
+	}
+	return id, nil
+}
+
+// relistInstallations refreshes the login to installation mapping, joining a
+// listing already in flight
+func (app *App) relistInstallations() (map[string]string, error) {
+	app.mu.Lock()
+	if call := app.installationsListing; call != nil {
+		app.mu.Unlock()
+		<-call.done
+		return call.mapping, call.err
+	}
+	call := &installationListing{done: make(chan struct{})}
+	app.installationsListing = call
+	app.mu.Unlock()
+
+	installations, err := app.ListInstallations()
+	if err == nil {
+		call.mapping = make(map[string]string, len(installations))
+		for _, installation := range installations {
+			if installation.SuspendedAt != nil {
+				continue
+			}
+			call.mapping[strings.ToLower(installation.Account.Login)] = fmt.Sprintf("%d", installation.ID)
+		}
+	}
+	call.err = err
+
+	app.mu.Lock()
+	if err == nil {
+		app.installations = call.mapping
+		app.installationsFetchedAt = time.Now()
+	}
+	app.installationsListing = nil
+	app.mu.Unlock()
+
+	close(call.done)
+	return call.mapping, call.err
+}
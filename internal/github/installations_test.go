@@ -0,0 +1,107 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListInstallationsPaginates(t *testing.T) {
+	key := newTestKey(t)
+	app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+		var batch []Installation
+		if r.URL.Query().Get("page") == "1" {
+			for i := 0; i < 100; i++ {
+				batch = append(batch, Installation{ID: int64(i), Account: Account{Login: fmt.Sprintf("org-%d", i)}})
+			}
+		} else {
+			batch = []Installation{{ID: 100, Account: Account{Login: "org-100"}}}
+		}
+		json.NewEncoder(w).Encode(batch)
+	})
+
+	installations, err := app.ListInstallations()
+	if err != nil {
+		t.Fatalf("ListInstallations: %v", err)
+	}
+	if len(installations) != 101 {
+		t.Errorf("got %d installations, want 101 across two pages", len(installations))
+	}
+}
+
+func TestResolveInstallation(t *testing.T) {
+	key := newTestKey(t)
+	suspended := time.Now()
+
+	var listings atomic.Int32
+	release := make(chan struct{})
+	app := newTestApp(t, key, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/installations" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		listings.Add(1)
+		<-release
+		json.NewEncoder(w).Encode([]Installation{
+			{ID: 1, Account: Account{Login: "ARED-Group"}},
+			{ID: 2, Account: Account{Login: "customer"}},
+			{ID: 3, Account: Account{Login: "suspended-org"}, SuspendedAt: &suspended},
+		})
+	})
+
+	// Concurrent lookups share one listing
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := app.ResolveInstallation("ared-group")
+			if err != nil {
+				t.Errorf("ResolveInstallation: %v", err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := listings.Load(); n != 1 {
+		t.Errorf("listings = %d, want 1", n)
+	}
+	for i, id := range ids {
+		if id != "1" {
+			t.Errorf("lookup %d = %q, want 1 (logins match case-insensitively)", i, id)
+		}
+	}
+
+	if id, err := app.ResolveInstallation("customer"); err != nil || id != "2" {
+		t.Errorf("ResolveInstallation(customer) = %q, %v; want 2 from the cache", id, err)
+	}
+
+	// Unknown and suspended logins are answered from the recent listing
+	for _, login := range []string{"unknown", "suspended-org"} {
+		if _, err := app.ResolveInstallation(login); !errors.Is(err, ErrInstallationNotFound) {
+			t.Errorf("ResolveInstallation(%s) error = %v, want ErrInstallationNotFound", login, err)
+		}
+	}
+	if n := listings.Load(); n != 1 {
+		t.Errorf("listings after cached lookups = %d, want 1", n)
+	}
+
+	// Once the listing is stale an unknown login lists again
+	app.mu.Lock()
+	app.installationsFetchedAt = time.Now().Add(-installationNegativeCacheTTL)
+	app.mu.Unlock()
+	if _, err := app.ResolveInstallation("unknown"); !errors.Is(err, ErrInstallationNotFound) {
+		t.Errorf("ResolveInstallation(unknown) error = %v, want ErrInstallationNotFound", err)
+	}
+	if n := listings.Load(); n != 2 {
+		t.Errorf("listings after the negative cache expired = %d, want 2", n)
+	}
+}
@@ -0,0 +1,272 @@
+package github
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingMethodSigner is RS256 backed by any crypto.Signer, so the App key can
+// live outside this process (HSM, KMS, signing daemon).
+type signingMethodSigner struct{}
+
+var rs256Signer = &signingMethodSigner{}
+
+func (m *signingMethodSigner) Alg() string {
+	return jwt.SigningMethodRS256.Alg()
+}
+
+func (m *signingMethodSigner) Verify(signingString string, sig []byte, key interface{}) error {
+	return jwt.SigningMethodRS256.Verify(signingString, sig, key)
+}
+
+func (m *signingMethodSigner) Sign(signingString string, key interface{}) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, jwt.ErrInvalidKeyType
+	}
+
+	digest := sha256.Sum256([]byte(signingString))
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// KeyFingerprint returns the SHA-256 fingerprint of a signer's public key in
+// the "SHA256:<base64>" format GitHub displays for App private keys
+func KeyFingerprint(signer crypto.Signer) string {
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// LoadPrivateKey loads the private key from a file.
+func LoadPrivateKey(filePath string) (*rsa.PrivateKey, error) {
+	keyData, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseRSAPrivateKeyFromPEM(keyData)
+}
+
+// ParsePrivateKeyBase64 parses a PEM private key that has been base64 encoded
+// to fit in an environment variable. A raw PEM value is accepted as well.
+func ParsePrivateKeyBase64(value string) (*rsa.PrivateKey, error) {
+	keyData := []byte(value)
+	if !strings.Contains(value, "-----BEGIN") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("private key is neither PEM nor base64: %w", err)
+		}
+		keyData = decoded
+	}
+	return jwt.ParseRSAPrivateKeyFromPEM(keyData)
+}
+
+// signerMaxClockSkew is how far a request timestamp may be from the signer's
+// clock before the request is refused as a replay
+const signerMaxClockSkew = 30 * time.Second
+
+// signerRequest and signerResponse are the newline-delimited JSON messages
+// exchanged with an external signing process. With a shared secret, requests
+// carry a timestamp and an HMAC-SHA256 over their fields.
+type signerRequest struct {
+	Op        string `json:"op"`                  // "public_key" or "sign"
+	Hash      string `json:"hash,omitempty"`      // "SHA-256"
+	Digest    string `json:"digest,omitempty"`    // base64
+	Timestamp int64  `json:"timestamp,omitempty"` // unix seconds
+	MAC       string `json:"mac,omitempty"`       // base64
+}
+
+// mac computes the request's HMAC under secret
+func (r *signerRequest) mac(secret []byte) string {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n%s\n%s\n%d", r.Op, r.Hash, r.Digest, r.Timestamp)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// authorized reports whether the request carries a fresh, valid MAC
+func (r *signerRequest) authorized(secret []byte) bool {
+	if len(secret) == 0 {
+		return true
+	}
+	skew := time.Since(time.Unix(r.Timestamp, 0))
+	if skew > signerMaxClockSkew || skew < -signerMaxClockSkew {
+		return false
+	}
+	return hmac.Equal([]byte(r.MAC), []byte(r.mac(secret)))
+}
+
+type signerResponse struct {
+	PublicKey string `json:"public_key,omitempty"` // PEM
+	Signature string `json:"signature,omitempty"`  // base64
+	Error     string `json:"error,omitempty"`
+}
+
+// RemoteSigner signs through an external process listening on a unix or TCP
+// socket, so the App private key never has to be readable by this server.
+type RemoteSigner struct {
+	network   string
+	address   string
+	timeout   time.Duration
+	secret    []byte
+	publicKey *rsa.PublicKey
+}
+
+// NewRemoteSigner connects to the signer at address ("unix:///path.sock" or
+// "tcp://host:port") and fetches its public key. secret authenticates requests
+// and must match the signer's; it is required for TCP signers.
+func NewRemoteSigner(address string, timeout time.Duration, secret string) (*RemoteSigner, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signer address: %w", err)
+	}
+
+	s := &RemoteSigner{network: u.Scheme, timeout: timeout, secret: []byte(secret)}
+	switch u.Scheme {
+	case "unix":
+		s.address = u.Path
+	case "tcp":
+		s.address = u.Host
+	default:
+		return nil, fmt.Errorf("unsupported signer address scheme: %q", u.Scheme)
+	}
+
+	resp, err := s.call(&signerRequest{Op: "public_key"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch signer public key: %w", err)
+	}
+	s.publicKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(resp.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("signer returned invalid public key: %w", err)
+	}
+
+	return s, nil
+}
+
+// Public returns the signer's RSA public key
+func (s *RemoteSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks the remote process to sign a SHA-256 digest
+func (s *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, fmt.Errorf("unsupported hash function: %v", opts.HashFunc())
+	}
+
+	resp, err := s.call(&signerRequest{
+		Op:     "sign",
+		Hash:   "SHA-256",
+		Digest: base64.StdEncoding.EncodeToString(digest),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+// call performs one request/response exchange on a fresh connection
+func (s *RemoteSigner) call(req *signerRequest) (*signerResponse, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if len(s.secret) > 0 {
+		req.Timestamp = time.Now().Unix()
+		req.MAC = req.mac(s.secret)
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp signerResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("signer error: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// ServeSigner answers RemoteSigner requests on listener using signer. It backs
+// the github-signer command and can serve as a local stand-in for tests. If
+// secret is set, requests without a valid MAC under it are refused.
+func ServeSigner(listener net.Listener, signer crypto.Signer, secret []byte) error {
+	publicDER, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	publicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go serveSignerConn(conn, signer, publicPEM, secret)
+	}
+}
+
+// serveSignerConn handles a single signer request
+func serveSignerConn(conn net.Conn, signer crypto.Signer, publicPEM string, secret []byte) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var req signerRequest
+	var resp signerResponse
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		resp.Error = "invalid request"
+	} else if !req.authorized(secret) {
+		log.Printf("Refused unauthenticated signer request from %s", conn.RemoteAddr())
+		resp.Error = "unauthorized"
+	} else {
+		switch req.Op {
+		case "public_key":
+			resp.PublicKey = publicPEM
+		case "sign":
+			digest, err := base64.StdEncoding.DecodeString(req.Digest)
+			if err != nil || req.Hash != "SHA-256" || len(digest) != sha256.Size {
+				resp.Error = "invalid sign request"
+				break
+			}
+			signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+			if err != nil {
+				log.Printf("Signing failed: %v", err)
+				resp.Error = "signing failed"
+				break
+			}
+			resp.Signature = base64.StdEncoding.EncodeToString(signature)
+		default:
+			resp.Error = "unknown op"
+		}
+	}
+
+	json.NewEncoder(conn).Encode(&resp)
+}
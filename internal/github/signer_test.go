@@ -0,0 +1,119 @@
+package github
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// startSigner serves key on listener with secret until the test ends
+func startSigner(t *testing.T, listener net.Listener, secret string) {
+	t.Helper()
+
+	key := newTestKey(t)
+	t.Cleanup(func() { listener.Close() })
+	go ServeSigner(listener, key, []byte(secret))
+}
+
+func TestRemoteSigner(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	startSigner(t, tcp, "shared-secret")
+
+	socket := filepath.Join(t.TempDir(), "signer.sock")
+	unix, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	startSigner(t, unix, "")
+
+	for _, address := range []struct{ url, secret string }{
+		{"tcp://" + tcp.Addr().String(), "shared-secret"},
+		{"unix://" + socket, ""},
+	} {
+		t.Run(address.url, func(t *testing.T) {
+			signer, err := NewRemoteSigner(address.url, time.Second, address.secret)
+			if err != nil {
+				t.Fatalf("NewRemoteSigner: %v", err)
+			}
+
+			// App JWTs are signed remotely and verify under the signer's public key
+			app, err := NewApp("123", "42", signer)
+			if err != nil {
+				t.Fatalf("NewApp: %v", err)
+			}
+			signed, err := app.GenerateJWT()
+			if err != nil {
+				t.Fatalf("GenerateJWT: %v", err)
+			}
+			token, err := jwt.ParseWithClaims(signed, &jwt.RegisteredClaims{}, func(*jwt.Token) (interface{}, error) {
+				return signer.Public(), nil
+			}, jwt.WithValidMethods([]string{"RS256"}))
+			if err != nil {
+				t.Fatalf("App JWT does not verify: %v", err)
+			}
+			if subject, _ := token.Claims.GetSubject(); subject != "123" {
+				t.Errorf("App JWT subject = %q, want 123", subject)
+			}
+		})
+	}
+}
+
+func TestRemoteSignerSecret(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	startSigner(t, listener, "shared-secret")
+	address := "tcp://" + listener.Addr().String()
+
+	for _, secret := range []string{"", "wrong-secret"} {
+		if _, err := NewRemoteSigner(address, time.Second, secret); err == nil || !strings.Contains(err.Error(), "unauthorized") {
+			t.Errorf("NewRemoteSigner with secret %q error = %v, want unauthorized", secret, err)
+		}
+	}
+
+	// A captured request can't be replayed once its timestamp is stale
+	req := &signerRequest{Op: "public_key", Timestamp: time.Now().Add(-time.Minute).Unix()}
+	req.MAC = req.mac([]byte("shared-secret"))
+	if req.authorized([]byte("shared-secret")) {
+		t.Error("stale request was authorized")
+	}
+	req.Timestamp = time.Now().Unix()
+	req.MAC = req.mac([]byte("shared-secret"))
+	if !req.authorized([]byte("shared-secret")) {
+		t.Error("fresh request was refused")
+	}
+}
+
+func TestParsePrivateKeyBase64(t *testing.T) {
+	key := newTestKey(t)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+
+	for name, value := range map[string]string{
+		"base64": base64.StdEncoding.EncodeToString([]byte(keyPEM)),
+		"pem":    keyPEM,
+	} {
+		parsed, err := ParsePrivateKeyBase64(value)
+		if err != nil {
+			t.Errorf("%s: ParsePrivateKeyBase64: %v", name, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("%s: parsed a different key", name)
+		}
+	}
+
+	if _, err := ParsePrivateKeyBase64("not a key"); err == nil {
+		t.Error("ParsePrivateKeyBase64 accepted garbage")
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// credentialFormat renders registry credentials for a particular consumer
+type credentialFormat struct {
+	name        string
+	contentType string
+	render      func(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse)
+	// bearer reports whether the format can carry a registry bearer token
+	bearer bool
+}
+
+// credentialFormats lists the supported formats; the first one is the default
+var credentialFormats = []credentialFormat{
+	{"json", "application/json", renderCredentialsJSON, true},
+	{"docker-config", "application/vnd.docker.config+json", renderDockerConfig, true},
+	{"containerd", "application/toml", renderContainerdConfig, false},
+	{"k3s", "application/vnd.k3s.registries+yaml", renderK3sRegistries, false},
+	{"kubernetes", "application/vnd.kubernetes.secret+yaml", renderKubernetesSecret, false},
+	{"balena", "application/vnd.balena.auth+json", renderBalenaAuth, true},
+}
+
+// writeCredentials sends registry credentials in the negotiated format
+func writeCredentials(w http.ResponseWriter, r *http.Request, format credentialFormat, token *models.GitHubRegistryTokenResponse) {
+	if token.TokenType == models.RegistryTokenTypeBearer && !format.bearer {
+		writeError(w, fmt.Sprintf("format %s cannot carry bearer credentials for %s", format.name, token.Registry), http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	format.render(w, r, token)
+}
+
+// negotiateCredentialFormat picks the format from the "format" query parameter
+// or, failing that, the Accept header
+func negotiateCredentialFormat(r *http.Request) (credentialFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, format := range credentialFormats {
+			if format.name == name {
+				return format, nil
+			}
+		}
+		return credentialFormat{}, fmt.Errorf("unknown format %q, supported: %s", name, credentialFormatNames())
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		for _, format := range credentialFormats {
+			if format.contentType == mediaType {
+				return format, nil
+			}
+		}
+	}
+
+	return credentialFormats[0], nil
+}
+
+// credentialFormatNames lists the supported format names
+func credentialFormatNames() string {
+	names := make([]string, 0, len(credentialFormats))
+	for _, format := range credentialFormats {
+		names = append(names, format.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// dockerAuth is the base64 "username:password" used by docker config files
+func dockerAuth(token *models.GitHubRegistryTokenResponse) string {
+	return base64.StdEncoding.EncodeToString([]byte(token.Username + ":" + token.Token))
+}
+
+// dockerConfig builds a ~/.docker/config.json holding only this registry.
+// Bearer tokens go in registrytoken, which Docker sends as is.
+func dockerConfig(token *models.GitHubRegistryTokenResponse) map[string]interface{} {
+	auth := map[string]string{"auth": dockerAuth(token)}
+	if token.TokenType == models.RegistryTokenTypeBearer {
+		auth = map[string]string{"registrytoken": token.Token}
+	}
+	return map[string]interface{}{
+		"auths": map[string]interface{}{
+			token.Registry: auth,
+		},
+	}
+}
+
+// renderCredentialsJSON is the service's own credentials document. It
+// deliberately carries no shell command: devices should use the
+// docker-credential-dtm helper instead of piping the token through a shell.
+func renderCredentialsJSON(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	credentials := map[string]interface{}{
+		"registry":    token.Registry,
+		"username":    token.Username,
+		"token":       token.Token,
+		"expires_at":  token.ExpiresAt,
+		"permissions": token.Permissions,
+	}
+	if token.TokenType != "" {
+		credentials["token_type"] = token.TokenType
+	}
+	json.NewEncoder(w).Encode(credentials)
+}
+
+// renderDockerConfig writes a ready-to-use ~/.docker/config.json
+func renderDockerConfig(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(dockerConfig(token))
+}
+
+// renderContainerdConfig writes the legacy CRI registry auth section for
+// /etc/containerd/config.toml. containerd deprecates registry.configs auth in
+// favour of config_path hosts.toml files, which cannot hold credentials for
+// token-auth registries, so the output is labelled as legacy.
+func renderContainerdConfig(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	fmt.Fprintf(w, "# Legacy CRI registry auth, deprecated by containerd; prefer the docker-credential-dtm helper\n")
+	fmt.Fprintf(w, "# Expires at %s\n", token.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(w, "[plugins.\"io.containerd.grpc.v1.cri\".registry.configs.%s.auth]\n", strconv.Quote(token.Registry))
+	fmt.Fprintf(w, "  username = %s\n", strconv.Quote(token.Username))
+	fmt.Fprintf(w, "  password = %s\n", strconv.Quote(token.Token))
+}
+
+// renderK3sRegistries writes /etc/rancher/k3s/registries.yaml
+func renderK3sRegistries(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	fmt.Fprintf(w, "# Expires at %s\n", token.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(w, "configs:\n")
+	fmt.Fprintf(w, "  %s:\n", strconv.Quote(token.Registry))
+	fmt.Fprintf(w, "    auth:\n")
+	fmt.Fprintf(w, "      username: %s\n", strconv.Quote(token.Username))
+	fmt.Fprintf(w, "      password: %s\n", strconv.Quote(token.Token))
+}
+
+// renderKubernetesSecret writes a kubernetes.io/dockerconfigjson Secret. The
+// "name" and "namespace" query parameters default to regcred and default.
+func renderKubernetesSecret(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "regcred"
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	config, _ := json.Marshal(dockerConfig(token))
+
+	fmt.Fprintf(w, "apiVersion: v1\n")
+	fmt.Fprintf(w, "kind: Secret\n")
+	fmt.Fprintf(w, "metadata:\n")
+	fmt.Fprintf(w, "  name: %s\n", strconv.Quote(name))
+	fmt.Fprintf(w, "  namespace: %s\n", strconv.Quote(namespace))
+	fmt.Fprintf(w, "  annotations:\n")
+	fmt.Fprintf(w, "    dynamic-token-manager/expires-at: %s\n", strconv.Quote(token.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z")))
+	fmt.Fprintf(w, "type: kubernetes.io/dockerconfigjson\n")
+	fmt.Fprintf(w, "data:\n")
+	fmt.Fprintf(w, "  .dockerconfigjson: %s\n", base64.StdEncoding.EncodeToString(config))
+}
+
+// renderBalenaAuth writes the AuthConfig accepted by the balena-engine (and
+// Docker Engine) API, e.g. base64 encoded in the X-Registry-Auth header
+func renderBalenaAuth(w http.ResponseWriter, r *http.Request, token *models.GitHubRegistryTokenResponse) {
+	if token.TokenType == models.RegistryTokenTypeBearer {
+		json.NewEncoder(w).Encode(map[string]string{
+			"registrytoken": token.Token,
+			"serveraddress": token.Registry,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"username":      token.Username,
+		"password":      token.Token,
+		"serveraddress": token.Registry,
+	})
+}
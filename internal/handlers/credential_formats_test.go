@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestNegotiateCredentialFormat(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		want          string
+	}{
+		{"", "", "json"},
+		{"format=k3s", "application/json", "k3s"},
+		{"", "text/html, application/vnd.kubernetes.secret+yaml;q=0.9", "kubernetes"},
+		{"", "application/toml", "containerd"},
+		{"", "text/html", "json"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/credentials?"+tt.query, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		format, err := negotiateCredentialFormat(req)
+		if err != nil || format.name != tt.want {
+			t.Errorf("negotiate(%q, %q) = %s, %v; want %s", tt.query, tt.accept, format.name, err, tt.want)
+		}
+	}
+
+	if _, err := negotiateCredentialFormat(httptest.NewRequest("GET", "/credentials?format=podman", nil)); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+// renderCredentials renders token in the named format
+func renderCredentials(t *testing.T, name, query string, token *models.GitHubRegistryTokenResponse) *httptest.ResponseRecorder {
+	t.Helper()
+
+	format, err := negotiateCredentialFormat(httptest.NewRequest("GET", "/credentials?format="+name, nil))
+	if err != nil {
+		t.Fatalf("negotiate %s: %v", name, err)
+	}
+	rec := httptest.NewRecorder()
+	writeCredentials(rec, httptest.NewRequest("GET", "/credentials?format="+name+"&"+query, nil), format, token)
+	return rec
+}
+
+func TestWriteCredentials(t *testing.T) {
+	token := &models.GitHubRegistryTokenResponse{
+		Token:     "ghs_test",
+		ExpiresAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Registry:  "ghcr.io",
+		Username:  "ared-group",
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("ared-group:ghs_test"))
+
+	rec := renderCredentials(t, "json", "", token)
+	var document map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&document); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	if document["token"] != "ghs_test" || document["registry"] != "ghcr.io" || document["username"] != "ared-group" {
+		t.Errorf("json document = %v", document)
+	}
+	if _, ok := document["login_command"]; ok {
+		t.Error("json document carries a shell command")
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Error("credentials are cacheable")
+	}
+
+	rec = renderCredentials(t, "docker-config", "", token)
+	var dockerConfig struct {
+		Auths map[string]map[string]string `json:"auths"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&dockerConfig); err != nil {
+		t.Fatalf("docker-config: %v", err)
+	}
+	if dockerConfig.Auths["ghcr.io"]["auth"] != auth {
+		t.Errorf("docker-config auths = %v", dockerConfig.Auths)
+	}
+
+	rec = renderCredentials(t, "containerd", "", token)
+	for _, line := range []string{
+		`[plugins."io.containerd.grpc.v1.cri".registry.configs."ghcr.io".auth]`,
+		`  username = "ared-group"`,
+		`  password = "ghs_test"`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("containerd config lacks %q:\n%s", line, rec.Body.String())
+		}
+	}
+
+	rec = renderCredentials(t, "k3s", "", token)
+	if !strings.Contains(rec.Body.String(), "configs:\n  \"ghcr.io\":\n    auth:\n      username: \"ared-group\"\n      password: \"ghs_test\"\n") {
+		t.Errorf("k3s registries.yaml:\n%s", rec.Body.String())
+	}
+
+	rec = renderCredentials(t, "kubernetes", "name=pull&namespace=edge", token)
+	body := rec.Body.String()
+	if !strings.Contains(body, "  name: \"pull\"\n  namespace: \"edge\"\n") || !strings.Contains(body, "type: kubernetes.io/dockerconfigjson\n") {
+		t.Errorf("kubernetes secret:\n%s", body)
+	}
+	_, encoded, _ := strings.Cut(body, ".dockerconfigjson: ")
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || !strings.Contains(string(decoded), auth) {
+		t.Errorf("kubernetes secret data = %s, %v; want the docker config", decoded, err)
+	}
+
+	rec = renderCredentials(t, "balena", "", token)
+	var balena map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&balena); err != nil {
+		t.Fatalf("balena: %v", err)
+	}
+	if balena["username"] != "ared-group" || balena["password"] != "ghs_test" || balena["serveraddress"] != "ghcr.io" {
+		t.Errorf("balena auth = %v", balena)
+	}
+}
+
+func TestWriteBearerCredentials(t *testing.T) {
+	token := &models.GitHubRegistryTokenResponse{
+		Token:     "bearer-token",
+		TokenType: models.RegistryTokenTypeBearer,
+		Registry:  "registry-1.docker.io",
+	}
+
+	rec := renderCredentials(t, "docker-config", "", token)
+	if !strings.Contains(rec.Body.String(), `"registrytoken": "bearer-token"`) {
+		t.Errorf("docker-config for a bearer token:\n%s", rec.Body.String())
+	}
+
+	// Formats that can only hold a username and password refuse bearer tokens
+	for _, name := range []string{"containerd", "k3s", "kubernetes"} {
+		if rec := renderCredentials(t, name, "", token); rec.Code != http.StatusNotAcceptable {
+			t.Errorf("%s with a bearer token: status %d, want 406", name, rec.Code)
+		}
+	}
+}
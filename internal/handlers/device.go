@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+	"github.com/gorilla/mux"
+)
+
+// Heartbeat payload limits
+const (
+	maxHeartbeatBytes  = 64 << 10
+	maxHeartbeatImages = 256
+)
+
+type DeviceHandler struct {
+	deviceService *services.DeviceService
+}
+
+func NewDeviceHandler(deviceService *services.DeviceService) *DeviceHandler {
+	return &DeviceHandler{
+		deviceService: deviceService,
+	}
+}
+
+// RegisterDevice enrolls a new device
+func (h *DeviceHandler) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var req models.DeviceRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.deviceService.RegisterDevice(&req, adminIdentity(r))
+	if err != nil {
+		h.sendStoreError(w, err, req.SerialNumber)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, device)
+}
+
+// ListDevices lists enrolled devices. The "status", "fleet" and
+// "hardware_model" query parameters filter the list; "limit" and "offset" page it.
+func (h *DeviceHandler) ListDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := models.DeviceFilter{
+		Status:        query.Get("status"),
+		Fleet:         query.Get("fleet"),
+		HardwareModel: query.Get("hardware_model"),
+	}
+
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			writeError(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if filter.Offset, err = strconv.Atoi(value); err != nil || filter.Offset < 0 {
+			writeError(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("not_seen_hours"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours < 1 {
+			writeError(w, "not_seen_hours must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		filter.NotSeenSince = time.Now().Add(-time.Duration(hours) * time.Hour)
+	}
+
+	devices, err := h.deviceService.ListDevices(filter)
+	if err != nil {
+		h.sendStoreError(w, err, "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// GetDevice returns an enrolled device
+func (h *DeviceHandler) GetDevice(w http.ResponseWriter, r *http.Request) {
+	serial := mux.Vars(r)["serial"]
+
+	device, err := h.deviceService.GetDevice(serial)
+	if err != nil {
+		h.sendStoreError(w, err, serial)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, device)
+}
+
+// UpdateDevice changes a device's fleet, hardware model, public key or
+// client certificate requirement
+func (h *DeviceHandler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
+	serial := mux.Vars(r)["serial"]
+
+	var req models.DeviceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.deviceService.UpdateDevice(serial, &req, adminIdentity(r))
+	if err != nil {
+		h.sendStoreError(w, err, serial)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, device)
+}
+
+// DeleteDevice removes a device and revokes the credentials issued to it
+func (h *DeviceHandler) DeleteDevice(w http.ResponseWriter, r *http.Request) {
+	serial := mux.Vars(r)["serial"]
+
+	if err := h.deviceService.DeleteDevice(serial, adminIdentity(r)); err != nil {
+		h.sendStoreError(w, err, serial)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetStatus tells the calling device how the service sees it
+func (h *DeviceHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	deviceSerial, ok := r.Context().Value("device_serial").(string)
+	if !ok {
+		writeError(w, "Device authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	access := deviceAccess(r, h.deviceService, deviceSerial)
+	if access.Device == nil {
+		h.sendStoreError(w, store.ErrNotFound, deviceSerial)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.DeviceStatusResponse{
+		SerialNumber: access.Device.SerialNumber,
+		Status:       access.Device.Status,
+		Group:        access.Group,
+		LastSeenAt:   access.Device.LastSeenAt,
+	})
+}
+
+// Heartbeat records the status a device reports and tells it how the service
+// sees it
+func (h *DeviceHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	deviceSerial, ok := r.Context().Value("device_serial").(string)
+	if !ok {
+		writeError(w, "Device authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	var heartbeat models.DeviceHeartbeat
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHeartbeatBytes)).Decode(&heartbeat); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(heartbeat.Images) > maxHeartbeatImages {
+		writeError(w, "Too many images", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.deviceService.RecordHeartbeat(deviceSerial, &heartbeat)
+	if err != nil {
+		h.sendStoreError(w, err, deviceSerial)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.DeviceStatusResponse{
+		SerialNumber: device.SerialNumber,
+		Status:       device.Status,
+		Group:        deviceAccess(r, h.deviceService, deviceSerial).Group,
+		LastSeenAt:   device.LastSeenAt,
+	})
+}
+
+// SuspendDevice blocks a device and revokes the credentials issued to it
+func (h *DeviceHandler) SuspendDevice(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, models.DeviceStatusSuspended)
+}
+
+// ReactivateDevice lets a suspended or quarantined device authenticate again
+// with full access
+func (h *DeviceHandler) ReactivateDevice(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, models.DeviceStatusActive)
+}
+
+// QuarantineDevice restricts a device to the recovery repositories
+func (h *DeviceHandler) QuarantineDevice(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, models.DeviceStatusQuarantined)
+}
+
+// DecommissionDevice permanently retires a device
+func (h *DeviceHandler) DecommissionDevice(w http.ResponseWriter, r *http.Request) {
+	h.changeStatus(w, r, models.DeviceStatusDecommissioned)
+}
+
+// changeStatus moves the device in the path to status, recording the admin
+// making the change and the reason from the optional request body
+func (h *DeviceHandler) changeStatus(w http.ResponseWriter, r *http.Request, status string) {
+	serial := mux.Vars(r)["serial"]
+
+	var req models.DeviceStatusChangeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	event, err := h.deviceService.SetDeviceStatus(serial, status, adminIdentity(r), req.Reason)
+	if err != nil {
+		h.sendStoreError(w, err, serial)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, event)
+}
+
+// GetStatusHistory lists a device's events, newest first
+func (h *DeviceHandler) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	serial := mux.Vars(r)["serial"]
+	events, err := h.deviceService.DeviceStatusHistory(serial)
+	if err != nil {
+		h.sendStoreError(w, err, serial)
+		return
+	}
+	if events == nil {
+		events = []*models.DeviceStatusEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"serial_number": serial,
+		"events":        events,
+	})
+}
+
+// adminIdentity returns the name of the admin whose key authenticated the request
+func adminIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value("admin_identity").(string); ok {
+		return identity
+	}
+	return "admin"
+}
+
+// sendStoreError maps device store errors to HTTP responses
+func (h *DeviceHandler) sendStoreError(w http.ResponseWriter, err error, serial string) {
+	switch {
+	case errors.Is(err, services.ErrInvalidSerialNumber), errors.Is(err, services.ErrInvalidPublicKey),
+		errors.Is(err, services.ErrInvalidSerialPattern), errors.Is(err, services.ErrInvalidDeviceStatus),
+		errors.Is(err, services.ErrInvalidFleetName), errors.Is(err, services.ErrInvalidFleetPolicy):
+		writeError(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, services.ErrInvalidEnrollmentToken):
+		writeError(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, services.ErrSerialNotAllowed):
+		writeError(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, services.ErrDeviceStatusUnchanged), errors.Is(err, services.ErrDeviceDecommissioned),
+		errors.Is(err, services.ErrFleetInUse):
+		writeError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, "Device not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrAlreadyExists):
+		writeError(w, "Device already registered", http.StatusConflict)
+	default:
+		log.Printf("Device store error for %s: %v", serial, err)
+		writeError(w, "Device registry unavailable", http.StatusInternalServerError)
+	}
+}
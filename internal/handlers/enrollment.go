@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+	"github.com/gorilla/mux"
+)
+
+// CreateEnrollmentToken mints a single-use enrollment token (admin)
+func (h *DeviceHandler) CreateEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	var req models.EnrollmentTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		writeError(w, "expires_in must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	token, err := h.deviceService.CreateEnrollmentToken(&req)
+	if err != nil {
+		h.sendStoreError(w, err, "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// ListEnrollmentTokens lists enrollment tokens without their secrets (admin)
+func (h *DeviceHandler) ListEnrollmentTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.deviceService.ListEnrollmentTokens()
+	if err != nil {
+		h.sendStoreError(w, err, "")
+		return
+	}
+	if tokens == nil {
+		tokens = []*models.EnrollmentToken{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enrollment_tokens": tokens,
+	})
+}
+
+// DeleteEnrollmentToken revokes an enrollment token (admin)
+func (h *DeviceHandler) DeleteEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := h.deviceService.DeleteEnrollmentToken(id); err != nil {
+		h.sendEnrollmentError(w, err, id)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Enroll registers a new device that presents an enrollment token. The
+// token is its only authentication.
+func (h *DeviceHandler) Enroll(w http.ResponseWriter, r *http.Request) {
+	var req models.DeviceEnrollmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.deviceService.EnrollDevice(&req)
+	if err != nil {
+		h.sendStoreError(w, err, req.SerialNumber)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// sendEnrollmentError maps enrollment token errors to HTTP responses
+func (h *DeviceHandler) sendEnrollmentError(w http.ResponseWriter, err error, id string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, "Enrollment token not found", http.StatusNotFound)
+	default:
+		h.sendStoreError(w, err, id)
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+	"github.com/gorilla/mux"
+)
+
+func TestDeleteEnrollmentToken(t *testing.T) {
+	t.Setenv("DEVICE_VALIDATION_URL", "")
+	deviceService := services.NewDeviceService(config.Load(), store.NewMemoryStore())
+	t.Cleanup(func() { deviceService.Close() })
+	h := NewDeviceHandler(deviceService)
+
+	token, err := deviceService.CreateEnrollmentToken(&models.EnrollmentTokenRequest{})
+	if err != nil {
+		t.Fatalf("CreateEnrollmentToken: %v", err)
+	}
+
+	deleteToken := func(id string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/api/v1/admin/enrollment-tokens/"+id, nil), map[string]string{"id": id})
+		rec := httptest.NewRecorder()
+		h.DeleteEnrollmentToken(rec, req)
+		return rec
+	}
+
+	if rec := deleteToken(token.ID); rec.Code != http.StatusNoContent {
+		t.Fatalf("DeleteEnrollmentToken: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := deleteToken(token.ID)
+	var resp struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusNotFound || resp.Message != "Enrollment token not found" {
+		t.Errorf("deleting an unknown token: status %d %q, want 404 Enrollment token not found", rec.Code, resp.Message)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+	"github.com/gorilla/mux"
+)
+
+// CreateFleet adds a fleet with its credential policy
+func (h *DeviceHandler) CreateFleet(w http.ResponseWriter, r *http.Request) {
+	var req models.FleetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	fleet, err := h.deviceService.CreateFleet(&req)
+	if err != nil {
+		h.sendFleetError(w, err, req.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, fleet)
+}
+
+// ListFleets lists all fleets
+func (h *DeviceHandler) ListFleets(w http.ResponseWriter, r *http.Request) {
+	fleets, err := h.deviceService.ListFleets()
+	if err != nil {
+		h.sendFleetError(w, err, "")
+		return
+	}
+	if fleets == nil {
+		fleets = []*models.Fleet{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"fleets": fleets,
+	})
+}
+
+// GetFleet returns a fleet and its policy
+func (h *DeviceHandler) GetFleet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	fleet, err := h.deviceService.GetFleet(name)
+	if err != nil {
+		h.sendFleetError(w, err, name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fleet)
+}
+
+// UpdateFleet replaces a fleet's description and policy
+func (h *DeviceHandler) UpdateFleet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var req models.FleetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name != "" && req.Name != name {
+		writeError(w, "Fleet name can't be changed", http.StatusBadRequest)
+		return
+	}
+
+	fleet, err := h.deviceService.UpdateFleet(name, &req)
+	if err != nil {
+		h.sendFleetError(w, err, name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, fleet)
+}
+
+// DeleteFleet removes a fleet no device belongs to
+func (h *DeviceHandler) DeleteFleet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := h.deviceService.DeleteFleet(name); err != nil {
+		h.sendFleetError(w, err, name)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendFleetError maps fleet errors to HTTP responses
+func (h *DeviceHandler) sendFleetError(w http.ResponseWriter, err error, name string) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeError(w, "Fleet not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrAlreadyExists):
+		writeError(w, "Fleet already exists", http.StatusConflict)
+	default:
+		h.sendStoreError(w, err, name)
+	}
+}
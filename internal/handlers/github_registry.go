@@ -2,26 +2,29 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 
+	"github.com/gorilla/mux"
 	"github.com/ARED-Group/dynamic-token-manager/internal/config"
 	"github.com/ARED-Group/dynamic-token-manager/internal/models"
 	"github.com/ARED-Group/dynamic-token-manager/internal/services"
 )
 
 type GitHubRegistryHandler struct {
-	config        *config.Config
-	tokenService  *services.TokenService
-	deviceService *services.DeviceService
+	config          *config.Config
+	tokenService    *services.TokenService
+	deviceService   *services.DeviceService
+	registryService *services.RegistryService
 }
 
-func NewGitHubRegistryHandler(cfg *config.Config, tokenService *services.TokenService, deviceService *services.DeviceService) *GitHubRegistryHandler {
+func NewGitHubRegistryHandler(cfg *config.Config, tokenService *services.TokenService, deviceService *services.DeviceService, registryService *services.RegistryService) *GitHubRegistryHandler {
 	return &GitHubRegistryHandler{
-		config:        cfg,
-		tokenService:  tokenService,
-		deviceService: deviceService,
+		config:          cfg,
+		tokenService:    tokenService,
+		deviceService:   deviceService,
+		registryService: registryService,
 	}
 }
 
@@ -37,6 +40,12 @@ func (h *GitHubRegistryHandler) GetRegistryToken(w http.ResponseWriter, r *http.
 
 	log.Printf("GitHub registry token requested by device: %s", deviceSerial)
 
+	// In proxy mode the device only ever receives proxy credentials
+	if h.config.RegistryProxyEnabled {
+		h.sendProxyCredentials(w, deviceSerial)
+		return
+	}
+
 	// Validate GitHub App configuration
 	if err := h.config.ValidateGitHubConfig(); err != nil {
 		log.Printf("GitHub configuration error: %v", err)
@@ -44,21 +53,19 @@ func (h *GitHubRegistryHandler) GetRegistryToken(w http.ResponseWriter, r *http.
 		return
 	}
 
-	// Create request for GitHub registry token
-	req := &models.GitHubRegistryTokenRequest{
-		DeviceSerial: deviceSerial,
-		Repository:   "ared-group", // Your organization
-	}
+	// Create request for GitHub registry token, scoped to the device
+	req := registryTokenRequest(r, h.deviceService, deviceSerial)
 
 	// Get GitHub token from service
 	token, err := h.tokenService.GetGitHubRegistryToken(req)
 	if err != nil {
 		log.Printf("Failed to get GitHub registry token for device %s: %v", deviceSerial, err)
-		h.sendErrorResponse(w, "Failed to obtain GitHub token", http.StatusInternalServerError)
+		h.sendTokenError(w, err, "Failed to obtain GitHub token")
 		return
 	}
 
-	log.Printf("Successfully generated GitHub registry token for device: %s (expires: %v)", deviceSerial, token.ExpiresAt)
+	log.Printf("Successfully generated GitHub registry token for device: %s (expires: %v, permissions: %v, repository_selection: %s)",
+		deviceSerial, token.ExpiresAt, token.Permissions, token.RepositorySelection)
 
 	// Return token response
 	w.Header().Set("Content-Type", "application/json")
@@ -66,7 +73,9 @@ func (h *GitHubRegistryHandler) GetRegistryToken(w http.ResponseWriter, r *http.
 	json.NewEncoder(w).Encode(token)
 }
 
-// GetRegistryCredentials - Alternative endpoint that returns ready-to-use credentials
+// GetRegistryCredentials - Alternative endpoint that returns ready-to-use
+// credentials. The optional "registry" query parameter selects one of the
+// configured registries; the default registry is used otherwise.
 func (h *GitHubRegistryHandler) GetRegistryCredentials(w http.ResponseWriter, r *http.Request) {
 	deviceSerial, ok := r.Context().Value("device_serial").(string)
 	if !ok {
@@ -74,32 +83,22 @@ func (h *GitHubRegistryHandler) GetRegistryCredentials(w http.ResponseWriter, r
 		return
 	}
 
-	// Get GitHub token
-	req := &models.GitHubRegistryTokenRequest{
-		DeviceSerial: deviceSerial,
-		Repository:   "ared-group",
-	}
-
-	token, err := h.tokenService.GetGitHubRegistryToken(req)
+	format, err := negotiateCredentialFormat(r)
 	if err != nil {
-		log.Printf("Failed to get GitHub registry credentials for device %s: %v", deviceSerial, err)
-		h.sendErrorResponse(w, "Failed to obtain registry credentials", http.StatusInternalServerError)
+		h.sendErrorResponse(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Return credentials in format ready for balena login
-	credentials := map[string]interface{}{
-		"registry": token.Registry,
-		"username": token.Username,
-		"token":    token.Token,
-		"expires_at": token.ExpiresAt,
-		"login_command": fmt.Sprintf("echo %s | balena login %s -u %s --password-stdin", 
-			token.Token, token.Registry, token.Username),
+	// Get credentials from the registry's backend
+	name := r.URL.Query().Get("registry")
+	token, err := h.registryService.Credentials(name, registryTokenRequest(r, h.deviceService, deviceSerial))
+	if err != nil {
+		log.Printf("Failed to get registry credentials for device %s: %v", deviceSerial, err)
+		h.sendTokenError(w, err, "Failed to obtain registry credentials")
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(credentials)
+	writeCredentials(w, r, format, token)
 }
 
 // RefreshGitHubToken - Force refresh GitHub token
@@ -112,17 +111,27 @@ func (h *GitHubRegistryHandler) RefreshGitHubToken(w http.ResponseWriter, r *htt
 
 	log.Printf("Force refresh GitHub token requested by device: %s", deviceSerial)
 
-	// TODO: Implement force refresh logic
-	// For now, just get a new token (GitHub App tokens are always fresh)
-	req := &models.GitHubRegistryTokenRequest{
-		DeviceSerial: deviceSerial,
-		Repository:   "ared-group",
+	// Proxy credentials are minted per request, so there is nothing to bypass
+	if h.config.RegistryProxyEnabled {
+		h.sendProxyCredentials(w, deviceSerial)
+		return
 	}
 
-	token, err := h.tokenService.GetGitHubRegistryToken(req)
+	// The body is optional; an empty one keeps the previous token alive
+	var body models.GitHubTokenRefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			h.sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	req := registryTokenRequest(r, h.deviceService, deviceSerial)
+
+	token, err := h.tokenService.RefreshGitHubRegistryToken(req, body.RevokePrevious)
 	if err != nil {
 		log.Printf("Failed to refresh GitHub token for device %s: %v", deviceSerial, err)
-		h.sendErrorResponse(w, "Failed to refresh GitHub token", http.StatusInternalServerError)
+		h.sendTokenError(w, err, "Failed to refresh GitHub token")
 		return
 	}
 
@@ -133,20 +142,23 @@ func (h *GitHubRegistryHandler) RefreshGitHubToken(w http.ResponseWriter, r *htt
 
 // ValidateGitHubToken - Validate if GitHub token is still valid
 func (h *GitHubRegistryHandler) ValidateGitHubToken(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Token string `json:"token"`
+	deviceSerial, ok := r.Context().Value("device_serial").(string)
+	if !ok {
+		h.sendErrorResponse(w, "Device authentication required", http.StatusUnauthorized)
+		return
 	}
-	
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+
+	var req models.GitHubTokenValidationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
 		h.sendErrorResponse(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// TODO: Implement actual GitHub token validation
-	// For now, return a simple response
-	response := map[string]interface{}{
-		"valid": true,
-		"message": "Token validation not implemented yet",
+	response, err := h.tokenService.ValidateGitHubRegistryToken(deviceSerial, &req)
+	if err != nil {
+		log.Printf("Failed to validate GitHub token for device %s: %v", deviceSerial, err)
+		h.sendTokenError(w, err, "Failed to validate GitHub token")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -154,15 +166,48 @@ func (h *GitHubRegistryHandler) ValidateGitHubToken(w http.ResponseWriter, r *ht
 	json.NewEncoder(w).Encode(response)
 }
 
+// RevokeDeviceTokens - Revoke every GitHub token issued to a device (admin)
+func (h *GitHubRegistryHandler) RevokeDeviceTokens(w http.ResponseWriter, r *http.Request) {
+	serial := mux.Vars(r)["serial"]
+
+	revoked, evicted, err := h.tokenService.RevokeDeviceTokens(serial, h.deviceService.HoldsAccess)
+	if err != nil {
+		log.Printf("Failed to revoke GitHub tokens for device %s: %v", serial, err)
+		h.sendTokenError(w, err, "Failed to revoke device tokens")
+		return
+	}
+
+	log.Printf("Revoked %d and evicted %d shared GitHub token(s) issued to device: %s", revoked, evicted, serial)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"serial_number":  serial,
+		"revoked_tokens": revoked,
+		"evicted_tokens": evicted,
+	})
+}
+
 // GetGitHubStatus - Health check for GitHub App integration
 func (h *GitHubRegistryHandler) GetGitHubStatus(w http.ResponseWriter, r *http.Request) {
 	status := map[string]interface{}{
 		"github_app_configured": h.config.GitHubAppID != "",
 		"github_app_id": h.config.GitHubAppID,
 		"installation_id": h.config.GitHubInstallationID,
-		"private_key_configured": h.config.GitHubPrivateKeyPath != "",
+		"organization": h.config.GitHubOrganization,
+		"organizations": h.config.GitHubOrganizations,
+		"api_url": h.config.GitHubAPIURL,
+		"private_key_configured": h.config.GitHubPrivateKeyPath != "" || h.config.GitHubPrivateKey != "" || h.config.GitHubSignerAddress != "",
+		"private_key_source": h.config.GitHubPrivateKeySource,
 		"registry_url": h.config.RegistryURL,
 		"registry_username": h.config.RegistryUsername,
+		"registry_proxy_enabled": h.config.RegistryProxyEnabled,
+		"registries": h.registryService.Registries(),
+	}
+
+	if fingerprints := h.tokenService.GitHubKeyFingerprints(); len(fingerprints) > 0 {
+		status["active_key_fingerprint"] = fingerprints[0]
+		status["key_fingerprints"] = fingerprints
 	}
 
 	// Try to validate GitHub configuration
@@ -178,15 +223,50 @@ func (h *GitHubRegistryHandler) GetGitHubStatus(w http.ResponseWriter, r *http.R
 	json.NewEncoder(w).Encode(status)
 }
 
-// Helper method to send error responses
-func (h *GitHubRegistryHandler) sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
-	errorResp := models.ErrorResponse{
-		Error:   http.StatusText(statusCode),
-		Message: message,
-		Code:    statusCode,
+// sendProxyCredentials sends the credentials for logging in to the registry proxy
+func (h *GitHubRegistryHandler) sendProxyCredentials(w http.ResponseWriter, deviceSerial string) {
+	token, err := h.tokenService.GetRegistryProxyCredentials(deviceSerial)
+	if err != nil {
+		log.Printf("Failed to issue registry proxy credentials for device %s: %v", deviceSerial, err)
+		h.sendErrorResponse(w, "Failed to obtain registry credentials", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(errorResp)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+// registryTokenRequest builds a registry token request for the device. The
+// optional "repository" query parameter narrows the token to one repository and
+// "organization" selects which GitHub App installation issues it.
+func registryTokenRequest(r *http.Request, deviceService *services.DeviceService, deviceSerial string) *models.GitHubRegistryTokenRequest {
+	access := deviceAccess(r, deviceService, deviceSerial)
+	return &models.GitHubRegistryTokenRequest{
+		DeviceSerial: deviceSerial,
+		Repository:   r.URL.Query().Get("repository"),
+		Organization: r.URL.Query().Get("organization"),
+		Group:        access.Group,
+		Quarantined:  access.Quarantined(),
+		Policy:       access.Policy,
+	}
+}
+
+// deviceAccess returns the access the device auth middleware loaded for the
+// request, loading it only if the middleware did not run
+func deviceAccess(r *http.Request, deviceService *services.DeviceService, deviceSerial string) *models.DeviceAccess {
+	if access, ok := r.Context().Value("device_access").(*models.DeviceAccess); ok && access.SerialNumber == deviceSerial {
+		return access
+	}
+	return deviceService.LoadAccess(deviceSerial)
+}
+
+// sendTokenError maps token service errors to HTTP responses
+func (h *GitHubRegistryHandler) sendTokenError(w http.ResponseWriter, err error, message string) {
+	writeTokenError(w, err, message)
+}
+
+// Helper method to send error responses
+func (h *GitHubRegistryHandler) sendErrorResponse(w http.ResponseWriter, message string, statusCode int) {
+	writeError(w, message, statusCode)
 }
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/gorilla/mux"
+)
+
+// RegistryHandler serves credentials for any configured registry
+type RegistryHandler struct {
+	registryService *services.RegistryService
+	deviceService   *services.DeviceService
+}
+
+func NewRegistryHandler(registryService *services.RegistryService, deviceService *services.DeviceService) *RegistryHandler {
+	return &RegistryHandler{
+		registryService: registryService,
+		deviceService:   deviceService,
+	}
+}
+
+// ListRegistries lists the registries the device can request credentials for
+func (h *RegistryHandler) ListRegistries(w http.ResponseWriter, r *http.Request) {
+	deviceSerial, _ := r.Context().Value("device_serial").(string)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"registries": h.registryService.AllowedRegistries(deviceAccess(r, h.deviceService, deviceSerial).Policy),
+	})
+}
+
+// GetCredentials returns credentials for the registry named in the path, in
+// any of the formats the registry-credentials endpoint supports
+func (h *RegistryHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	deviceSerial, ok := r.Context().Value("device_serial").(string)
+	if !ok {
+		writeError(w, "Device authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	format, err := negotiateCredentialFormat(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	token, err := h.registryService.Credentials(name, registryTokenRequest(r, h.deviceService, deviceSerial))
+	if err != nil {
+		log.Printf("Failed to get %s registry credentials for device %s: %v", name, deviceSerial, err)
+		writeTokenError(w, err, "Failed to obtain registry credentials")
+		return
+	}
+
+	writeCredentials(w, r, format, token)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/registry"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+)
+
+// RegistryTokenHandler implements the Docker Registry v2 token endpoint for
+// the registry proxy. Devices log in with their serial as username and a
+// registry session token as password.
+type RegistryTokenHandler struct {
+	tokenService  *services.TokenService
+	deviceService *services.DeviceService
+	issuer        *registry.TokenIssuer
+	ttl           time.Duration
+}
+
+func NewRegistryTokenHandler(tokenService *services.TokenService, deviceService *services.DeviceService, issuer *registry.TokenIssuer, ttl time.Duration) *RegistryTokenHandler {
+	return &RegistryTokenHandler{
+		tokenService:  tokenService,
+		deviceService: deviceService,
+		issuer:        issuer,
+		ttl:           ttl,
+	}
+}
+
+// Token issues a registry token for the requested scopes. Scopes the device
+// may not access are left out of the token rather than failing the request,
+// as the token specification requires.
+func (h *RegistryTokenHandler) Token(w http.ResponseWriter, r *http.Request) {
+	serial, password, ok := r.BasicAuth()
+	if !ok || serial == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dynamic-token-manager"`)
+		writeError(w, "Device credentials required", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := h.tokenService.ValidateRegistrySessionToken(serial, password); err != nil {
+		log.Printf("Registry token denied for device %s: %v", serial, err)
+		writeError(w, "Invalid device credentials", http.StatusUnauthorized)
+		return
+	}
+
+	device := h.deviceService.VerifiedDeviceAccess(serial)
+	if device == nil {
+		writeError(w, "Invalid device", http.StatusForbidden)
+		return
+	}
+
+	if service := r.URL.Query().Get("service"); service != "" && service != h.issuer.Service() {
+		writeError(w, "Unknown service", http.StatusBadRequest)
+		return
+	}
+
+	var granted []registry.Access
+	for _, scope := range r.URL.Query()["scope"] {
+		access, err := registry.ParseScope(scope)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if access.Type != "repository" || !hasAction(access.Actions, "pull") {
+			continue
+		}
+
+		// ghcr.io names are <organization>/<package>
+		org, repo, _ := strings.Cut(access.Name, "/")
+		req := &models.GitHubRegistryTokenRequest{
+			DeviceSerial: serial,
+			Organization: org,
+			Repository:   repo,
+			Group:        device.Group,
+			Quarantined:  device.Quarantined(),
+			Policy:       device.Policy,
+		}
+		if err := h.tokenService.AuthorizeRegistryPull(req); err != nil {
+			log.Printf("Registry pull of %s denied for device %s: %v", access.Name, serial, err)
+			continue
+		}
+
+		granted = append(granted, registry.Access{Type: "repository", Name: access.Name, Actions: []string{"pull"}})
+	}
+
+	token, _, err := h.issuer.Issue(serial, granted)
+	if err != nil {
+		log.Printf("Failed to issue registry token for device %s: %v", serial, err)
+		writeError(w, "Failed to issue registry token", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(h.ttl.Seconds()),
+		"issued_at":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// hasAction reports whether actions contains action
+func hasAction(actions []string, action string) bool {
+	for _, candidate := range actions {
+		if candidate == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/registry"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+func TestRegistryTokenHandler(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("DEVICE_VALIDATION_URL", "")
+	t.Setenv("GITHUB_ORGANIZATION", "ared-group")
+	t.Setenv("GITHUB_TOKEN_REPOSITORIES", "app")
+	cfg := config.Load()
+
+	tokenService, err := services.NewTokenService(cfg)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	deviceService := services.NewDeviceService(cfg, store.NewMemoryStore())
+	t.Cleanup(func() { deviceService.Close() })
+	if _, err := deviceService.RegisterDevice(&models.DeviceRegistrationRequest{SerialNumber: "SN1"}, "test"); err != nil {
+		t.Fatalf("RegisterDevice: %v", err)
+	}
+
+	issuer := registry.NewTokenIssuer(cfg.JWTSecret, "dynamic-token-manager", time.Minute)
+	h := NewRegistryTokenHandler(tokenService, deviceService, issuer, time.Minute)
+
+	session, err := tokenService.GetRegistryProxyCredentials("SN1")
+	if err != nil {
+		t.Fatalf("GetRegistryProxyCredentials: %v", err)
+	}
+	other, err := tokenService.GetRegistryProxyCredentials("SN2")
+	if err != nil {
+		t.Fatalf("GetRegistryProxyCredentials: %v", err)
+	}
+
+	request := func(query, username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/registry/token?"+query, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		h.Token(rec, req)
+		return rec
+	}
+
+	// Scopes the device may not pull are left out rather than failing
+	rec := request("service=dynamic-token-manager&scope=repository:ared-group/app:pull&scope=repository:ared-group/other:pull&scope=repository:other-org/app:pull", "SN1", session.Token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Token: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Token     string `json:"token"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.ExpiresIn != 60 {
+		t.Errorf("expires_in = %d, want 60", resp.ExpiresIn)
+	}
+	claims, err := issuer.Validate(resp.Token)
+	if err != nil {
+		t.Fatalf("issued token does not validate: %v", err)
+	}
+	if claims.Subject != "SN1" || len(claims.Access) != 1 || !claims.Allows("ared-group/app", "pull") {
+		t.Errorf("token grants %+v to %s, want only pull of ared-group/app to SN1", claims.Access, claims.Subject)
+	}
+
+	for _, tt := range []struct {
+		name, query, username, password string
+		status                          int
+	}{
+		{"no credentials", "scope=repository:ared-group/app:pull", "", "", http.StatusUnauthorized},
+		{"malformed password", "scope=repository:ared-group/app:pull", "SN1", "not-a-token", http.StatusUnauthorized},
+		{"another device's session", "scope=repository:ared-group/app:pull", "SN1", other.Token, http.StatusUnauthorized},
+		{"unregistered device", "scope=repository:ared-group/app:pull", "SN2", other.Token, http.StatusForbidden},
+		{"other service", "service=ghcr.io&scope=repository:ared-group/app:pull", "SN1", session.Token, http.StatusBadRequest},
+		{"malformed scope", "scope=repository:ared-group/app", "SN1", session.Token, http.StatusBadRequest},
+	} {
+		if rec := request(tt.query, tt.username, tt.password); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
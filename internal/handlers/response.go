@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+)
+
+// defaultRetryAfterSeconds is suggested to devices when GitHub gives no hint
+const defaultRetryAfterSeconds = 30
+
+// writeJSON sends v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends a JSON error response
+func writeError(w http.ResponseWriter, message string, statusCode int) {
+	writeJSON(w, statusCode, models.ErrorResponse{
+		Error:   http.StatusText(statusCode),
+		Message: message,
+		Code:    statusCode,
+	})
+}
+
+// writeTokenError maps token service errors to HTTP responses. Transient GitHub
+// failures become 503 with a retry hint; permanent ones (bad credentials,
+// suspended app, removed installation) become 502.
+func writeTokenError(w http.ResponseWriter, err error, message string) {
+	var apiErr *github.APIError
+	var cooldownErr *services.RefreshCooldownError
+
+	switch {
+	case errors.As(err, &cooldownErr):
+		writeRetryableError(w, http.StatusTooManyRequests, err.Error(), int(math.Ceil(cooldownErr.RetryAfter.Seconds())))
+	case errors.Is(err, services.ErrUnknownRegistry):
+		writeError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrRepositoryNotAllowed), errors.Is(err, services.ErrOrganizationNotAllowed),
+		errors.Is(err, services.ErrDeviceQuarantined), errors.Is(err, services.ErrRegistryNotAllowed):
+		writeError(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &apiErr) && apiErr.Temporary():
+		retryAfter := int(math.Ceil(apiErr.RetryAfter.Seconds()))
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfterSeconds
+		}
+		writeRetryableError(w, http.StatusServiceUnavailable, message+": GitHub temporarily unavailable", retryAfter)
+	case errors.As(err, &apiErr):
+		writeError(w, fmt.Sprintf("%s: GitHub %s", message, apiErr.Kind), http.StatusBadGateway)
+	case errors.Is(err, github.ErrInstallationNotFound):
+		writeError(w, message+": GitHub App installation not found", http.StatusBadGateway)
+	default:
+		writeError(w, message, http.StatusInternalServerError)
+	}
+}
+
+// writeRetryableError sends an error telling the device when to retry
+func writeRetryableError(w http.ResponseWriter, statusCode int, message string, retryAfter int) {
+	errorResp := models.ErrorResponse{
+		Error:      http.StatusText(statusCode),
+		Message:    message,
+		Code:       statusCode,
+		RetryAfter: retryAfter,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(errorResp)
+}
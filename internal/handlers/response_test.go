@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+func TestWriteTokenError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"transient", &github.APIError{Kind: github.ErrorKindTransient}, http.StatusServiceUnavailable, "30"},
+		{"rate limited", fmt.Errorf("wrapped: %w", &github.APIError{Kind: github.ErrorKindRateLimited, RetryAfter: 90 * time.Second}), http.StatusServiceUnavailable, "90"},
+		{"bad credentials", &github.APIError{Kind: github.ErrorKindBadCredentials}, http.StatusBadGateway, ""},
+		{"app suspended", &github.APIError{Kind: github.ErrorKindAppSuspended}, http.StatusBadGateway, ""},
+		{"installation not found", fmt.Errorf("%w for account x", github.ErrInstallationNotFound), http.StatusBadGateway, ""},
+		{"other", errors.New("boom"), http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeTokenError(rec, tt.err, "Failed to get registry token")
+			if rec.Code != tt.status || rec.Header().Get("Retry-After") != tt.retryAfter {
+				t.Errorf("status %d with Retry-After %q, want %d with %q", rec.Code, rec.Header().Get("Retry-After"), tt.status, tt.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+)
+
+// DeviceSessionHandler lets devices trade a signed challenge for a session
+// token, so they need neither a certificate nor a synchronised clock
+type DeviceSessionHandler struct {
+	deviceService *services.DeviceService
+	tokenService  *services.TokenService
+}
+
+func NewDeviceSessionHandler(deviceService *services.DeviceService, tokenService *services.TokenService) *DeviceSessionHandler {
+	return &DeviceSessionHandler{
+		deviceService: deviceService,
+		tokenService:  tokenService,
+	}
+}
+
+// GetChallenge issues a challenge for the serial in the serial_number query
+// parameter or X-Device-Serial header
+func (h *DeviceSessionHandler) GetChallenge(w http.ResponseWriter, r *http.Request) {
+	serial := r.URL.Query().Get("serial_number")
+	if serial == "" {
+		serial = r.Header.Get("X-Device-Serial")
+	}
+	if serial == "" {
+		writeError(w, "Device serial number required", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := h.deviceService.CreateChallenge(serial)
+	switch {
+	case errors.Is(err, services.ErrInvalidSerialNumber):
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Failed to create challenge for %s: %v", serial, err)
+		writeError(w, "Failed to create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, challenge)
+}
+
+// CreateSession verifies a signed challenge and issues a session token the
+// device then presents as "Authorization: Bearer <token>"
+func (h *DeviceSessionHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
+	var req models.DeviceSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SerialNumber == "" || req.Challenge == "" || req.Signature == "" {
+		writeError(w, "serial_number, challenge and signature are required", http.StatusBadRequest)
+		return
+	}
+
+	var rejected *services.DeviceRejectedError
+	err := h.deviceService.VerifyChallenge(&req)
+	switch {
+	case errors.Is(err, services.ErrChallengeFailed):
+		writeError(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.As(err, &rejected):
+		writeError(w, "Invalid device: "+rejected.Message, http.StatusForbidden)
+		return
+	case err != nil:
+		log.Printf("Device validation failed for %s: %v", req.SerialNumber, err)
+		writeError(w, "Device validation unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	session, err := h.tokenService.IssueDeviceSession(req.SerialNumber)
+	if err != nil {
+		log.Printf("Failed to issue session for %s: %v", req.SerialNumber, err)
+		writeError(w, "Failed to issue session token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, session)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+// newTestSessionHandler returns a session handler over an in-memory registry
+// holding device SN1 with the returned key
+func newTestSessionHandler(t *testing.T) (*DeviceSessionHandler, *services.DeviceService, *devicesig.SigningKey) {
+	t.Helper()
+
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("DEVICE_VALIDATION_URL", "")
+	cfg := config.Load()
+
+	tokenService, err := services.NewTokenService(cfg)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	deviceService := services.NewDeviceService(cfg, store.NewMemoryStore())
+	t.Cleanup(func() { deviceService.Close() })
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := devicesig.ParseSigningKey("ed25519:" + base64.StdEncoding.EncodeToString(private.Seed()))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	if _, err := deviceService.RegisterDevice(&models.DeviceRegistrationRequest{SerialNumber: "SN1", PublicKey: key.VerifyKeyString()}, "test"); err != nil {
+		t.Fatalf("RegisterDevice: %v", err)
+	}
+
+	return NewDeviceSessionHandler(deviceService, tokenService), deviceService, key
+}
+
+// getChallenge calls GetChallenge for serialNumber
+func getChallenge(t *testing.T, h *DeviceSessionHandler, serialNumber string) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.GetChallenge(rec, httptest.NewRequest("GET", "/api/v1/devices/challenge?serial_number="+serialNumber, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GetChallenge: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var challenge models.DeviceChallengeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil {
+		t.Fatalf("failed to decode challenge: %v", err)
+	}
+	return challenge.Challenge
+}
+
+// createSession posts req to CreateSession
+func createSession(h *DeviceSessionHandler, req *models.DeviceSessionRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	h.CreateSession(rec, httptest.NewRequest("POST", "/api/v1/devices/session", bytes.NewReader(body)))
+	return rec
+}
+
+func TestDeviceSessionHandler(t *testing.T) {
+	h, _, key := newTestSessionHandler(t)
+
+	challenge := getChallenge(t, h, "SN1")
+	req := &models.DeviceSessionRequest{
+		SerialNumber: "SN1",
+		Challenge:    challenge,
+		Signature:    key.Sign(devicesig.ChallengeMessage("SN1", challenge)),
+	}
+
+	rec := createSession(h, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("CreateSession: status %d: %s", rec.Code, rec.Body.String())
+	}
+	var session models.TokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&session); err != nil || session.Token == "" {
+		t.Fatalf("CreateSession returned no token: %v", err)
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Error("session response may be cached")
+	}
+
+	if rec := createSession(h, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused challenge: status %d, want 401", rec.Code)
+	}
+}
+
+func TestDeviceSessionHandlerRejects(t *testing.T) {
+	h, deviceService, key := newTestSessionHandler(t)
+
+	challenge := getChallenge(t, h, "SN1")
+	badSignature := &models.DeviceSessionRequest{SerialNumber: "SN1", Challenge: challenge, Signature: key.Sign("something else")}
+	if rec := createSession(h, badSignature); rec.Code != http.StatusUnauthorized {
+		t.Errorf("bad signature: status %d, want 401", rec.Code)
+	}
+
+	if rec := createSession(h, &models.DeviceSessionRequest{SerialNumber: "SN1"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("incomplete request: status %d, want 400", rec.Code)
+	}
+
+	if _, err := deviceService.SetDeviceStatus("SN1", models.DeviceStatusSuspended, "test", ""); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+	challenge = getChallenge(t, h, "SN1")
+	suspended := &models.DeviceSessionRequest{
+		SerialNumber: "SN1",
+		Challenge:    challenge,
+		Signature:    key.Sign(devicesig.ChallengeMessage("SN1", challenge)),
+	}
+	if rec := createSession(h, suspended); rec.Code != http.StatusForbidden {
+		t.Errorf("suspended device: status %d, want 403", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	h.GetChallenge(rec, httptest.NewRequest("GET", "/api/v1/devices/challenge", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("challenge without serial: status %d, want 400", rec.Code)
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -34,7 +35,23 @@ func (h *TokenHandler) GenerateToken(w http.ResponseWriter, r *http.Request) {
 		req.DeviceSerial = deviceSerial
 	}
 
+	// Quarantined devices only get registry credentials for recovery
+	access := deviceAccess(r, h.deviceService, req.DeviceSerial)
+	if access.Quarantined() {
+		http.Error(w, "Device is quarantined", http.StatusForbidden)
+		return
+	}
+	req.Policy = access.Policy
+
 	token, err := h.tokenService.GenerateToken(&req)
+	if errors.Is(err, services.ErrReservedTokenType) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrScopeNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -77,7 +94,19 @@ func (h *TokenHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newToken, err := h.tokenService.RefreshToken(req.Token)
+	// The new token is issued under the calling device's current policy
+	deviceSerial, _ := r.Context().Value("device_serial").(string)
+	access := deviceAccess(r, h.deviceService, deviceSerial)
+	if access.Quarantined() {
+		http.Error(w, "Device is quarantined", http.StatusForbidden)
+		return
+	}
+
+	newToken, err := h.tokenService.RefreshToken(req.Token, deviceSerial, access.Policy)
+	if errors.Is(err, services.ErrScopeNotAllowed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
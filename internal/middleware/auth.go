@@ -1,47 +1,81 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"strings"
 
 	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
 	"github.com/ARED-Group/dynamic-token-manager/internal/services"
 )
 
+// maxSignedBodyBytes bounds the request bodies read to verify signatures
+const maxSignedBodyBytes = 1 << 20
+
+// maxClientVersionLength bounds the client versions recorded for devices
+const maxClientVersionLength = 128
+
 type AuthMiddleware struct {
 	config        *config.Config
 	tokenService  *services.TokenService
 	deviceService *services.DeviceService
+	clientIP      *ClientIPResolver
 }
 
-func NewAuthMiddleware(cfg *config.Config, tokenService *services.TokenService, deviceService *services.DeviceService) *AuthMiddleware {
+func NewAuthMiddleware(cfg *config.Config, tokenService *services.TokenService, deviceService *services.DeviceService, clientIP *ClientIPResolver) *AuthMiddleware {
 	return &AuthMiddleware{
 		config:        cfg,
 		tokenService:  tokenService,
 		deviceService: deviceService,
+		clientIP:      clientIP,
 	}
 }
 
-// DeviceAuthMiddleware validates device authentication using serial number
+// DeviceAuthMiddleware validates device authentication using the serial
+// number from the client certificate, a device session token or the
+// X-Device-Serial header. It puts the serial in the context as
+// "device_serial" and the device's *models.DeviceAccess as "device_access".
 func (a *AuthMiddleware) DeviceAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check for device serial in header
-		deviceSerial := r.Header.Get("X-Device-Serial")
+		// Identify the device by its certificate, session token, or the serial header
+		deviceSerial, verified, err := a.deviceIdentity(r)
+		if err != nil {
+			http.Error(w, "Invalid device: "+err.Error(), http.StatusForbidden)
+			return
+		}
 		if deviceSerial == "" {
 			http.Error(w, "Device serial number required", http.StatusUnauthorized)
 			return
 		}
 
-		// Validate device
-		if !a.deviceService.IsValidDevice(deviceSerial) {
-			http.Error(w, "Invalid device", http.StatusForbidden)
+		// Validate device and, unless its identity is verified, its request signature
+		req, err := deviceValidationRequest(r, deviceSerial)
+		if err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		req.IdentityVerified = verified
+		req.ClientCertificate = hasClientCertificate(r)
+		resp, err := a.deviceService.ValidateDevice(req)
+		if err != nil {
+			log.Printf("Device validation failed for %s: %v", deviceSerial, err)
+			http.Error(w, "Device validation unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if !resp.Valid {
+			http.Error(w, "Invalid device: "+resp.Message, http.StatusForbidden)
+			return
+		}
+		a.deviceService.RecordSeen(deviceSerial, a.clientIP.ClientIP(r), clientVersion(r))
 
-		// Add device serial to context
-		ctx := context.WithValue(r.Context(), "device_serial", deviceSerial)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r.WithContext(a.deviceContext(r, deviceSerial, resp)))
 	})
 }
 
@@ -74,14 +108,115 @@ func (a *AuthMiddleware) JWTAuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// AdminAuthMiddleware protects administrative endpoints with ADMIN_API_KEY or
+// one of ADMIN_API_KEYS, presented as "Authorization: Bearer <key>", and puts
+// the name of the key's holder in the context as "admin_identity". Admin
+// endpoints are disabled while no key is configured.
+func (a *AuthMiddleware) AdminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := a.config.AdminKeys()
+		if len(keys) == 0 {
+			http.Error(w, "Admin API not configured", http.StatusServiceUnavailable)
+			return
+		}
+
+		parts := strings.Split(r.Header.Get("Authorization"), " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
+			return
+		}
+
+		// Compare against every key so timing doesn't reveal which one matched
+		var identity string
+		for _, key := range keys {
+			if subtle.ConstantTimeCompare([]byte(parts[1]), []byte(key.Key)) == 1 && identity == "" {
+				identity = key.Name
+			}
+		}
+		if identity == "" {
+			http.Error(w, "Invalid admin credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "admin_identity", identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // OptionalDeviceAuth allows requests with or without device authentication
 func (a *AuthMiddleware) OptionalDeviceAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		deviceSerial := r.Header.Get("X-Device-Serial")
-		if deviceSerial != "" && a.deviceService.IsValidDevice(deviceSerial) {
-			ctx := context.WithValue(r.Context(), "device_serial", deviceSerial)
-			r = r.WithContext(ctx)
+		deviceSerial, verified, err := a.deviceIdentity(r)
+		if err == nil && deviceSerial != "" {
+			if req, err := deviceValidationRequest(r, deviceSerial); err == nil {
+				req.IdentityVerified = verified
+				req.ClientCertificate = hasClientCertificate(r)
+				if resp, err := a.deviceService.ValidateDevice(req); err == nil && resp.Valid {
+					r = r.WithContext(a.deviceContext(r, deviceSerial, resp))
+				}
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// deviceContext adds an authenticated device's serial and access to the
+// request context, reusing the device record validation loaded
+func (a *AuthMiddleware) deviceContext(r *http.Request, deviceSerial string, resp *models.DeviceValidationResponse) context.Context {
+	var access *models.DeviceAccess
+	if resp.Device != nil {
+		access = a.deviceService.Access(deviceSerial, resp.Device)
+	} else {
+		// Validation loaded no registered device, e.g. with DEVICE_AUTH_ENABLED=false
+		// or for a device the inventory service vouched for
+		access = a.deviceService.LoadAccess(deviceSerial)
+	}
+
+	ctx := context.WithValue(r.Context(), "device_serial", deviceSerial)
+	return context.WithValue(ctx, "device_access", access)
+}
+
+// deviceValidationRequest collects what is needed to validate a device's
+// request, including the canonical request its signature covers. The body is
+// read to hash it and then restored for the handler.
+func deviceValidationRequest(r *http.Request, deviceSerial string) (*models.DeviceValidationRequest, error) {
+	req := &models.DeviceValidationRequest{
+		SerialNumber: deviceSerial,
+		Signature:    r.Header.Get(devicesig.HeaderSignature),
+		Timestamp:    r.Header.Get(devicesig.HeaderTimestamp),
+		Nonce:        r.Header.Get(devicesig.HeaderNonce),
+	}
+	if req.Signature == "" {
+		return req, nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+		r.Body.Close()
+		if err != nil {
+			return nil, errors.New("failed to read request body")
+		}
+		if len(body) > maxSignedBodyBytes {
+			return nil, errors.New("request body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	req.SignedPayload = devicesig.CanonicalRequest(r.Method, r.URL.RequestURI(), req.Timestamp, req.Nonce, devicesig.BodyHash(body))
+	return req, nil
+}
+
+// clientVersion returns the software version the device reports in
+// X-Client-Version, or else its User-Agent
+func clientVersion(r *http.Request) string {
+	version := r.Header.Get("X-Client-Version")
+	if version == "" {
+		version = r.UserAgent()
+	}
+	if len(version) > maxClientVersionLength {
+		version = version[:maxClientVersionLength]
+	}
+	return version
+}
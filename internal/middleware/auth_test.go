@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/services"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+// testAuth is an AuthMiddleware over an in-memory registry with a keyless
+// device SN1 and a device SIGNED holding key
+type testAuth struct {
+	auth          *AuthMiddleware
+	tokenService  *services.TokenService
+	deviceService *services.DeviceService
+	key           *devicesig.SigningKey
+}
+
+func newTestAuth(t *testing.T) *testAuth {
+	t.Helper()
+
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("DEVICE_VALIDATION_URL", "")
+	cfg := config.Load()
+
+	tokenService, err := services.NewTokenService(cfg)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	deviceService := services.NewDeviceService(cfg, store.NewMemoryStore())
+	t.Cleanup(func() { deviceService.Close() })
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := devicesig.ParseSigningKey("ed25519:" + base64.StdEncoding.EncodeToString(private.Seed()))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+
+	for _, req := range []*models.DeviceRegistrationRequest{
+		{SerialNumber: "SN1"},
+		{SerialNumber: "SIGNED", PublicKey: key.VerifyKeyString()},
+	} {
+		if _, err := deviceService.RegisterDevice(req, "test"); err != nil {
+			t.Fatalf("RegisterDevice(%s): %v", req.SerialNumber, err)
+		}
+	}
+
+	return &testAuth{
+		auth:          NewAuthMiddleware(cfg, tokenService, deviceService, NewClientIPResolver(nil)),
+		tokenService:  tokenService,
+		deviceService: deviceService,
+		key:           key,
+	}
+}
+
+// serve runs req through DeviceAuthMiddleware and returns the response and
+// the serial the handler saw
+func (a *testAuth) serve(req *http.Request) (*httptest.ResponseRecorder, string) {
+	var serial string
+	handler := a.auth.DeviceAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serial, _ = r.Context().Value("device_serial").(string)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec, serial
+}
+
+// sessionToken issues a device session token for serialNumber
+func (a *testAuth) sessionToken(t *testing.T, serialNumber string) string {
+	t.Helper()
+
+	session, err := a.tokenService.IssueDeviceSession(serialNumber)
+	if err != nil {
+		t.Fatalf("IssueDeviceSession: %v", err)
+	}
+	return session.Token
+}
+
+func TestDeviceAuthMiddleware(t *testing.T) {
+	a := newTestAuth(t)
+
+	tests := []struct {
+		name       string
+		prepare    func(req *http.Request)
+		wantStatus int
+		wantSerial string
+	}{
+		{"no identity", func(req *http.Request) {}, http.StatusUnauthorized, ""},
+		{"unsigned request from a keyless device", func(req *http.Request) {
+			req.Header.Set("X-Device-Serial", "SN1")
+		}, http.StatusForbidden, ""},
+		{"unknown device", func(req *http.Request) {
+			req.Header.Set("X-Device-Serial", "UNKNOWN")
+		}, http.StatusForbidden, ""},
+		{"unsigned request from a device with a key", func(req *http.Request) {
+			req.Header.Set("X-Device-Serial", "SIGNED")
+		}, http.StatusForbidden, ""},
+		{"signed request", func(req *http.Request) {
+			req.Header.Set("X-Device-Serial", "SIGNED")
+			if err := a.key.SignRequest(req, nil); err != nil {
+				t.Fatalf("SignRequest: %v", err)
+			}
+		}, http.StatusOK, "SIGNED"},
+		{"session token", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+a.sessionToken(t, "SIGNED"))
+		}, http.StatusOK, "SIGNED"},
+		{"session token with matching header", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+a.sessionToken(t, "SIGNED"))
+			req.Header.Set("X-Device-Serial", "SIGNED")
+		}, http.StatusOK, "SIGNED"},
+		{"session token with another device's header", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+a.sessionToken(t, "SIGNED"))
+			req.Header.Set("X-Device-Serial", "SN1")
+		}, http.StatusForbidden, ""},
+		{"invalid session token", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer not-a-token")
+		}, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+			tt.prepare(req)
+
+			rec, serial := a.serve(req)
+			if rec.Code != tt.wantStatus || serial != tt.wantSerial {
+				t.Errorf("status %d for %q, want %d for %q (%s)", rec.Code, serial, tt.wantStatus, tt.wantSerial, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDeviceAuthMiddlewareUnsignedLegacyDevices(t *testing.T) {
+	t.Setenv("DEVICE_SIGNATURE_REQUIRED", "false")
+	a := newTestAuth(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+	req.Header.Set("X-Device-Serial", "SN1")
+	if rec, serial := a.serve(req); rec.Code != http.StatusOK || serial != "SN1" {
+		t.Errorf("keyless device: status %d for %q, want 200 for SN1", rec.Code, serial)
+	}
+
+	// A device with a key must still sign
+	req = httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+	req.Header.Set("X-Device-Serial", "SIGNED")
+	if rec, _ := a.serve(req); rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned request from a device with a key: status %d, want 403", rec.Code)
+	}
+}
+
+func TestDeviceAuthMiddlewareClientCertificate(t *testing.T) {
+	a := newTestAuth(t)
+	a.auth.config.TLSClientSerialField = "cn"
+
+	withCert := func(commonName string) *http.Request {
+		req := httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	// The certificate proves the identity, so no signature is needed
+	rec, serial := a.serve(withCert("SIGNED"))
+	if rec.Code != http.StatusOK || serial != "SIGNED" {
+		t.Errorf("certificate: status %d for %q, want 200 for SIGNED", rec.Code, serial)
+	}
+
+	req := withCert("SIGNED")
+	req.Header.Set("X-Device-Serial", "SN1")
+	if rec, _ := a.serve(req); rec.Code != http.StatusForbidden {
+		t.Errorf("certificate with another device's header: status %d, want 403", rec.Code)
+	}
+
+	if rec, _ := a.serve(withCert("")); rec.Code != http.StatusForbidden {
+		t.Errorf("certificate without a serial: status %d, want 403", rec.Code)
+	}
+
+	// Having presented a certificate, the device can no longer be named by
+	// the header, even in a signed request
+	req = httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+	req.Header.Set("X-Device-Serial", "SIGNED")
+	if err := a.key.SignRequest(req, nil); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	if rec, _ := a.serve(req); rec.Code != http.StatusForbidden {
+		t.Errorf("signed header request after certificate: status %d, want 403", rec.Code)
+	}
+
+	// Nor can a session token stand in for the certificate
+	req = httptest.NewRequest("GET", "/api/v1/tokens/info", nil)
+	req.Header.Set("Authorization", "Bearer "+a.sessionToken(t, "SIGNED"))
+	if rec, _ := a.serve(req); rec.Code != http.StatusForbidden {
+		t.Errorf("session token after certificate: status %d, want 403", rec.Code)
+	}
+}
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	a := newTestAuth(t)
+	a.auth.config.AdminAPIKey = "shared-key"
+	a.auth.config.AdminAPIKeys = []config.AdminAPIKey{{Name: "alice", Key: "alice-key"}}
+
+	var identity string
+	handler := a.auth.AdminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = r.Context().Value("admin_identity").(string)
+	}))
+
+	tests := []struct {
+		key          string
+		wantStatus   int
+		wantIdentity string
+	}{
+		{"alice-key", http.StatusOK, "alice"},
+		{"shared-key", http.StatusOK, "admin"},
+		{"wrong-key", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		identity = ""
+		req := httptest.NewRequest("GET", "/api/v1/admin/devices", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus || identity != tt.wantIdentity {
+			t.Errorf("key %s: status %d as %q, want %d as %q", tt.key, rec.Code, identity, tt.wantStatus, tt.wantIdentity)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// deviceIdentity returns the serial of the device making the request and
+// whether it has been verified. A verified client certificate takes
+// precedence, then a device session token, then the X-Device-Serial header,
+// which may only repeat a verified serial.
+func (a *AuthMiddleware) deviceIdentity(r *http.Request) (serial string, verified bool, err error) {
+	headerSerial := r.Header.Get("X-Device-Serial")
+
+	if !hasClientCertificate(r) {
+		return a.sessionIdentity(r, headerSerial)
+	}
+
+	certSerial := certificateSerial(r.TLS.VerifiedChains[0][0], a.config.TLSClientSerialField)
+	if certSerial == "" {
+		return "", false, errors.New("client certificate carries no device serial")
+	}
+	if headerSerial != "" && headerSerial != certSerial {
+		return "", false, errors.New("X-Device-Serial does not match client certificate")
+	}
+	return certSerial, true, nil
+}
+
+// hasClientCertificate reports whether the request came with a verified
+// client certificate
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// sessionIdentity identifies a device by its "Authorization: Bearer" session
+// token, falling back to the unverified serial header without one
+func (a *AuthMiddleware) sessionIdentity(r *http.Request, headerSerial string) (string, bool, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return headerSerial, false, nil
+	}
+
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false, errors.New("invalid authorization header format")
+	}
+	sessionSerial, err := a.tokenService.ValidateDeviceSessionToken(parts[1])
+	if err != nil {
+		return "", false, errors.New("invalid session token")
+	}
+	if headerSerial != "" && headerSerial != sessionSerial {
+		return "", false, errors.New("X-Device-Serial does not match session token")
+	}
+	return sessionSerial, true, nil
+}
+
+// certificateSerial extracts the device serial from a client certificate's
+// subject common name ("cn"), first DNS SAN ("dns") or first URI SAN ("uri").
+// For URIs the serial is the last segment, so "urn:device:SN123" and
+// "spiffe://fleet.example.com/device/SN123" both yield SN123.
+func certificateSerial(cert *x509.Certificate, field string) string {
+	switch field {
+	case "cn":
+		return cert.Subject.CommonName
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return uriSerial(cert.URIs[0])
+		}
+	}
+	return ""
+}
+
+// uriSerial returns the last path or opaque segment of a URI
+func uriSerial(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque[strings.LastIndex(u.Opaque, ":")+1:]
+	}
+	path := strings.TrimRight(u.Path, "/")
+	return path[strings.LastIndex(path, "/")+1:]
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver determines the address a request came from. Forwarding
+// headers are honoured only when the connection comes from a trusted proxy;
+// anyone else could set them to pose as another client.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIPResolver creates a resolver trusting the forwarding headers of
+// proxies in trusted. Without trusted proxies the connection's address is used.
+func NewClientIPResolver(trusted []*net.IPNet) *ClientIPResolver {
+	return &ClientIPResolver{trusted: trusted}
+}
+
+// ClientIP returns the IP address a request came from, without the port. The
+// X-Forwarded-For chain is walked from the right, past trusted proxies, to
+// the first address a trusted proxy vouched for.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !c.isTrusted(remote) {
+		return remote
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// A malformed hop ends the part of the chain worth believing
+				break
+			}
+			if i == 0 || !c.isTrusted(hop) {
+				return hop
+			}
+		}
+		return remote
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+		return xri
+	}
+	return remote
+}
+
+// isTrusted reports whether addr belongs to a trusted proxy
+func (c *ClientIPResolver) isTrusted(addr string) bool {
+	if c == nil {
+		return false
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
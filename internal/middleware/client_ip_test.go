@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	resolver := NewClientIPResolver([]*net.IPNet{proxies})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted forwarding headers are ignored", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hops before the proxy are skipped", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "192.0.2.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"trusted proxy without forwarded-for", "10.0.0.1:5000", map[string]string{"X-Real-IP": "198.51.100.2"}, "198.51.100.2"},
+		{"malformed hop", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "198.51.100.1, not-an-ip"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+			if got := resolver.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
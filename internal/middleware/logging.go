@@ -31,6 +31,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // Logging returns the LoggingMiddleware for easier usage in routes
 func Logging() func(http.Handler) http.Handler {
 	return LoggingMiddleware
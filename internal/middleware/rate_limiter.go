@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
 )
 
 // RateLimiter represents a simple rate limiter
@@ -28,11 +30,12 @@ func NewRateLimiter(window, cleanup time.Duration) *RateLimiter {
 	return rl
 }
 
-// RateLimitMiddleware returns a middleware that limits requests per IP
-func (rl *RateLimiter) RateLimitMiddleware(limit int) func(http.Handler) http.Handler {
+// RateLimitMiddleware returns a middleware that limits requests per client IP,
+// as clientIP resolves it
+func (rl *RateLimiter) RateLimitMiddleware(limit int, clientIP *ClientIPResolver) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getClientIP(r)
+			ip := clientIP.ClientIP(r)
 			
 			if !rl.Allow(ip, limit) {
 				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
@@ -44,6 +47,26 @@ func (rl *RateLimiter) RateLimitMiddleware(limit int) func(http.Handler) http.Ha
 	}
 }
 
+// DeviceRateLimitMiddleware returns a middleware that limits requests per
+// authenticated device. It must run after device authentication. limitFor
+// returns a device's limit; 0 means unlimited.
+func (rl *RateLimiter) DeviceRateLimitMiddleware(limitFor func(access *models.DeviceAccess) int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deviceSerial, ok := r.Context().Value("device_serial").(string)
+			access, _ := r.Context().Value("device_access").(*models.DeviceAccess)
+			if ok && access != nil {
+				if limit := limitFor(access); limit > 0 && !rl.Allow("device:"+deviceSerial, limit) {
+					http.Error(w, "Device rate limit exceeded", http.StatusTooManyRequests)
+					return
+				}
+			}
+			
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // Allow checks if a request is allowed for the given IP
 func (rl *RateLimiter) Allow(ip string, limit int) bool {
 	rl.mu.Lock()
@@ -101,19 +124,3 @@ func (rl *RateLimiter) cleanupExpired() {
 		rl.mu.Unlock()
 	}
 }
-
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff
-	}
-	
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-	
-	// Fall back to RemoteAddr
-	return r.RemoteAddr
-}
\ No newline at end of file
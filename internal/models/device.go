@@ -0,0 +1,213 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Device statuses. Active devices have full access; quarantined devices still
+// authenticate but only receive credentials for recovery repositories.
+// Suspended and decommissioned devices are rejected, and decommissioning is
+// permanent.
+const (
+	DeviceStatusActive         = "active"
+	DeviceStatusSuspended      = "suspended"
+	DeviceStatusQuarantined    = "quarantined"
+	DeviceStatusDecommissioned = "decommissioned"
+)
+
+// Device is an enrolled device. Only enrolled, active or quarantined devices
+// can obtain tokens.
+type Device struct {
+	SerialNumber  string `json:"serial_number"`
+	Status        string `json:"status"`
+	Fleet         string `json:"fleet,omitempty"`
+	HardwareModel string `json:"hardware_model,omitempty"`
+	PublicKey     string `json:"public_key,omitempty"`
+	// RequireClientCert rejects the device's X-Device-Serial authentication. It
+	// is set the first time the device presents a client certificate.
+	RequireClientCert bool       `json:"require_client_cert"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	LastSeenAt        *time.Time `json:"last_seen_at,omitempty"`
+	LastSeenIP        string     `json:"last_seen_ip,omitempty"`
+	ClientVersion     string     `json:"client_version,omitempty"`
+	// Heartbeat is the status the device last reported
+	Heartbeat *DeviceHeartbeat `json:"heartbeat,omitempty"`
+}
+
+// MarshalJSON hides HMAC device keys, which are shared secrets rather than
+// public keys
+func (d Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	if strings.HasPrefix(d.PublicKey, "hmac:") {
+		d.PublicKey = "hmac:redacted"
+	}
+	return json.Marshal(device(d))
+}
+
+// DeviceRegistrationRequest enrolls a device
+type DeviceRegistrationRequest struct {
+	SerialNumber      string `json:"serial_number"`
+	Fleet             string `json:"fleet,omitempty"`
+	HardwareModel     string `json:"hardware_model,omitempty"`
+	PublicKey         string `json:"public_key,omitempty"`
+	RequireClientCert bool   `json:"require_client_cert,omitempty"`
+}
+
+// DeviceUpdateRequest changes a device's details. Omitted fields are left as they are.
+type DeviceUpdateRequest struct {
+	Fleet             *string `json:"fleet,omitempty"`
+	HardwareModel     *string `json:"hardware_model,omitempty"`
+	PublicKey         *string `json:"public_key,omitempty"`
+	RequireClientCert *bool   `json:"require_client_cert,omitempty"`
+}
+
+// DeviceFilter selects devices when listing them
+type DeviceFilter struct {
+	Status        string
+	Fleet         string
+	HardwareModel string
+	// NotSeenSince selects devices last seen before it, or never
+	NotSeenSince time.Time
+	Limit        int
+	Offset       int
+}
+
+// DeviceListResponse is one page of devices
+type DeviceListResponse struct {
+	Devices []*Device `json:"devices"`
+	Total   int       `json:"total"`
+	Limit   int       `json:"limit"`
+	Offset  int       `json:"offset"`
+}
+
+// DeviceAccess is what a device's requests are served under: its registry
+// record, if any, its fleet group and that group's policy. It is loaded once
+// when the device authenticates.
+type DeviceAccess struct {
+	SerialNumber string
+	Device       *Device
+	Group        string
+	Policy       *FleetPolicy
+}
+
+// Quarantined reports whether the device is restricted to recovery repositories
+func (a *DeviceAccess) Quarantined() bool {
+	return a.Device != nil && a.Device.Status == DeviceStatusQuarantined
+}
+
+// DeviceStatusResponse tells a device how the service sees it
+type DeviceStatusResponse struct {
+	SerialNumber string     `json:"serial_number"`
+	Status       string     `json:"status"`
+	Group        string     `json:"group,omitempty"`
+	LastSeenAt   *time.Time `json:"last_seen_at,omitempty"`
+}
+
+// DeviceHeartbeat is the status a device reports with a heartbeat
+type DeviceHeartbeat struct {
+	Images         []ImageStatus `json:"images,omitempty"`
+	UptimeSeconds  int64         `json:"uptime_seconds,omitempty"`
+	DiskTotalBytes uint64        `json:"disk_total_bytes,omitempty"`
+	DiskFreeBytes  uint64        `json:"disk_free_bytes,omitempty"`
+	ReceivedAt     time.Time     `json:"received_at"`
+}
+
+// ImageStatus is an image running on a device
+type ImageStatus struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// DeviceSighting records an authenticated request from a device
+type DeviceSighting struct {
+	SerialNumber  string
+	SeenAt        time.Time
+	IP            string
+	ClientVersion string
+}
+
+// DeviceStatusChangeRequest is the optional body of a status change. The
+// actor is the admin whose key authorized the change.
+type DeviceStatusChangeRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Device event actions. Every change to a registered device records an event.
+const (
+	DeviceEventRegistered    = "registered"
+	DeviceEventEnrolled      = "enrolled"
+	DeviceEventUpdated       = "updated"
+	DeviceEventStatusChanged = "status_changed"
+	DeviceEventDeleted       = "deleted"
+)
+
+// DeviceStatusEvent records a change of a device: its registration or
+// enrollment, an update of its details, a change of its status or its
+// deletion. FromStatus is empty for new devices and ToStatus for deleted ones.
+type DeviceStatusEvent struct {
+	ID           int64     `json:"id"`
+	SerialNumber string    `json:"serial_number"`
+	Action       string    `json:"action"`
+	FromStatus   string    `json:"from_status"`
+	ToStatus     string    `json:"to_status"`
+	Actor        string    `json:"actor"`
+	Reason       string    `json:"reason,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// EnrollmentToken is a single-use token a new device exchanges for its
+// permanent credentials. The token itself is only shown once, when created.
+type EnrollmentToken struct {
+	ID            string     `json:"id"`
+	Fleet         string     `json:"fleet,omitempty"`
+	SerialPattern string     `json:"serial_pattern,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UsedAt        *time.Time `json:"used_at,omitempty"`
+	UsedBy        string     `json:"used_by,omitempty"`
+}
+
+// EnrollmentTokenRequest mints an enrollment token
+type EnrollmentTokenRequest struct {
+	Fleet         string `json:"fleet,omitempty"`
+	SerialPattern string `json:"serial_pattern,omitempty"` // e.g. "ARED-*"
+	ExpiresIn     int    `json:"expires_in,omitempty"`     // seconds
+}
+
+// EnrollmentTokenResponse carries a new enrollment token
+type EnrollmentTokenResponse struct {
+	*EnrollmentToken
+	Token string `json:"token"`
+}
+
+// DeviceEnrollmentRequest is sent by a new device to enroll itself
+type DeviceEnrollmentRequest struct {
+	Token         string `json:"token"`
+	SerialNumber  string `json:"serial_number"`
+	HardwareModel string `json:"hardware_model,omitempty"`
+	PublicKey     string `json:"public_key,omitempty"`
+}
+
+// DeviceEnrollmentResponse returns an enrolled device's credentials. SigningKey
+// is only set when the device sent no public key and must sign with a
+// generated HMAC secret; it is not shown again.
+type DeviceEnrollmentResponse struct {
+	Device     *Device `json:"device"`
+	SigningKey string  `json:"signing_key,omitempty"`
+}
+
+// DeviceChallengeResponse is a server nonce the device signs to open a session
+type DeviceChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DeviceSessionRequest answers a challenge to obtain a session token
+type DeviceSessionRequest struct {
+	SerialNumber string `json:"serial_number"`
+	Challenge    string `json:"challenge"`
+	Signature    string `json:"signature"` // base64 signature of the challenge message
+}
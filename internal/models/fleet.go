@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Fleet is a group of devices governed by one credential policy. Devices join
+// a fleet through their fleet field or a DEVICE_GROUPS pattern.
+type Fleet struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Policy      FleetPolicy `json:"policy"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// FleetPolicy limits what a fleet's devices receive. Empty fields fall back
+// to the service-wide configuration.
+type FleetPolicy struct {
+	// Registries the fleet may get credentials for, by name
+	Registries []string `json:"registries,omitempty"`
+	// Repositories registry credentials are scoped to; for token-exchange
+	// registries they narrow the registry's configured repositories
+	Repositories []string `json:"repositories,omitempty"`
+	// Organization pins GitHub registry tokens to one organization
+	Organization string `json:"organization,omitempty"`
+	// AllowedScopes are the scopes device tokens may carry
+	AllowedScopes []string `json:"allowed_scopes,omitempty"`
+	// TokenTTL is the lifetime of device tokens, in seconds
+	TokenTTL int `json:"token_ttl,omitempty"`
+	// RateLimitPerMinute bounds each device's requests
+	RateLimitPerMinute int `json:"rate_limit_per_minute,omitempty"`
+}
+
+// FleetRequest creates or replaces a fleet
+type FleetRequest struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Policy      FleetPolicy `json:"policy"`
+}
@@ -7,6 +7,8 @@ type TokenRequest struct {
 	DeviceSerial string   `json:"device_serial,omitempty"`
 	TokenType    string   `json:"token_type,omitempty"`
 	Scopes       []string `json:"scopes,omitempty"`
+	// Policy is the requesting device's fleet policy, if any
+	Policy *FleetPolicy `json:"-"`
 }
 
 // TokenResponse represents a token response
@@ -21,32 +23,92 @@ type TokenResponse struct {
 type GitHubRegistryTokenRequest struct {
 	DeviceSerial string `json:"device_serial"`
 	Repository   string `json:"repository,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Group        string `json:"group,omitempty"`
+	// Quarantined limits the request to the recovery repositories
+	Quarantined bool `json:"-"`
+	// Policy is the requesting device's fleet policy, if any
+	Policy *FleetPolicy `json:"-"`
 }
 
 // GitHubRegistryTokenResponse represents GitHub registry token response
 type GitHubRegistryTokenResponse struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	Registry  string    `json:"registry"`
-	Username  string    `json:"username"`
+	Token               string            `json:"token"`
+	TokenType           string            `json:"token_type,omitempty"`
+	ExpiresAt           time.Time         `json:"expires_at"`
+	Registry            string            `json:"registry"`
+	Username            string            `json:"username"`
+	Permissions         map[string]string `json:"permissions,omitempty"`
+	RepositorySelection string            `json:"repository_selection,omitempty"`
+	Repositories        []string          `json:"repositories,omitempty"`
+}
+
+// RegistryTokenTypeBearer marks registry credentials that are a bearer token
+// rather than a password, as issued by token-exchange registries
+const RegistryTokenTypeBearer = "bearer"
+
+// RegistryInfo describes a registry devices can request credentials for
+type RegistryInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	URL     string `json:"url"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// GitHubTokenRefreshRequest is the optional body of a forced token refresh
+type GitHubTokenRefreshRequest struct {
+	RevokePrevious bool `json:"revoke_previous,omitempty"`
+}
+
+// GitHubTokenValidationRequest asks whether a registry token is still usable
+type GitHubTokenValidationRequest struct {
+	Token       string `json:"token"`
+	CheckGitHub bool   `json:"check_github,omitempty"`
+}
+
+// GitHubTokenValidationResponse describes the state of a registry token
+type GitHubTokenValidationResponse struct {
+	Valid            bool              `json:"valid"`
+	Message          string            `json:"message,omitempty"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	RemainingSeconds int64             `json:"remaining_seconds"`
+	Permissions      map[string]string `json:"permissions,omitempty"`
+	Repositories     []string          `json:"repositories,omitempty"`
+	IssuedToDevice   bool              `json:"issued_to_device"`
+	Revoked          bool              `json:"revoked"`
+	GitHubChecked    bool              `json:"github_checked"`
 }
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
-	Code    int    `json:"code"`
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Code       int    `json:"code"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
 }
 
 // DeviceValidationRequest for device authentication
 type DeviceValidationRequest struct {
 	SerialNumber string `json:"serial_number"`
 	Signature    string `json:"signature,omitempty"`
+	Timestamp    string `json:"timestamp,omitempty"`
+	Nonce        string `json:"nonce,omitempty"`
+	// SignedPayload is the canonical request the signature covers
+	SignedPayload string `json:"-"`
+	// IdentityVerified is set when the serial comes from a verified client
+	// certificate or device session token, so no request signature is needed
+	IdentityVerified bool `json:"-"`
+	// ClientCertificate is set when the serial comes from a verified client
+	// certificate
+	ClientCertificate bool `json:"-"`
 }
 
 // DeviceValidationResponse for device authentication
 type DeviceValidationResponse struct {
 	Valid      bool   `json:"valid"`
 	DeviceID   string `json:"device_id,omitempty"`
+	Status     string `json:"status,omitempty"`
 	Message    string `json:"message,omitempty"`
+	// Device is the validated device, when the registry knows it
+	Device *Device `json:"-"`
 }
@@ -0,0 +1,347 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUpstreamTokens bounds the upstream token cache
+const maxUpstreamTokens = 1024
+
+// UpstreamCredentialsFunc returns the credentials used to pull repository
+// from the upstream registry on behalf of a device
+type UpstreamCredentialsFunc func(deviceSerial, repository string) (username, password string, err error)
+
+// Proxy is a pull-through auth proxy in front of an upstream registry such as
+// ghcr.io. Devices present registry tokens issued by this service; the proxy
+// exchanges the upstream credentials for an upstream bearer token itself, so
+// those credentials never leave the server.
+type Proxy struct {
+	upstream    *url.URL
+	issuer      *TokenIssuer
+	realm       string
+	credentials UpstreamCredentialsFunc
+	client      *http.Client
+	proxy       *httputil.ReverseProxy
+
+	// writeTimeout replaces the server's write timeout for proxied pulls,
+	// which stream whole image layers
+	writeTimeout time.Duration
+
+	mu        sync.Mutex
+	challenge *challenge
+	tokens    map[string]upstreamToken
+}
+
+// challenge is the upstream registry's Bearer auth challenge
+type challenge struct {
+	realm   string
+	service string
+}
+
+type upstreamToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// NewProxy creates a proxy for upstreamHost (e.g. "ghcr.io"). realm is the
+// absolute URL of this service's token endpoint, advertised to clients, and
+// writeTimeout bounds a single proxied response; 0 means no limit.
+func NewProxy(upstreamHost, realm string, issuer *TokenIssuer, credentials UpstreamCredentialsFunc, writeTimeout time.Duration) *Proxy {
+	upstream := &url.URL{Scheme: "https", Host: upstreamHost}
+
+	p := &Proxy{
+		upstream:    upstream,
+		issuer:      issuer,
+		realm:       realm,
+		credentials: credentials,
+		client:      &http.Client{Timeout: 15 * time.Second},
+		tokens:      make(map[string]upstreamToken),
+
+		writeTimeout: writeTimeout,
+	}
+
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = upstream.Scheme
+			req.URL.Host = upstream.Host
+			req.Host = upstream.Host
+			req.Header.Del("Cookie")
+		},
+		ModifyResponse: p.modifyResponse,
+	}
+
+	return p
+}
+
+// ServeHTTP proxies read-only registry API requests for authorized devices
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		p.sendError(w, "UNSUPPORTED", "Only pulls are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, isBase := repositoryFromPath(r.URL.Path)
+	if name == "" && !isBase {
+		p.sendError(w, "NAME_UNKNOWN", "Unrecognised registry path", http.StatusNotFound)
+		return
+	}
+
+	claims := p.authenticate(r)
+	if claims == nil || (!isBase && !claims.Allows(name, "pull")) {
+		p.sendUnauthorized(w, name)
+		return
+	}
+
+	// API version check used by clients to probe the registry
+	if isBase {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+		return
+	}
+
+	token, err := p.upstreamToken(claims.Subject, name)
+	if err != nil {
+		log.Printf("Registry proxy: failed to authorize %s for device %s: %v", name, claims.Subject, err)
+		p.sendError(w, "UNAVAILABLE", "Upstream registry authorization failed", http.StatusBadGateway)
+		return
+	}
+
+	// Blobs take longer to stream than the server's write timeout allows
+	var deadline time.Time
+	if p.writeTimeout > 0 {
+		deadline = time.Now().Add(p.writeTimeout)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+		log.Printf("Registry proxy: failed to extend write deadline: %v", err)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+token)
+	p.proxy.ServeHTTP(w, r)
+}
+
+// authenticate validates the registry token presented by the client
+func (p *Proxy) authenticate(r *http.Request) *Claims {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return nil
+	}
+
+	claims, err := p.issuer.Validate(parts[1])
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// modifyResponse drops stale upstream tokens and hides upstream challenges
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		p.mu.Lock()
+		p.tokens = make(map[string]upstreamToken)
+		p.mu.Unlock()
+
+		// Send the client back to us rather than to the upstream realm
+		resp.Header.Set("WWW-Authenticate", p.challengeHeader(""))
+	}
+	return nil
+}
+
+// upstreamToken returns a cached upstream bearer token for repository,
+// exchanging the device's upstream credentials for one when needed
+func (p *Proxy) upstreamToken(deviceSerial, repository string) (string, error) {
+	username, password, err := p.credentials(deviceSerial, repository)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(username + ":" + password))
+	key := repository + "|" + hex.EncodeToString(sum[:])
+
+	p.mu.Lock()
+	cached, ok := p.tokens[key]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	c, err := p.upstreamChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("service", c.service)
+	query.Set("scope", "repository:"+repository+":pull")
+	req, err := http.NewRequest("GET", c.realm+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(username, password)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream token request failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Token == "" {
+		result.Token = result.AccessToken
+	}
+	if result.Token == "" {
+		return "", fmt.Errorf("upstream token response contained no token")
+	}
+	if result.ExpiresIn <= 0 {
+		// The token specification's default lifetime
+		result.ExpiresIn = 60
+	}
+
+	// Renew a little early so in-flight pulls do not race the expiry
+	lifetime := time.Duration(result.ExpiresIn)*time.Second - 10*time.Second
+	p.mu.Lock()
+	p.storeTokenLocked(key, upstreamToken{token: result.Token, expiresAt: time.Now().Add(lifetime)})
+	p.mu.Unlock()
+
+	return result.Token, nil
+}
+
+// storeTokenLocked caches token under key, dropping expired tokens and then
+// the token closest to expiry once the cache is full. p.mu must be held.
+func (p *Proxy) storeTokenLocked(key string, token upstreamToken) {
+	if _, ok := p.tokens[key]; !ok && len(p.tokens) >= maxUpstreamTokens {
+		now := time.Now()
+		for k, cached := range p.tokens {
+			if !now.Before(cached.expiresAt) {
+				delete(p.tokens, k)
+			}
+		}
+		for len(p.tokens) >= maxUpstreamTokens {
+			var oldestKey string
+			var oldest time.Time
+			for k, cached := range p.tokens {
+				if oldestKey == "" || cached.expiresAt.Before(oldest) {
+					oldestKey, oldest = k, cached.expiresAt
+				}
+			}
+			delete(p.tokens, oldestKey)
+		}
+	}
+	p.tokens[key] = token
+}
+
+// upstreamChallenge discovers where the upstream registry issues tokens
+func (p *Proxy) upstreamChallenge() (*challenge, error) {
+	p.mu.Lock()
+	c := p.challenge
+	p.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	resp, err := p.client.Get(p.upstream.String() + "/v2/")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	c = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if c == nil {
+		return nil, fmt.Errorf("upstream registry did not return a Bearer challenge (%s)", resp.Status)
+	}
+
+	p.mu.Lock()
+	p.challenge = c
+	p.mu.Unlock()
+	return c, nil
+}
+
+// parseChallenge parses `Bearer realm="...",service="..."`
+func parseChallenge(header string) *challenge {
+	scheme, params, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+
+	c := &challenge{}
+	for _, param := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "realm":
+			c.realm = value
+		case "service":
+			c.service = value
+		}
+	}
+	if c.realm == "" {
+		return nil
+	}
+	return c
+}
+
+// repositoryFromPath extracts the repository name from a registry API path.
+// isBase is true for the /v2/ version check endpoint.
+func repositoryFromPath(path string) (name string, isBase bool) {
+	rest := strings.TrimPrefix(path, "/v2/")
+	if rest == "" {
+		return "", true
+	}
+
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/list"} {
+		if i := strings.LastIndex(rest, marker); i > 0 {
+			return rest[:i], false
+		}
+	}
+	return "", false
+}
+
+// challengeHeader builds the WWW-Authenticate header pointing at our realm
+func (p *Proxy) challengeHeader(repository string) string {
+	header := fmt.Sprintf(`Bearer realm="%s",service="%s"`, p.realm, p.issuer.Service())
+	if repository != "" {
+		header += fmt.Sprintf(`,scope="repository:%s:pull"`, repository)
+	}
+	return header
+}
+
+// sendUnauthorized asks the client to obtain a token from our realm
+func (p *Proxy) sendUnauthorized(w http.ResponseWriter, repository string) {
+	w.Header().Set("WWW-Authenticate", p.challengeHeader(repository))
+	p.sendError(w, "UNAUTHORIZED", "Authentication required", http.StatusUnauthorized)
+}
+
+// sendError writes an error in the registry API's error format
+func (p *Proxy) sendError(w http.ResponseWriter, code, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy in front of a fake upstream registry that
+// issues bearer tokens for the basic credentials dtm-user:ghs_test
+func newTestProxy(t *testing.T) (*Proxy, *TokenIssuer, *atomic.Int32) {
+	t.Helper()
+
+	var tokenRequests atomic.Int32
+	var upstream *httptest.Server
+	upstream = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="ghcr.io"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/token":
+			tokenRequests.Add(1)
+			if username, password, _ := r.BasicAuth(); username != "dtm-user" || password != "ghs_test" {
+				t.Errorf("upstream token request with credentials %s:%s", username, password)
+			}
+			if service := r.URL.Query().Get("service"); service != "ghcr.io" {
+				t.Errorf("upstream token service = %q, want ghcr.io", service)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      "upstream-" + r.URL.Query().Get("scope"),
+				"expires_in": 300,
+			})
+		case r.Header.Get("Authorization") == "Bearer upstream-repository:ared-group/app:pull" && strings.HasPrefix(r.URL.Path, "/v2/ared-group/app/"):
+			w.Write([]byte("manifest"))
+		default:
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="ghcr.io"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	host := strings.TrimPrefix(upstream.URL, "https://")
+	issuer := NewTokenIssuer("secret", "dynamic-token-manager", time.Minute)
+	proxy := NewProxy(host, "https://dtm.example.com/registry/token", issuer, func(deviceSerial, repository string) (string, string, error) {
+		return "dtm-user", "ghs_test", nil
+	}, 0)
+	proxy.client = upstream.Client()
+	proxy.proxy.Transport = upstream.Client().Transport
+
+	return proxy, issuer, &tokenRequests
+}
+
+// pull sends a method request for path through proxy with token as bearer, if set
+func pull(proxy *Proxy, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProxy(t *testing.T) {
+	proxy, issuer, tokenRequests := newTestProxy(t)
+
+	token, _, err := issuer.Issue("SN1", []Access{
+		{Type: "repository", Name: "ared-group/app", Actions: []string{"pull"}},
+		{Type: "repository", Name: "ared-group/revoked", Actions: []string{"pull"}},
+	})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	// Without a token the client is sent to our realm for the repository
+	rec := pull(proxy, "GET", "/v2/ared-group/app/manifests/latest", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated pull: status %d, want 401", rec.Code)
+	}
+	want := `Bearer realm="https://dtm.example.com/registry/token",service="dynamic-token-manager",scope="repository:ared-group/app:pull"`
+	if got := rec.Header().Get("WWW-Authenticate"); got != want {
+		t.Errorf("challenge = %s, want %s", got, want)
+	}
+
+	if rec := pull(proxy, "GET", "/v2/", token); rec.Code != http.StatusOK || rec.Header().Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Errorf("version check: status %d, want 200 with the API version header", rec.Code)
+	}
+
+	// The upstream token is fetched once and reused
+	for i := 0; i < 2; i++ {
+		rec := pull(proxy, "GET", "/v2/ared-group/app/manifests/latest", token)
+		if rec.Code != http.StatusOK || rec.Body.String() != "manifest" {
+			t.Fatalf("pull %d: status %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := tokenRequests.Load(); n != 1 {
+		t.Errorf("upstream token requests = %d, want 1", n)
+	}
+
+	// Repositories outside the token are refused without reaching upstream
+	if rec := pull(proxy, "GET", "/v2/ared-group/other/manifests/latest", token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("pull of an ungranted repository: status %d, want 401", rec.Code)
+	}
+
+	// Upstream challenges point back at our realm, never at ghcr.io's
+	rec = pull(proxy, "GET", "/v2/ared-group/revoked/manifests/latest", token)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("upstream refusal: status %d, want 401", rec.Code)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, `realm="https://dtm.example.com/registry/token"`) {
+		t.Errorf("upstream challenge passed through: %s", got)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"PUT", "/v2/ared-group/app/manifests/latest", http.StatusMethodNotAllowed},
+		{"GET", "/v2/_catalog", http.StatusNotFound},
+	} {
+		if rec := pull(proxy, tt.method, tt.path, token); rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestProxyRejectsForeignTokens(t *testing.T) {
+	proxy, _, _ := newTestProxy(t)
+
+	other := NewTokenIssuer("other-secret", "dynamic-token-manager", time.Minute)
+	token, _, err := other.Issue("SN1", []Access{{Type: "repository", Name: "ared-group/app", Actions: []string{"pull"}}})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if rec := pull(proxy, "GET", "/v2/ared-group/app/manifests/latest", token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("pull with a foreign token: status %d, want 401", rec.Code)
+	}
+}
+
+func TestRepositoryFromPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		name   string
+		isBase bool
+	}{
+		{"/v2/", "", true},
+		{"/v2/ared-group/app/manifests/latest", "ared-group/app", false},
+		{"/v2/ared-group/team/app/blobs/sha256:abc", "ared-group/team/app", false},
+		{"/v2/ared-group/app/tags/list", "ared-group/app", false},
+		{"/v2/_catalog", "", false},
+	}
+	for _, tt := range tests {
+		if name, isBase := repositoryFromPath(tt.path); name != tt.name || isBase != tt.isBase {
+			t.Errorf("repositoryFromPath(%s) = %q, %v; want %q, %v", tt.path, name, isBase, tt.name, tt.isBase)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	c := parseChallenge(`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:user/image:pull"`)
+	if c == nil || c.realm != "https://ghcr.io/token" || c.service != "ghcr.io" {
+		t.Errorf("parseChallenge = %+v", c)
+	}
+	for _, header := range []string{"", `Basic realm="registry"`, `Bearer service="ghcr.io"`} {
+		if c := parseChallenge(header); c != nil {
+			t.Errorf("parseChallenge(%q) = %+v, want nil", header, c)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  Access
+		ok    bool
+	}{
+		{"repository:ared-group/app:pull", Access{Type: "repository", Name: "ared-group/app", Actions: []string{"pull"}}, true},
+		{"repository:ared-group/app:pull,push", Access{Type: "repository", Name: "ared-group/app", Actions: []string{"pull", "push"}}, true},
+		// Names may carry a port or tag-like colon; actions follow the last one
+		{"repository:localhost:5000/app:pull", Access{Type: "repository", Name: "localhost:5000/app", Actions: []string{"pull"}}, true},
+		{"repository:ared-group/app", Access{}, false},
+		{"repository:ared-group/app:", Access{}, false},
+		{":ared-group/app:pull", Access{}, false},
+		{"", Access{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseScope(tt.scope)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseScope(%q) error = %v, want ok %v", tt.scope, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseScope(%q) = %+v, want %+v", tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestTokenIssuer(t *testing.T) {
+	issuer := NewTokenIssuer("secret", "dynamic-token-manager", time.Minute)
+
+	token, expiry, err := issuer.Issue("SN1", []Access{{Type: "repository", Name: "ared-group/app", Actions: []string{"pull"}}})
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if d := time.Until(expiry); d <= 0 || d > time.Minute {
+		t.Errorf("expiry in %v, want within a minute", d)
+	}
+
+	claims, err := issuer.Validate(token)
+	if err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if claims.Subject != "SN1" {
+		t.Errorf("subject = %q, want SN1", claims.Subject)
+	}
+	if !claims.Allows("ared-group/app", "pull") {
+		t.Error("token does not allow pulling the granted repository")
+	}
+	if claims.Allows("ared-group/app", "push") || claims.Allows("ared-group/other", "pull") {
+		t.Error("token allows access that was not granted")
+	}
+
+	// Tokens are only valid for the issuing secret and service
+	for name, other := range map[string]*TokenIssuer{
+		"other secret":  NewTokenIssuer("other-secret", "dynamic-token-manager", time.Minute),
+		"other service": NewTokenIssuer("secret", "other-service", time.Minute),
+	} {
+		if _, err := other.Validate(token); err == nil {
+			t.Errorf("token validated under %s", name)
+		}
+	}
+
+	expired := NewTokenIssuer("secret", "dynamic-token-manager", -time.Minute)
+	token, _, err = expired.Issue("SN1", nil)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if _, err := issuer.Validate(token); err == nil {
+		t.Error("expired token validated")
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// ErrChallengeFailed is returned for any failed challenge response, so
+// callers can't probe which devices exist or have keys
+var ErrChallengeFailed = errors.New("challenge verification failed")
+
+// challengeIssuer issues stateless challenges: "<expiry>.<nonce>.<mac>", where
+// the MAC binds the serial number, expiry and nonce. Nothing is stored until a
+// challenge is answered with a valid signature, so requesting challenges
+// costs the server no memory and can't crowd out real devices.
+type challengeIssuer struct {
+	key []byte
+}
+
+// newChallengeIssuer derives the challenge MAC key from secret
+func newChallengeIssuer(secret string) *challengeIssuer {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("device-challenge"))
+	return &challengeIssuer{key: mac.Sum(nil)}
+}
+
+// issue creates a challenge for serialNumber valid until expiresAt
+func (c *challengeIssuer) issue(serialNumber string, expiresAt time.Time) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(expiresAt.Unix(), 10) + "." + nonce
+	return payload + "." + c.mac(serialNumber, payload), nil
+}
+
+// verify checks that challenge was issued to serialNumber and has not expired,
+// and returns its expiry
+func (c *challengeIssuer) verify(challenge, serialNumber string) (time.Time, bool) {
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	payload, mac := challenge[:i], challenge[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(c.mac(serialNumber, payload))) {
+		return time.Time{}, false
+	}
+
+	expiry, _, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expiresAt := time.Unix(unix, 0)
+	return expiresAt, time.Now().Before(expiresAt)
+}
+
+// mac authenticates a challenge payload for serialNumber
+func (c *challengeIssuer) mac(serialNumber, payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(serialNumber + "\n" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CreateChallenge issues a short-lived nonce bound to a serial number.
+// Challenges are issued for any well-formed serial so they reveal nothing
+// about which devices are enrolled.
+func (s *DeviceService) CreateChallenge(serialNumber string) (*models.DeviceChallengeResponse, error) {
+	if !validSerialNumber(serialNumber) {
+		return nil, ErrInvalidSerialNumber
+	}
+
+	expiresAt := time.Now().Add(s.config.DeviceChallengeTTL).UTC()
+	challenge, err := s.challenges.issue(serialNumber, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.DeviceChallengeResponse{
+		Challenge: challenge,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// VerifyChallenge checks a device's signed answer to a challenge. The device
+// must be enrolled with a key and in good standing.
+func (s *DeviceService) VerifyChallenge(req *models.DeviceSessionRequest) error {
+	expiresAt, ok := s.challenges.verify(req.Challenge, req.SerialNumber)
+	if !ok {
+		return ErrChallengeFailed
+	}
+
+	device, err := s.store.GetDevice(req.SerialNumber)
+	if err != nil {
+		log.Printf("Challenge response from unknown device %s: %v", req.SerialNumber, err)
+		return ErrChallengeFailed
+	}
+	if device.PublicKey == "" {
+		log.Printf("Challenge response from device %s without a registered key", req.SerialNumber)
+		return ErrChallengeFailed
+	}
+	key, err := devicesig.ParseVerifyKey(device.PublicKey)
+	if err != nil {
+		log.Printf("Invalid signing key registered for device %s: %v", req.SerialNumber, err)
+		return ErrChallengeFailed
+	}
+	if !key.Verify(devicesig.ChallengeMessage(req.SerialNumber, req.Challenge), req.Signature) {
+		return ErrChallengeFailed
+	}
+
+	// Each challenge is answered once. Only answers with a valid signature are
+	// remembered, so forged ones can't fill the cache.
+	if !s.nonces.Use(req.SerialNumber+"\nchallenge\n"+req.Challenge, expiresAt) {
+		return ErrChallengeFailed
+	}
+
+	// A session token would stand in for a certificate the device is bound to
+	if device.RequireClientCert {
+		return &DeviceRejectedError{Message: "Device must authenticate with its client certificate"}
+	}
+
+	// The signature proves the identity; the usual checks decide whether the
+	// device may authenticate at all
+	resp, err := s.validateDevice(&models.DeviceValidationRequest{SerialNumber: req.SerialNumber}, false)
+	if err != nil {
+		return err
+	}
+	if !resp.Valid {
+		return &DeviceRejectedError{Message: resp.Message}
+	}
+	return nil
+}
+
+// DeviceRejectedError is returned when a device proved its identity but may
+// not authenticate, e.g. because it is suspended
+type DeviceRejectedError struct {
+	Message string
+}
+
+func (e *DeviceRejectedError) Error() string {
+	return e.Message
+}
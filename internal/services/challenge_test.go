@@ -0,0 +1,186 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// answerChallenge fetches a challenge for serialNumber and signs it with key
+func answerChallenge(t *testing.T, s *DeviceService, serialNumber string, key *devicesig.SigningKey) *models.DeviceSessionRequest {
+	t.Helper()
+
+	challenge, err := s.CreateChallenge(serialNumber)
+	if err != nil {
+		t.Fatalf("CreateChallenge: %v", err)
+	}
+	return &models.DeviceSessionRequest{
+		SerialNumber: serialNumber,
+		Challenge:    challenge.Challenge,
+		Signature:    key.Sign(devicesig.ChallengeMessage(serialNumber, challenge.Challenge)),
+	}
+}
+
+func TestVerifyChallenge(t *testing.T) {
+	deviceService, tokenService := newTestServices(t, nil)
+	key := newSigningKey(t)
+	registerDevice(t, deviceService, "SN1", key)
+
+	req := answerChallenge(t, deviceService, "SN1", key)
+	if err := deviceService.VerifyChallenge(req); err != nil {
+		t.Fatalf("VerifyChallenge: %v", err)
+	}
+
+	// Challenges are single use
+	if err := deviceService.VerifyChallenge(req); !errors.Is(err, ErrChallengeFailed) {
+		t.Errorf("reused challenge error = %v, want ErrChallengeFailed", err)
+	}
+
+	session, err := tokenService.IssueDeviceSession("SN1")
+	if err != nil {
+		t.Fatalf("IssueDeviceSession: %v", err)
+	}
+	serial, err := tokenService.ValidateDeviceSessionToken(session.Token)
+	if err != nil || serial != "SN1" {
+		t.Errorf("ValidateDeviceSessionToken = %q, %v; want SN1", serial, err)
+	}
+}
+
+func TestVerifyChallengeRejects(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	key := newSigningKey(t)
+	registerDevice(t, deviceService, "SN1", key)
+	registerDevice(t, deviceService, "SN2", key)
+	registerDevice(t, deviceService, "KEYLESS", nil)
+
+	tests := []struct {
+		name string
+		req  func() *models.DeviceSessionRequest
+	}{
+		{"wrong key", func() *models.DeviceSessionRequest {
+			return answerChallenge(t, deviceService, "SN1", newSigningKey(t))
+		}},
+		{"challenge issued to another serial", func() *models.DeviceSessionRequest {
+			req := answerChallenge(t, deviceService, "SN2", key)
+			req.SerialNumber = "SN1"
+			req.Signature = key.Sign(devicesig.ChallengeMessage("SN1", req.Challenge))
+			return req
+		}},
+		{"unknown challenge", func() *models.DeviceSessionRequest {
+			return &models.DeviceSessionRequest{SerialNumber: "SN1", Challenge: "made-up", Signature: key.Sign("made-up")}
+		}},
+		{"unknown device", func() *models.DeviceSessionRequest {
+			return answerChallenge(t, deviceService, "UNKNOWN", key)
+		}},
+		{"device without a key", func() *models.DeviceSessionRequest {
+			return answerChallenge(t, deviceService, "KEYLESS", key)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := deviceService.VerifyChallenge(tt.req()); !errors.Is(err, ErrChallengeFailed) {
+				t.Errorf("VerifyChallenge error = %v, want ErrChallengeFailed", err)
+			}
+		})
+	}
+}
+
+func TestChallengeIssuer(t *testing.T) {
+	issuer := newChallengeIssuer("secret")
+
+	challenge, err := issuer.issue("SN1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if _, ok := issuer.verify(challenge, "SN1"); !ok {
+		t.Error("verify rejected a fresh challenge")
+	}
+	if _, ok := issuer.verify(challenge, "SN2"); ok {
+		t.Error("verify accepted a challenge issued to another serial")
+	}
+	if _, ok := newChallengeIssuer("other").verify(challenge, "SN1"); ok {
+		t.Error("verify accepted a challenge issued with another secret")
+	}
+
+	// The expiry can't be extended
+	_, rest, _ := strings.Cut(challenge, ".")
+	extended := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10) + "." + rest
+	if _, ok := issuer.verify(extended, "SN1"); ok {
+		t.Error("verify accepted a challenge with a forged expiry")
+	}
+
+	expired, err := issuer.issue("SN1", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if _, ok := issuer.verify(expired, "SN1"); ok {
+		t.Error("verify accepted an expired challenge")
+	}
+}
+
+func TestVerifyChallengeSuspendedDevice(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	key := newSigningKey(t)
+	registerDevice(t, deviceService, "SN1", key)
+	if _, err := deviceService.SetDeviceStatus("SN1", models.DeviceStatusSuspended, "test", ""); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+
+	var rejected *DeviceRejectedError
+	err := deviceService.VerifyChallenge(answerChallenge(t, deviceService, "SN1", key))
+	if !errors.As(err, &rejected) {
+		t.Fatalf("VerifyChallenge error = %v, want DeviceRejectedError", err)
+	}
+	if rejected.Message != "Device is suspended" {
+		t.Errorf("rejection = %q, want Device is suspended", rejected.Message)
+	}
+}
+
+func TestVerifyChallengeCertificateBoundDevice(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	key := newSigningKey(t)
+	registerDevice(t, deviceService, "SN1", key)
+	requireClientCert := true
+	if _, err := deviceService.UpdateDevice("SN1", &models.DeviceUpdateRequest{RequireClientCert: &requireClientCert}, "test"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+
+	// A session token would stand in for the certificate, so none is issued
+	var rejected *DeviceRejectedError
+	if err := deviceService.VerifyChallenge(answerChallenge(t, deviceService, "SN1", key)); !errors.As(err, &rejected) {
+		t.Errorf("VerifyChallenge error = %v, want DeviceRejectedError", err)
+	}
+
+	// Sessions issued before the binding are refused without the certificate
+	resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "SN1", IdentityVerified: true})
+	if err != nil || resp.Valid {
+		t.Errorf("session without certificate: %+v, %v; want invalid", resp, err)
+	}
+	resp, err = deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "SN1", IdentityVerified: true, ClientCertificate: true})
+	if err != nil || !resp.Valid {
+		t.Errorf("client certificate: %+v, %v; want valid", resp, err)
+	}
+}
+
+func TestDeviceSessionTokenType(t *testing.T) {
+	_, tokenService := newTestServices(t, nil)
+
+	// Clients can't mint session tokens, and other tokens aren't sessions
+	_, err := tokenService.GenerateToken(&models.TokenRequest{DeviceSerial: "SN1", TokenType: deviceSessionTokenType})
+	if !errors.Is(err, ErrReservedTokenType) {
+		t.Errorf("GenerateToken(device_session) error = %v, want ErrReservedTokenType", err)
+	}
+
+	access, err := tokenService.GenerateToken(&models.TokenRequest{DeviceSerial: "SN1"})
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if _, err := tokenService.ValidateDeviceSessionToken(access.Token); err == nil {
+		t.Error("ValidateDeviceSessionToken accepted an access token")
+	}
+}
@@ -1,22 +1,96 @@
 package services
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
 	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+// ErrInvalidSerialNumber is returned when registering a malformed serial number
+var ErrInvalidSerialNumber = errors.New("serial number must be 1-128 characters without whitespace or slashes")
+
+// ErrInvalidPublicKey is returned when a device key can't be parsed
+var ErrInvalidPublicKey = errors.New("invalid public key")
+
+// Device status change errors
+var (
+	ErrInvalidDeviceStatus   = errors.New("invalid device status")
+	ErrDeviceStatusUnchanged = errors.New("device status unchanged")
+	ErrDeviceDecommissioned  = errors.New("device has been decommissioned")
+)
+
+// Device listing page sizes
+const (
+	defaultDevicePageSize = 50
+	maxDevicePageSize     = 500
 )
 
+// DeactivationHook is called after a device has left active status or been
+// deleted
+type DeactivationHook func(serialNumber string)
+
+// ScopeChangeHook is called after the fleet policy of some devices changed,
+// possibly narrowing what their credentials may reach. affected reports
+// whether a device is one of them.
+type ScopeChangeHook func(affected func(serialNumber string) bool)
+
 type DeviceService struct {
-	config *config.Config
+	config     *config.Config
+	store      store.Store
+	nonces     *devicesig.NonceCache
+	challenges *challengeIssuer
+	sightings  *sightingRecorder
+	remote     *remoteValidator // nil without DEVICE_VALIDATION_URL
+
+	mu                sync.RWMutex
+	deactivationHooks []DeactivationHook
+	scopeChangeHooks  []ScopeChangeHook
 }
 
-func NewDeviceService(cfg *config.Config) *DeviceService {
-	return &DeviceService{
-		config: cfg,
+func NewDeviceService(cfg *config.Config, deviceStore store.Store) *DeviceService {
+	cleanupInterval := cfg.DeviceSignatureMaxSkew
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Minute
+	}
+
+	s := &DeviceService{
+		config:     cfg,
+		store:      deviceStore,
+		nonces:     devicesig.NewNonceCache(cleanupInterval),
+		challenges: newChallengeIssuer(cfg.JWTSecret),
+		sightings:  newSightingRecorder(deviceStore, cfg.DeviceLastSeenFlushInterval),
 	}
+	if cfg.DeviceValidationURL != "" {
+		s.remote = newRemoteValidator(cfg)
+	}
+	return s
+}
+
+// Close writes pending device sightings and releases the device store
+func (s *DeviceService) Close() error {
+	s.sightings.Close()
+	return s.store.Close()
 }
 
-// ValidateDevice validates a device by serial number
+// ValidateDevice validates a device by serial number and, unless it presented
+// a client certificate, by its request signature when the request is signed or
+// signatures are required
 func (s *DeviceService) ValidateDevice(req *models.DeviceValidationRequest) (*models.DeviceValidationResponse, error) {
+	return s.validateDevice(req, true)
+}
+
+// validateDevice checks that a device is enrolled and in good standing, and optionally
+// verifies its request signature
+func (s *DeviceService) validateDevice(req *models.DeviceValidationRequest, verifySignature bool) (*models.DeviceValidationResponse, error) {
 	if !s.config.DeviceAuthEnabled {
 		// If device auth is disabled, allow all devices
 		return &models.DeviceValidationResponse{
@@ -34,25 +108,517 @@ func (s *DeviceService) ValidateDevice(req *models.DeviceValidationRequest) (*mo
 		}, nil
 	}
 
-	// For now, accept any non-empty serial number
-	// TODO: Implement actual device validation logic
+	// Only enrolled devices may authenticate, unless the inventory service
+	// vouches for them
+	device, err := s.store.GetDevice(req.SerialNumber)
+	if errors.Is(err, store.ErrNotFound) && s.remote != nil {
+		return s.validateInventoryDevice(req, verifySignature)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return &models.DeviceValidationResponse{
+			Valid:    false,
+			DeviceID: req.SerialNumber,
+			Message:  "Device not registered",
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up device: %w", err)
+	}
+
+	// Quarantined devices authenticate; handlers narrow what they receive
+	switch device.Status {
+	case models.DeviceStatusActive, models.DeviceStatusQuarantined:
+	case models.DeviceStatusSuspended:
+		return &models.DeviceValidationResponse{
+			Valid:    false,
+			DeviceID: req.SerialNumber,
+			Message:  "Device is suspended",
+		}, nil
+	case models.DeviceStatusDecommissioned:
+		return &models.DeviceValidationResponse{
+			Valid:    false,
+			DeviceID: req.SerialNumber,
+			Message:  "Device has been decommissioned",
+		}, nil
+	default:
+		return &models.DeviceValidationResponse{
+			Valid:    false,
+			DeviceID: req.SerialNumber,
+			Message:  "Device is " + device.Status,
+		}, nil
+	}
+
+	// Once a device has presented a client certificate, a stolen serial must
+	// not stand in for it
+	if req.ClientCertificate && !device.RequireClientCert {
+		requireClientCert := true
+		event := &models.DeviceStatusEvent{
+			SerialNumber: req.SerialNumber,
+			Action:       models.DeviceEventUpdated,
+			Actor:        "device",
+			Reason:       "require_client_cert: presented a client certificate",
+		}
+		if _, err := s.store.UpdateDevice(req.SerialNumber, &models.DeviceUpdateRequest{RequireClientCert: &requireClientCert}, event); err != nil {
+			log.Printf("Failed to require a client certificate for device %s: %v", req.SerialNumber, err)
+		} else {
+			log.Printf("Device %s now requires its client certificate", req.SerialNumber)
+		}
+	}
+
+	// A device bound to its client certificate must present it, even with a
+	// session token
+	if verifySignature && device.RequireClientCert && !req.ClientCertificate {
+		return &models.DeviceValidationResponse{
+			Valid:    false,
+			DeviceID: req.SerialNumber,
+			Message:  "Device must authenticate with its client certificate",
+		}, nil
+	}
+
+	// A verified client certificate or session token already proves the
+	// device's identity
+	if verifySignature && !req.IdentityVerified {
+		if message := s.verifySignature(device, req); message != "" {
+			return &models.DeviceValidationResponse{
+				Valid:    false,
+				DeviceID: req.SerialNumber,
+				Message:  message,
+			}, nil
+		}
+	}
+
+	// Finally defer to the inventory service, if one is configured
+	if s.remote != nil {
+		resp, err := s.remote.Validate(req.SerialNumber, true)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Valid {
+			return resp, nil
+		}
+	}
+
 	return &models.DeviceValidationResponse{
 		Valid:    true,
 		DeviceID: req.SerialNumber,
+		Status:   device.Status,
 		Message:  "Device validated successfully",
+		Device:   device,
+	}, nil
+}
+
+// validateInventoryDevice validates a device that was never registered here
+// but may be known to the inventory service, which then decides alone. With no
+// key on record, the device must prove its identity with a client certificate
+// unless signatures are not required.
+func (s *DeviceService) validateInventoryDevice(req *models.DeviceValidationRequest, verifySignature bool) (*models.DeviceValidationResponse, error) {
+	device := &models.Device{SerialNumber: req.SerialNumber, Status: models.DeviceStatusActive}
+	if verifySignature && !req.IdentityVerified {
+		if message := s.verifySignature(device, req); message != "" {
+			return &models.DeviceValidationResponse{
+				Valid:    false,
+				DeviceID: req.SerialNumber,
+				Message:  message,
+			}, nil
+		}
+	}
+
+	resp, err := s.remote.Validate(req.SerialNumber, false)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Valid {
+		return resp, nil
+	}
+
+	return &models.DeviceValidationResponse{
+		Valid:    true,
+		DeviceID: req.SerialNumber,
+		Status:   device.Status,
+		Message:  "Device validated by inventory service",
 	}, nil
 }
 
-// IsValidDevice checks if a device serial number is valid
+// verifySignature checks a request's signature against the device's registered
+// key. It returns why the request was rejected, or "" if it is acceptable.
+func (s *DeviceService) verifySignature(device *models.Device, req *models.DeviceValidationRequest) string {
+	if req.Signature == "" {
+		// Devices with a registered key must always sign; keyless devices
+		// are only trusted unsigned when signatures are not required
+		if s.config.DeviceSignatureRequired || device.PublicKey != "" {
+			return "Request signature required"
+		}
+		return ""
+	}
+
+	if device.PublicKey == "" {
+		return "Device has no registered signing key"
+	}
+	key, err := devicesig.ParseVerifyKey(device.PublicKey)
+	if err != nil {
+		log.Printf("Invalid signing key registered for device %s: %v", device.SerialNumber, err)
+		return "Device signing key is invalid"
+	}
+
+	timestamp, err := devicesig.ParseTimestamp(req.Timestamp)
+	if err != nil {
+		return "Invalid request timestamp"
+	}
+	skew := time.Since(timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s.config.DeviceSignatureMaxSkew {
+		return "Request timestamp outside allowed clock skew"
+	}
+
+	if !key.Verify(req.SignedPayload, req.Signature) {
+		return "Invalid request signature"
+	}
+
+	// Only remember nonces of valid signatures, so forged requests can't burn them
+	if req.Nonce == "" {
+		return "Request nonce required"
+	}
+	if !s.nonces.Use(device.SerialNumber+":"+req.Nonce, timestamp.Add(s.config.DeviceSignatureMaxSkew)) {
+		return "Request nonce already used"
+	}
+	return ""
+}
+
+// IsValidDevice checks that a device is enrolled and in good standing. It does not
+// verify request signatures, so use it only where the device has already
+// proven its identity, e.g. with a session token.
 func (s *DeviceService) IsValidDevice(serialNumber string) bool {
+	return s.VerifiedDeviceAccess(serialNumber) != nil
+}
+
+// VerifiedDeviceAccess is IsValidDevice returning the device's access, or nil
+// if it may not authenticate
+func (s *DeviceService) VerifiedDeviceAccess(serialNumber string) *models.DeviceAccess {
 	req := &models.DeviceValidationRequest{
 		SerialNumber: serialNumber,
 	}
-	
-	resp, err := s.ValidateDevice(req)
+
+	resp, err := s.validateDevice(req, false)
 	if err != nil {
+		log.Printf("Device validation failed for %s: %v", serialNumber, err)
+		return nil
+	}
+	if !resp.Valid {
+		return nil
+	}
+	return s.Access(serialNumber, resp.Device)
+}
+
+// Access resolves the group and policy of a device already loaded, or of an
+// unregistered one when device is nil
+func (s *DeviceService) Access(serialNumber string, device *models.Device) *models.DeviceAccess {
+	group := s.deviceGroup(serialNumber, device)
+	return &models.DeviceAccess{
+		SerialNumber: serialNumber,
+		Device:       device,
+		Group:        group,
+		Policy:       s.FleetPolicy(group),
+	}
+}
+
+// LoadAccess loads a device and resolves its access, for callers that did not
+// authenticate it themselves
+func (s *DeviceService) LoadAccess(serialNumber string) *models.DeviceAccess {
+	device, err := s.store.GetDevice(serialNumber)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Failed to look up device %s: %v", serialNumber, err)
+		}
+		device = nil
+	}
+	return s.Access(serialNumber, device)
+}
+
+// GetDevice returns an enrolled device
+func (s *DeviceService) GetDevice(serialNumber string) (*models.Device, error) {
+	return s.store.GetDevice(serialNumber)
+}
+
+// RegisterDevice enrolls a new, active device on behalf of actor
+func (s *DeviceService) RegisterDevice(req *models.DeviceRegistrationRequest, actor string) (*models.Device, error) {
+	if !validSerialNumber(req.SerialNumber) {
+		return nil, ErrInvalidSerialNumber
+	}
+	if req.PublicKey != "" {
+		if err := validatePublicKey(req.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	device := &models.Device{
+		SerialNumber:      req.SerialNumber,
+		Status:            models.DeviceStatusActive,
+		Fleet:             req.Fleet,
+		HardwareModel:     req.HardwareModel,
+		PublicKey:         req.PublicKey,
+		RequireClientCert: req.RequireClientCert,
+	}
+	event := &models.DeviceStatusEvent{
+		SerialNumber: device.SerialNumber,
+		Action:       models.DeviceEventRegistered,
+		Actor:        actor,
+	}
+	if err := s.store.CreateDevice(device, event); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Device registered: %s by %s", device.SerialNumber, actor)
+	return device, nil
+}
+
+// ListDevices returns one page of enrolled devices
+func (s *DeviceService) ListDevices(filter models.DeviceFilter) (*models.DeviceListResponse, error) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultDevicePageSize
+	}
+	if filter.Limit > maxDevicePageSize {
+		filter.Limit = maxDevicePageSize
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	devices, total, err := s.store.ListDevices(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &models.DeviceListResponse{
+		Devices: devices,
+		Total:   total,
+		Limit:   filter.Limit,
+		Offset:  filter.Offset,
+	}, nil
+}
+
+// UpdateDevice changes the details of an enrolled device on behalf of actor,
+// recording which fields changed
+func (s *DeviceService) UpdateDevice(serialNumber string, req *models.DeviceUpdateRequest, actor string) (*models.Device, error) {
+	if req.PublicKey != nil && *req.PublicKey != "" {
+		if err := validatePublicKey(*req.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var fields []string
+	if req.Fleet != nil {
+		fields = append(fields, "fleet")
+	}
+	if req.HardwareModel != nil {
+		fields = append(fields, "hardware_model")
+	}
+	if req.PublicKey != nil {
+		fields = append(fields, "public_key")
+	}
+	if req.RequireClientCert != nil {
+		fields = append(fields, "require_client_cert")
+	}
+	event := &models.DeviceStatusEvent{
+		SerialNumber: serialNumber,
+		Action:       models.DeviceEventUpdated,
+		Actor:        actor,
+		Reason:       strings.Join(fields, ", "),
+	}
+
+	var previousGroup string
+	if req.Fleet != nil {
+		previous, err := s.store.GetDevice(serialNumber)
+		if err != nil {
+			return nil, err
+		}
+		previousGroup = s.deviceGroup(serialNumber, previous)
+	}
+
+	// Only the named fields are written, so a concurrent status change sticks
+	device, err := s.store.UpdateDevice(serialNumber, req, event)
+	if err != nil {
+		return nil, err
+	}
+
+	// Credentials issued under the old fleet's policy may reach more than the
+	// new one allows
+	if req.Fleet != nil && s.deviceGroup(serialNumber, device) != previousGroup {
+		log.Printf("Device %s moved from fleet %q to %q by %s", serialNumber, previousGroup, device.Fleet, actor)
+		s.runScopeChangeHooks(func(serial string) bool { return serial == serialNumber })
+	}
+	return device, nil
+}
+
+// DeleteDevice removes a device from the registry on behalf of actor and runs
+// deactivation hooks
+func (s *DeviceService) DeleteDevice(serialNumber, actor string) error {
+	event := &models.DeviceStatusEvent{
+		SerialNumber: serialNumber,
+		Action:       models.DeviceEventDeleted,
+		Actor:        actor,
+	}
+	if err := s.store.DeleteDevice(serialNumber, event); err != nil {
+		return err
+	}
+
+	log.Printf("Device deleted: %s by %s", serialNumber, actor)
+	s.runDeactivationHooks(serialNumber)
+	return nil
+}
+
+// GetDeviceGroup returns the fleet group a device belongs to, or "" if none.
+// The fleet recorded in the device registry wins over DEVICE_GROUPS patterns.
+func (s *DeviceService) GetDeviceGroup(serialNumber string) string {
+	device, err := s.store.GetDevice(serialNumber)
+	if err != nil {
+		device = nil
+	}
+	return s.deviceGroup(serialNumber, device)
+}
+
+// deviceGroup is GetDeviceGroup for a device already loaded, or nil
+func (s *DeviceService) deviceGroup(serialNumber string, device *models.Device) string {
+	if device != nil && device.Fleet != "" {
+		return device.Fleet
+	}
+
+	for _, rule := range s.config.DeviceGroupPatterns {
+		if matched, err := path.Match(rule.Pattern, serialNumber); err == nil && matched {
+			return rule.Group
+		}
+	}
+	return ""
+}
+
+// OnDeactivate registers a hook run whenever a device leaves active status or
+// is deleted
+func (s *DeviceService) OnDeactivate(hook DeactivationHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deactivationHooks = append(s.deactivationHooks, hook)
+}
+
+// OnScopeChange registers a hook run whenever devices move to another fleet
+// or the policy of their fleet changes what credentials may reach
+func (s *DeviceService) OnScopeChange(hook ScopeChangeHook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scopeChangeHooks = append(s.scopeChangeHooks, hook)
+}
+
+// SetDeviceStatus moves a device to status and records that actor changed it
+// and why. Leaving active status runs the deactivation hooks, so credentials
+// issued under the old status are revoked.
+func (s *DeviceService) SetDeviceStatus(serialNumber, status, actor, reason string) (*models.DeviceStatusEvent, error) {
+	switch status {
+	case models.DeviceStatusActive, models.DeviceStatusSuspended,
+		models.DeviceStatusQuarantined, models.DeviceStatusDecommissioned:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDeviceStatus, status)
+	}
+	event := &models.DeviceStatusEvent{
+		SerialNumber: serialNumber,
+		Action:       models.DeviceEventStatusChanged,
+		ToStatus:     status,
+		Actor:        actor,
+		Reason:       reason,
+	}
+	err := s.store.SetDeviceStatus(event, func(device *models.Device) error {
+		if device.Status == models.DeviceStatusDecommissioned {
+			return ErrDeviceDecommissioned
+		}
+		if device.Status == status {
+			return fmt.Errorf("%w: already %s", ErrDeviceStatusUnchanged, status)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Device %s changed from %s to %s by %s: %s", serialNumber, event.FromStatus, status, actor, reason)
+	if status == models.DeviceStatusActive {
+		if s.remote != nil {
+			s.remote.Invalidate(serialNumber)
+		}
+	} else {
+		s.runDeactivationHooks(serialNumber)
+	}
+	return event, nil
+}
+
+// DeviceStatusHistory returns a device's events, newest first
+func (s *DeviceService) DeviceStatusHistory(serialNumber string) ([]*models.DeviceStatusEvent, error) {
+	events, err := s.store.ListDeviceStatusEvents(serialNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		// Tell devices without history apart from unknown ones
+		if _, err := s.store.GetDevice(serialNumber); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// runDeactivationHooks runs the registered deactivation hooks for a device
+func (s *DeviceService) runDeactivationHooks(serialNumber string) {
+	s.mu.RLock()
+	hooks := append([]DeactivationHook(nil), s.deactivationHooks...)
+	s.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(serialNumber)
+	}
+}
+
+// runScopeChangeHooks runs the registered scope change hooks
+func (s *DeviceService) runScopeChangeHooks(affected func(serialNumber string) bool) {
+	s.mu.RLock()
+	hooks := append([]ScopeChangeHook(nil), s.scopeChangeHooks...)
+	s.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(affected)
+	}
+}
+
+// HoldsAccess reports whether a device may still authenticate and receive
+// registry credentials: it is active or quarantined, or it is unregistered and
+// the inventory service has not refused it. Revocation treats devices it
+// can't decide on as entitled, so a shared token is evicted rather than
+// revoked from under them.
+func (s *DeviceService) HoldsAccess(serialNumber string) bool {
+	if !s.config.DeviceAuthEnabled {
+		return true
+	}
+
+	device, err := s.store.GetDevice(serialNumber)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		if s.remote == nil {
+			return false
+		}
+		// Only the cached verdict is consulted; revocation must not wait on
+		// the inventory service for every holder
+		verdict, ok := s.remote.Cached(serialNumber)
+		return !ok || verdict.Valid
+	case err != nil:
+		log.Printf("Failed to look up device %s, treating it as entitled: %v", serialNumber, err)
+		return true
+	}
+	return device.Status == models.DeviceStatusActive || device.Status == models.DeviceStatusQuarantined
+}
+
+// validSerialNumber reports whether a serial number can be registered. Serials
+// appear in URL paths and headers, so whitespace and slashes are rejected.
+func validSerialNumber(serialNumber string) bool {
+	if serialNumber == "" || len(serialNumber) > 128 {
 		return false
 	}
-	
-	return resp.Valid
+	return !strings.ContainsAny(serialNumber, " \t\r\n/")
 }
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// signedValidationRequest builds the validation request for a request to uri
+// signed with key at timestamp
+func signedValidationRequest(serialNumber string, key *devicesig.SigningKey, uri string, timestamp time.Time, nonce string) *models.DeviceValidationRequest {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	payload := devicesig.CanonicalRequest("GET", uri, ts, nonce, devicesig.BodyHash(nil))
+	return &models.DeviceValidationRequest{
+		SerialNumber:  serialNumber,
+		Signature:     key.Sign(payload),
+		Timestamp:     ts,
+		Nonce:         nonce,
+		SignedPayload: payload,
+	}
+}
+
+func TestValidateDeviceSignatures(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	key := newSigningKey(t)
+	registerDevice(t, deviceService, "SN1", key)
+
+	valid := signedValidationRequest("SN1", key, "/api/v1/tokens", time.Now(), "nonce-1")
+	if resp, err := deviceService.ValidateDevice(valid); err != nil || !resp.Valid {
+		t.Fatalf("signed request: %+v, %v; want valid", resp, err)
+	}
+
+	tests := []struct {
+		name    string
+		req     *models.DeviceValidationRequest
+		message string
+	}{
+		{"replayed nonce", valid, "Request nonce already used"},
+		{"unsigned", &models.DeviceValidationRequest{SerialNumber: "SN1"}, "Request signature required"},
+		{"wrong key", signedValidationRequest("SN1", newSigningKey(t), "/api/v1/tokens", time.Now(), "nonce-2"), "Invalid request signature"},
+		{"stale timestamp", signedValidationRequest("SN1", key, "/api/v1/tokens", time.Now().Add(-time.Hour), "nonce-3"), "Request timestamp outside allowed clock skew"},
+		{"unknown device", signedValidationRequest("SN2", key, "/api/v1/tokens", time.Now(), "nonce-4"), "Device not registered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := deviceService.ValidateDevice(tt.req)
+			if err != nil {
+				t.Fatalf("ValidateDevice: %v", err)
+			}
+			if resp.Valid || resp.Message != tt.message {
+				t.Errorf("ValidateDevice = %+v, want invalid with %q", resp, tt.message)
+			}
+		})
+	}
+}
+
+func TestValidateDeviceVerifiedIdentity(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	registerDevice(t, deviceService, "SN1", newSigningKey(t))
+
+	// A verified client certificate stands in for the signature
+	resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "SN1", IdentityVerified: true})
+	if err != nil || !resp.Valid {
+		t.Errorf("verified identity: %+v, %v; want valid", resp, err)
+	}
+}
+
+func TestValidateDeviceStatus(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+
+	statuses := map[string]string{
+		models.DeviceStatusSuspended:      "Device is suspended",
+		models.DeviceStatusDecommissioned: "Device has been decommissioned",
+		models.DeviceStatusQuarantined:    "",
+	}
+	for status, message := range statuses {
+		t.Run(status, func(t *testing.T) {
+			serial := "SN-" + status
+			registerDevice(t, deviceService, serial, nil)
+			if _, err := deviceService.SetDeviceStatus(serial, status, "test", ""); err != nil {
+				t.Fatalf("SetDeviceStatus: %v", err)
+			}
+
+			resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: serial, IdentityVerified: true})
+			if err != nil {
+				t.Fatalf("ValidateDevice: %v", err)
+			}
+			if resp.Valid != (message == "") || (message != "" && resp.Message != message) {
+				t.Errorf("ValidateDevice = %+v, want message %q", resp, message)
+			}
+		})
+	}
+}
+
+func TestHoldsAccess(t *testing.T) {
+	inventory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req models.DeviceValidationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(models.DeviceValidationResponse{Valid: req.SerialNumber == "INVENTORY"})
+	}))
+	defer inventory.Close()
+
+	deviceService, _ := newTestServices(t, map[string]string{"DEVICE_VALIDATION_URL": inventory.URL})
+	registerDevice(t, deviceService, "ACTIVE", nil)
+	registerDevice(t, deviceService, "SUSPENDED", nil)
+	if _, err := deviceService.SetDeviceStatus("SUSPENDED", models.DeviceStatusSuspended, "test", ""); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+	for _, serial := range []string{"INVENTORY", "REFUSED"} {
+		deviceService.VerifiedDeviceAccess(serial)
+	}
+
+	want := map[string]bool{
+		"ACTIVE":    true,
+		"SUSPENDED": false,
+		"INVENTORY": true,
+		"REFUSED":   false,
+		// Without a verdict the device is given the benefit of the doubt
+		"UNSEEN": true,
+	}
+	for serial, holds := range want {
+		if got := deviceService.HoldsAccess(serial); got != holds {
+			t.Errorf("HoldsAccess(%s) = %v, want %v", serial, got, holds)
+		}
+	}
+
+	deviceService, _ = newTestServices(t, nil)
+	if deviceService.HoldsAccess("UNSEEN") {
+		t.Error("unregistered device holds access without an inventory service")
+	}
+}
+
+func TestHoldsAccessWithoutDeviceAuth(t *testing.T) {
+	gh := newFakeGitHub(t)
+	env := gh.env(t)
+	env["DEVICE_AUTH_ENABLED"] = "false"
+	deviceService, tokenService := newTestServices(t, env)
+
+	// Every device may authenticate, so tokens they share stay valid
+	shared, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN1"})
+	if err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+	if _, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN2"}); err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+
+	revoked, evicted, err := tokenService.RevokeDeviceTokens("SN1", deviceService.HoldsAccess)
+	if err != nil || revoked != 0 || evicted != 1 {
+		t.Errorf("RevokeDeviceTokens = %d revoked, %d evicted, %v; want 0 and 1", revoked, evicted, err)
+	}
+	if gh.Revoked(shared.Token) {
+		t.Error("a token another device holds was revoked")
+	}
+}
+
+func TestValidateDeviceInventory(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	inventory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		<-release
+		var req models.DeviceValidationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(models.DeviceValidationResponse{Valid: req.SerialNumber == "INVENTORY"})
+	}))
+	defer inventory.Close()
+
+	deviceService, _ := newTestServices(t, map[string]string{"DEVICE_VALIDATION_URL": inventory.URL})
+
+	// Concurrent misses share one lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "INVENTORY", IdentityVerified: true})
+			if err != nil || !resp.Valid {
+				t.Errorf("device known to the inventory: %+v, %v; want valid", resp, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("inventory looked up %d times, want 1", n)
+	}
+
+	resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "UNKNOWN", IdentityVerified: true})
+	if err != nil || resp.Valid {
+		t.Errorf("device unknown to the inventory: %+v, %v; want invalid", resp, err)
+	}
+
+	// Without a key the serial alone doesn't prove the identity
+	resp, err = deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "INVENTORY"})
+	if err != nil || resp.Valid {
+		t.Errorf("unverified device known to the inventory: %+v, %v; want invalid", resp, err)
+	}
+}
+
+func TestValidateDeviceInventoryFailOpen(t *testing.T) {
+	inventory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer inventory.Close()
+
+	deviceService, _ := newTestServices(t, map[string]string{
+		"DEVICE_VALIDATION_URL":       inventory.URL,
+		"DEVICE_VALIDATION_FAIL_OPEN": "true",
+	})
+	registerDevice(t, deviceService, "SN1", nil)
+
+	resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "SN1", IdentityVerified: true})
+	if err != nil || !resp.Valid {
+		t.Errorf("enrolled device: %+v, %v; want valid under fail-open", resp, err)
+	}
+
+	// Only the inventory could vouch for an unregistered device
+	if resp, err := deviceService.ValidateDevice(&models.DeviceValidationRequest{SerialNumber: "UNKNOWN", IdentityVerified: true}); err == nil {
+		t.Errorf("unregistered device: %+v; want an error", resp)
+	}
+}
+
+func TestDeviceEvents(t *testing.T) {
+	deviceService, _ := newTestServices(t, nil)
+	if _, err := deviceService.RegisterDevice(&models.DeviceRegistrationRequest{SerialNumber: "SN1"}, "alice"); err != nil {
+		t.Fatalf("RegisterDevice: %v", err)
+	}
+	fleet := "lab"
+	if _, err := deviceService.UpdateDevice("SN1", &models.DeviceUpdateRequest{Fleet: &fleet}, "bob"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	if _, err := deviceService.SetDeviceStatus("SN1", models.DeviceStatusSuspended, "carol", "lost"); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+	if err := deviceService.DeleteDevice("SN1", "dave"); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+
+	events, err := deviceService.DeviceStatusHistory("SN1")
+	if err != nil {
+		t.Fatalf("DeviceStatusHistory: %v", err)
+	}
+	want := []models.DeviceStatusEvent{
+		{Action: models.DeviceEventDeleted, Actor: "dave"},
+		{Action: models.DeviceEventStatusChanged, Actor: "carol", Reason: "lost"},
+		{Action: models.DeviceEventUpdated, Actor: "bob", Reason: "fleet"},
+		{Action: models.DeviceEventRegistered, Actor: "alice"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		if event.Action != want[i].Action || event.Actor != want[i].Actor || event.Reason != want[i].Reason {
+			t.Errorf("event %d = %+v, want %s by %s (%q)", i, event, want[i].Action, want[i].Actor, want[i].Reason)
+		}
+	}
+}
+
+func TestDeviceLastSeen(t *testing.T) {
+	deviceService, _ := newTestServices(t, map[string]string{"DEVICE_LAST_SEEN_FLUSH_INTERVAL": "1h"})
+	registerDevice(t, deviceService, "SN1", nil)
+	registerDevice(t, deviceService, "SN2", nil)
+
+	// A heartbeat writes the request's sighting at once
+	deviceService.RecordSeen("SN1", "10.0.0.1", "agent/1.0")
+	device, err := deviceService.RecordHeartbeat("SN1", &models.DeviceHeartbeat{})
+	if err != nil {
+		t.Fatalf("RecordHeartbeat: %v", err)
+	}
+	if device.LastSeenAt == nil || device.LastSeenIP != "10.0.0.1" || device.ClientVersion != "agent/1.0" {
+		t.Errorf("heartbeat left last-seen at %v from %q with %q", device.LastSeenAt, device.LastSeenIP, device.ClientVersion)
+	}
+
+	// Closing writes sightings still waiting for the next flush
+	deviceService.RecordSeen("SN2", "10.0.0.2", "")
+	if err := deviceService.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	device, err = deviceService.GetDevice("SN2")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.LastSeenAt == nil || device.LastSeenIP != "10.0.0.2" {
+		t.Errorf("Close left last-seen at %v from %q", device.LastSeenAt, device.LastSeenIP)
+	}
+}
+
+func TestUpdateDeviceFleetRevokesTokens(t *testing.T) {
+	gh := newFakeGitHub(t)
+	deviceService, tokenService := newTestServices(t, gh.env(t))
+	for _, serial := range []string{"SN1", "SN2"} {
+		registerDevice(t, deviceService, serial, nil)
+	}
+	// As wired by the API routes
+	deviceService.OnScopeChange(func(affected func(string) bool) {
+		if _, _, err := tokenService.RevokeTokens(affected, deviceService.HoldsAccess); err != nil {
+			t.Errorf("RevokeTokens: %v", err)
+		}
+	})
+
+	getToken := func(serial string) string {
+		t.Helper()
+		token, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: serial})
+		if err != nil {
+			t.Fatalf("GetGitHubRegistryToken(%s): %v", serial, err)
+		}
+		return token.Token
+	}
+	move := func(serial, fleet string) {
+		t.Helper()
+		if _, err := deviceService.UpdateDevice(serial, &models.DeviceUpdateRequest{Fleet: &fleet}, "test"); err != nil {
+			t.Fatalf("UpdateDevice(%s): %v", serial, err)
+		}
+	}
+
+	shared := getToken("SN1")
+	getToken("SN2")
+
+	// SN2 may still use the shared token, so it is only taken out of the cache
+	move("SN1", "edge")
+	if gh.Revoked(shared) {
+		t.Error("a token SN2 still holds was revoked")
+	}
+	own := getToken("SN2")
+	if own == shared {
+		t.Fatal("the moved device's token was served again")
+	}
+
+	// Updates that keep the fleet leave tokens alone
+	model := "rpi5"
+	if _, err := deviceService.UpdateDevice("SN2", &models.DeviceUpdateRequest{HardwareModel: &model}, "test"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	if gh.Revoked(own) {
+		t.Error("token revoked without a fleet change")
+	}
+
+	move("SN2", "edge")
+	if !gh.Revoked(own) {
+		t.Error("the token of a device that changed fleet was not revoked")
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+var (
+	// ErrInvalidEnrollmentToken is returned for unknown, used or expired
+	// enrollment tokens; callers can't tell which
+	ErrInvalidEnrollmentToken = errors.New("invalid enrollment token")
+	// ErrSerialNotAllowed is returned when a serial doesn't match the token's pattern
+	ErrSerialNotAllowed = errors.New("serial number not allowed by enrollment token")
+	// ErrInvalidSerialPattern is returned when minting a token with a malformed pattern
+	ErrInvalidSerialPattern = errors.New("invalid serial pattern")
+)
+
+// hmacSecretBytes is the size of generated device HMAC secrets
+const hmacSecretBytes = 32
+
+// CreateEnrollmentToken mints a single-use enrollment token. The returned
+// token secret is not stored and can't be shown again.
+func (s *DeviceService) CreateEnrollmentToken(req *models.EnrollmentTokenRequest) (*models.EnrollmentTokenResponse, error) {
+	if req.SerialPattern != "" {
+		if _, err := path.Match(req.SerialPattern, ""); err != nil {
+			return nil, ErrInvalidSerialPattern
+		}
+	}
+
+	ttl := s.config.EnrollmentTokenTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &models.EnrollmentToken{
+		ID:            id,
+		Fleet:         req.Fleet,
+		SerialPattern: req.SerialPattern,
+		ExpiresAt:     time.Now().Add(ttl).UTC(),
+	}
+	if err := s.store.CreateEnrollmentToken(token, enrollmentTokenHash(secret)); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Enrollment token %s created (fleet: %q, serial pattern: %q, expires: %v)", token.ID, token.Fleet, token.SerialPattern, token.ExpiresAt)
+	return &models.EnrollmentTokenResponse{EnrollmentToken: token, Token: secret}, nil
+}
+
+// ListEnrollmentTokens lists enrollment tokens, newest first
+func (s *DeviceService) ListEnrollmentTokens() ([]*models.EnrollmentToken, error) {
+	return s.store.ListEnrollmentTokens()
+}
+
+// DeleteEnrollmentToken revokes an enrollment token
+func (s *DeviceService) DeleteEnrollmentToken(id string) error {
+	return s.store.DeleteEnrollmentToken(id)
+}
+
+// EnrollDevice registers a new device in exchange for an enrollment token. A
+// device that sends no public key gets a generated HMAC secret to sign with.
+func (s *DeviceService) EnrollDevice(req *models.DeviceEnrollmentRequest) (*models.DeviceEnrollmentResponse, error) {
+	if req.Token == "" {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	if !validSerialNumber(req.SerialNumber) {
+		return nil, ErrInvalidSerialNumber
+	}
+
+	response := &models.DeviceEnrollmentResponse{}
+	publicKey := req.PublicKey
+	if publicKey == "" {
+		secret := make([]byte, hmacSecretBytes)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		publicKey = devicesig.AlgorithmHMAC + ":" + base64.StdEncoding.EncodeToString(secret)
+		response.SigningKey = publicKey
+	} else if err := validatePublicKey(publicKey); err != nil {
+		return nil, err
+	}
+
+	device := &models.Device{
+		SerialNumber:  req.SerialNumber,
+		Status:        models.DeviceStatusActive,
+		HardwareModel: req.HardwareModel,
+		PublicKey:     publicKey,
+	}
+
+	// The enrollment token the device presented is the actor
+	event := &models.DeviceStatusEvent{
+		SerialNumber: req.SerialNumber,
+		Action:       models.DeviceEventEnrolled,
+	}
+	err := s.store.EnrollDevice(enrollmentTokenHash(req.Token), device, event, func(token *models.EnrollmentToken) error {
+		if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+			return ErrInvalidEnrollmentToken
+		}
+		if token.SerialPattern != "" {
+			if matched, _ := path.Match(token.SerialPattern, req.SerialNumber); !matched {
+				return ErrSerialNotAllowed
+			}
+		}
+		device.Fleet = token.Fleet
+		event.Actor = "enrollment-token:" + token.ID
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrInvalidEnrollmentToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Device enrolled: %s (fleet: %q)", device.SerialNumber, device.Fleet)
+	response.Device = device
+	return response, nil
+}
+
+// validatePublicKey checks that a device key can verify signatures
+func validatePublicKey(publicKey string) error {
+	if _, err := devicesig.ParseVerifyKey(publicKey); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPublicKey, err)
+	}
+	return nil
+}
+
+// enrollmentTokenHash is how enrollment tokens are stored
+func enrollmentTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+var (
+	// ErrInvalidFleetName is returned when creating a fleet with a malformed name
+	ErrInvalidFleetName = errors.New("fleet name must be 1-64 characters without whitespace or slashes")
+	// ErrInvalidFleetPolicy is returned for policies that can't be enforced
+	ErrInvalidFleetPolicy = errors.New("invalid fleet policy")
+	// ErrFleetInUse is returned when deleting a fleet that still has devices
+	ErrFleetInUse = errors.New("fleet still has devices")
+)
+
+// CreateFleet adds a fleet and its policy
+func (s *DeviceService) CreateFleet(req *models.FleetRequest) (*models.Fleet, error) {
+	if req.Name == "" || len(req.Name) > 64 || strings.ContainsAny(req.Name, " \t\r\n/") {
+		return nil, ErrInvalidFleetName
+	}
+	if err := s.validateFleetPolicy(&req.Policy); err != nil {
+		return nil, err
+	}
+
+	fleet := &models.Fleet{
+		Name:        req.Name,
+		Description: req.Description,
+		Policy:      req.Policy,
+	}
+	if err := s.store.CreateFleet(fleet); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Fleet created: %s", fleet.Name)
+	// Devices already in the group, by DEVICE_GROUPS patterns, now fall
+	// under the fleet's policy rather than the service-wide configuration
+	if credentialPolicyChanged(&models.FleetPolicy{}, &fleet.Policy) {
+		s.runScopeChangeHooks(func(serial string) bool { return s.GetDeviceGroup(serial) == fleet.Name })
+	}
+	return fleet, nil
+}
+
+// UpdateFleet replaces a fleet's description and policy. Credentials the
+// fleet's devices hold are revoked when the policy scoping them changed.
+func (s *DeviceService) UpdateFleet(name string, req *models.FleetRequest) (*models.Fleet, error) {
+	if err := s.validateFleetPolicy(&req.Policy); err != nil {
+		return nil, err
+	}
+
+	previous, err := s.store.GetFleet(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := &models.Fleet{
+		Name:        name,
+		Description: req.Description,
+		Policy:      req.Policy,
+	}
+	if err := s.store.UpdateFleet(fleet); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Fleet policy updated: %s", fleet.Name)
+	if credentialPolicyChanged(&previous.Policy, &fleet.Policy) {
+		s.runScopeChangeHooks(func(serial string) bool { return s.GetDeviceGroup(serial) == name })
+	}
+	return fleet, nil
+}
+
+// GetFleet returns a fleet
+func (s *DeviceService) GetFleet(name string) (*models.Fleet, error) {
+	return s.store.GetFleet(name)
+}
+
+// ListFleets returns all fleets
+func (s *DeviceService) ListFleets() ([]*models.Fleet, error) {
+	return s.store.ListFleets()
+}
+
+// DeleteFleet removes a fleet that no device belongs to any more
+func (s *DeviceService) DeleteFleet(name string) error {
+	_, total, err := s.store.ListDevices(models.DeviceFilter{Fleet: name, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if total > 0 {
+		return fmt.Errorf("%w: %d device(s) in %s", ErrFleetInUse, total, name)
+	}
+
+	if err := s.store.DeleteFleet(name); err != nil {
+		return err
+	}
+
+	log.Printf("Fleet deleted: %s", name)
+	return nil
+}
+
+// FleetPolicy returns the policy of a device group, or nil if the group has
+// no fleet record and the service-wide configuration applies
+func (s *DeviceService) FleetPolicy(group string) *models.FleetPolicy {
+	if group == "" {
+		return nil
+	}
+
+	fleet, err := s.store.GetFleet(group)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("Failed to look up fleet %s: %v", group, err)
+		}
+		return nil
+	}
+	return &fleet.Policy
+}
+
+// validateFleetPolicy rejects policies naming unknown registries or negative limits
+func (s *DeviceService) validateFleetPolicy(policy *models.FleetPolicy) error {
+	for _, name := range policy.Registries {
+		if !s.hasRegistry(name) {
+			return fmt.Errorf("%w: unknown registry %s", ErrInvalidFleetPolicy, name)
+		}
+	}
+	if policy.TokenTTL < 0 {
+		return fmt.Errorf("%w: token_ttl must not be negative", ErrInvalidFleetPolicy)
+	}
+	if policy.RateLimitPerMinute < 0 {
+		return fmt.Errorf("%w: rate_limit_per_minute must not be negative", ErrInvalidFleetPolicy)
+	}
+	return nil
+}
+
+// hasRegistry reports whether a registry with the given name is configured
+func (s *DeviceService) hasRegistry(name string) bool {
+	for _, reg := range s.config.RegistryConfigs() {
+		if reg.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialPolicyChanged reports whether registry credentials issued under
+// policy previous may reach more or other than policy allows
+func credentialPolicyChanged(previous, policy *models.FleetPolicy) bool {
+	return previous.Organization != policy.Organization ||
+		!sameStrings(previous.Registries, policy.Registries) ||
+		!sameStrings(previous.Repositories, policy.Repositories)
+}
+
+// sameStrings reports whether a and b hold the same strings, in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, item := range a {
+		if !containsString(b, item) {
+			return false
+		}
+	}
+	return true
+}
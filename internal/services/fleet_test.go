@@ -0,0 +1,67 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestUpdateFleetRevokesTokens(t *testing.T) {
+	gh := newFakeGitHub(t)
+	deviceService, tokenService := newTestServices(t, gh.env(t))
+	if _, err := deviceService.CreateFleet(&models.FleetRequest{Name: "pilot", Policy: models.FleetPolicy{Repositories: []string{"app"}}}); err != nil {
+		t.Fatalf("CreateFleet: %v", err)
+	}
+	for _, serial := range []string{"SN1", "SN2", "SN3"} {
+		registerDevice(t, deviceService, serial, nil)
+	}
+	fleet := "pilot"
+	if _, err := deviceService.UpdateDevice("SN1", &models.DeviceUpdateRequest{Fleet: &fleet}, "test"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	// As wired by the API routes
+	deviceService.OnScopeChange(func(affected func(string) bool) {
+		if _, _, err := tokenService.RevokeTokens(affected, deviceService.HoldsAccess); err != nil {
+			t.Errorf("RevokeTokens: %v", err)
+		}
+	})
+
+	getToken := func(serial string) string {
+		t.Helper()
+		group := deviceService.GetDeviceGroup(serial)
+		token, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{
+			DeviceSerial: serial,
+			Group:        group,
+			Policy:       deviceService.FleetPolicy(group),
+		})
+		if err != nil {
+			t.Fatalf("GetGitHubRegistryToken(%s): %v", serial, err)
+		}
+		return token.Token
+	}
+	update := func(policy models.FleetPolicy) {
+		t.Helper()
+		if _, err := deviceService.UpdateFleet("pilot", &models.FleetRequest{Name: "pilot", Policy: policy}); err != nil {
+			t.Fatalf("UpdateFleet: %v", err)
+		}
+	}
+
+	member, outsider := getToken("SN1"), getToken("SN3")
+
+	// Policy changes that don't scope registry credentials leave tokens alone
+	update(models.FleetPolicy{Repositories: []string{"app"}, TokenTTL: 600})
+	if gh.Revoked(member) {
+		t.Error("token revoked after a token TTL change")
+	}
+
+	update(models.FleetPolicy{Repositories: []string{"agent"}})
+	if !gh.Revoked(member) {
+		t.Error("the token of a fleet device was not revoked when its repositories changed")
+	}
+	if gh.Revoked(outsider) {
+		t.Error("the token of a device outside the fleet was revoked")
+	}
+	if token := getToken("SN1"); token == member {
+		t.Error("the revoked token was served again")
+	}
+}
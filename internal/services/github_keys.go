@@ -0,0 +1,169 @@
+package services
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+// keyFile is a private key file found at GitHubPrivateKeyPath
+type keyFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// listGitHubKeyFiles returns the key files at path, newest first. path may be
+// a single PEM file or a directory of *.pem files.
+func listGitHubKeyFiles(path string) ([]keyFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []keyFile{{path: path, modTime: info.ModTime(), size: info.Size()}}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []keyFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, keyFile{
+			path:    filepath.Join(path, entry.Name()),
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .pem files found in %s", path)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	return files, nil
+}
+
+// keyFilesStamp summarises key files so changes can be detected cheaply
+func keyFilesStamp(files []keyFile) string {
+	parts := make([]string, 0, len(files))
+	for _, file := range files {
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file.path, file.modTime.UnixNano(), file.size))
+	}
+	return strings.Join(parts, ",")
+}
+
+// loadGitHubKeys loads every key at path, newest first
+func loadGitHubKeys(path string) ([]crypto.Signer, string, error) {
+	files, err := listGitHubKeyFiles(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signers := make([]crypto.Signer, 0, len(files))
+	for _, file := range files {
+		key, err := github.LoadPrivateKey(file.path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to load %s: %w", file.path, err)
+		}
+		signers = append(signers, key)
+	}
+	return signers, keyFilesStamp(files), nil
+}
+
+// watchGitHubKeys reloads the App keys when the files at GitHubPrivateKeyPath
+// change or the process receives SIGHUP. With a single key file the previous
+// key is kept as a fallback, so requests keep working while the new key is
+// being registered with GitHub.
+func (s *TokenService) watchGitHubKeys(stamp string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	interval := s.config.GitHubKeyReloadInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ticker.C:
+		case <-hup:
+			log.Printf("SIGHUP received, reloading GitHub App keys")
+			force = true
+		}
+
+		files, err := listGitHubKeyFiles(s.config.GitHubPrivateKeyPath)
+		if err != nil {
+			log.Printf("Failed to check GitHub App keys: %v", err)
+			continue
+		}
+		if !force && keyFilesStamp(files) == stamp {
+			continue
+		}
+
+		signers, newStamp, err := loadGitHubKeys(s.config.GitHubPrivateKeyPath)
+		if err != nil {
+			// Keep the current keys; a half-written file will be picked up next tick
+			log.Printf("Failed to reload GitHub App keys: %v", err)
+			continue
+		}
+		stamp = newStamp
+
+		if len(signers) == 1 {
+			signers = appendFallbackKey(signers, s.githubApp.Signers())
+		}
+		if err := s.githubApp.SetSigners(signers...); err != nil {
+			log.Printf("Failed to apply GitHub App keys: %v", err)
+			continue
+		}
+
+		log.Printf("GitHub App keys reloaded (active: %s, loaded: %d)", github.KeyFingerprint(signers[0]), len(signers))
+	}
+}
+
+// appendFallbackKey keeps the previously active key behind a new single key.
+// When the key is unchanged, e.g. on a forced reload, the existing fallback is
+// kept instead.
+func appendFallbackKey(signers []crypto.Signer, previous []crypto.Signer) []crypto.Signer {
+	if len(previous) == 0 {
+		return signers
+	}
+	if github.KeyFingerprint(previous[0]) != github.KeyFingerprint(signers[0]) {
+		return append(signers, previous[0])
+	}
+	if len(previous) > 1 {
+		return append(signers, previous[1])
+	}
+	return signers
+}
+
+// GitHubKeyFingerprints returns the loaded GitHub App key fingerprints,
+// active key first
+func (s *TokenService) GitHubKeyFingerprints() []string {
+	if s.githubApp == nil {
+		return nil
+	}
+	return s.githubApp.KeyFingerprints()
+}
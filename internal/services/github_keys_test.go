@@ -0,0 +1,90 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+// writeKey writes a fresh RSA key to path with the given modification time
+func writeKey(t *testing.T, path string, modTime time.Time) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	return key
+}
+
+func TestLoadGitHubKeysNewestFirst(t *testing.T) {
+	dir := t.TempDir()
+	older := writeKey(t, filepath.Join(dir, "a.pem"), time.Now().Add(-time.Hour))
+	newer := writeKey(t, filepath.Join(dir, "b.pem"), time.Now())
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600)
+
+	signers, stamp, err := loadGitHubKeys(dir)
+	if err != nil {
+		t.Fatalf("loadGitHubKeys: %v", err)
+	}
+	if len(signers) != 2 || github.KeyFingerprint(signers[0]) != github.KeyFingerprint(newer) || github.KeyFingerprint(signers[1]) != github.KeyFingerprint(older) {
+		t.Errorf("loaded keys are not newest first")
+	}
+
+	// Replacing a key changes the stamp the watcher compares
+	writeKey(t, filepath.Join(dir, "a.pem"), time.Now().Add(time.Minute))
+	if _, newStamp, err := loadGitHubKeys(dir); err != nil || newStamp == stamp {
+		t.Errorf("stamp after a key change = %q, %v; want a new stamp", newStamp, err)
+	}
+}
+
+func TestAppendFallbackKey(t *testing.T) {
+	keys := make([]crypto.Signer, 3)
+	for i := range keys {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		keys[i] = key
+	}
+	a, b, c := keys[0], keys[1], keys[2]
+
+	tests := []struct {
+		name     string
+		loaded   crypto.Signer
+		previous []crypto.Signer
+		want     []crypto.Signer
+	}{
+		{"first load", a, nil, []crypto.Signer{a}},
+		{"rotated key keeps the previous one", b, []crypto.Signer{a}, []crypto.Signer{b, a}},
+		{"rotated again drops the oldest", c, []crypto.Signer{b, a}, []crypto.Signer{c, b}},
+		{"unchanged key keeps its fallback", b, []crypto.Signer{b, a}, []crypto.Signer{b, a}},
+	}
+	for _, tt := range tests {
+		got := appendFallbackKey([]crypto.Signer{tt.loaded}, tt.previous)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d keys, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if github.KeyFingerprint(got[i]) != github.KeyFingerprint(tt.want[i]) {
+				t.Errorf("%s: key %d differs", tt.name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+// issuedTokenRetention is how long records are kept after a token expires
+const issuedTokenRetention = time.Hour
+
+// issuedToken records a GitHub installation token handed out by this service
+type issuedToken struct {
+	token          string
+	InstallationID string
+	Permissions    map[string]string
+	Repositories   []string
+	IssuedAt       time.Time
+	ExpiresAt      time.Time
+	Devices        map[string]time.Time // device serial -> last delivery
+	Revoked        bool
+	RevokedAt      time.Time
+}
+
+// issuedTokenStore keeps the service's own record of issued tokens, keyed by
+// SHA-256 of the token. The tokens themselves are only held in memory, for as
+// long as they may need to be revoked.
+type issuedTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*issuedToken
+}
+
+// newIssuedTokenStore creates a store and starts its cleanup goroutine
+func newIssuedTokenStore(cleanup time.Duration) *issuedTokenStore {
+	s := &issuedTokenStore{
+		tokens: make(map[string]*issuedToken),
+	}
+
+	go s.cleanupExpired(cleanup)
+
+	return s
+}
+
+// hashToken returns the lookup key for a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record notes that token was delivered to deviceSerial
+func (s *issuedTokenStore) Record(token *github.GitHubTokenResponse, installationID, deviceSerial string) {
+	key := hashToken(token.Token)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.tokens[key]
+	if !ok {
+		record = &issuedToken{
+			token:          token.Token,
+			InstallationID: installationID,
+			Permissions:    token.Permissions,
+			Repositories:   token.Repositories,
+			IssuedAt:       now,
+			ExpiresAt:      token.ExpiresAt,
+			Devices:        make(map[string]time.Time),
+		}
+		s.tokens[key] = record
+	}
+	record.Devices[deviceSerial] = now
+}
+
+// Lookup returns a copy of the record for token
+func (s *issuedTokenStore) Lookup(token string) (issuedToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, ok := s.tokens[hashToken(token)]
+	if !ok {
+		return issuedToken{}, false
+	}
+	return record.copy(), true
+}
+
+// copy returns a copy of the record that is safe to read without s.mu
+func (r *issuedToken) copy() issuedToken {
+	copied := *r
+	copied.Devices = make(map[string]time.Time, len(r.Devices))
+	for serial, at := range r.Devices {
+		copied.Devices[serial] = at
+	}
+	return copied
+}
+
+// HeldBy returns the unexpired, unrevoked tokens delivered to any device
+// holder reports true for
+func (s *issuedTokenStore) HeldBy(holder func(serialNumber string) bool) []issuedToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	var records []issuedToken
+	for _, record := range s.tokens {
+		if record.Revoked || !now.Before(record.ExpiresAt) {
+			continue
+		}
+		for serial := range record.Devices {
+			if holder(serial) {
+				records = append(records, record.copy())
+				break
+			}
+		}
+	}
+	return records
+}
+
+// MarkRevoked flags token as revoked
+func (s *issuedTokenStore) MarkRevoked(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.tokens[hashToken(token)]; ok {
+		record.Revoked = true
+		record.RevokedAt = time.Now()
+	}
+}
+
+// cleanupExpired forgets tokens that expired more than issuedTokenRetention ago
+func (s *issuedTokenStore) cleanupExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		cutoff := time.Now().Add(-issuedTokenRetention)
+
+		for key, record := range s.tokens {
+			if record.ExpiresAt.Before(cutoff) {
+				delete(s.tokens, key)
+			}
+		}
+
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestValidateGitHubRegistryToken(t *testing.T) {
+	gh := newFakeGitHub(t)
+	_, tokenService := newTestServices(t, gh.env(t))
+
+	issued, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN1"})
+	if err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+
+	resp, err := tokenService.ValidateGitHubRegistryToken("SN1", &models.GitHubTokenValidationRequest{Token: issued.Token, CheckGitHub: true})
+	if err != nil {
+		t.Fatalf("ValidateGitHubRegistryToken: %v", err)
+	}
+	if !resp.Valid || !resp.IssuedToDevice || !resp.GitHubChecked || resp.RemainingSeconds <= 0 || resp.Permissions["packages"] != "read" {
+		t.Errorf("own token = %+v, want valid, checked at GitHub, with its lifetime and permissions", resp)
+	}
+
+	// Unknown tokens and tokens issued to other devices look the same
+	for _, tt := range []struct{ serial, token string }{{"SN1", "ghs_unknown"}, {"SN2", issued.Token}} {
+		resp, err := tokenService.ValidateGitHubRegistryToken(tt.serial, &models.GitHubTokenValidationRequest{Token: tt.token})
+		if err != nil {
+			t.Fatalf("ValidateGitHubRegistryToken: %v", err)
+		}
+		if resp.Valid || resp.IssuedToDevice || resp.ExpiresAt != nil || resp.Message != "Token was not issued to this device" {
+			t.Errorf("token %s for %s = %+v, want invalid without details", tt.token, tt.serial, resp)
+		}
+	}
+
+	// A token GitHub no longer accepts is reported as rejected
+	gh.mu.Lock()
+	gh.revoked[issued.Token] = true
+	gh.mu.Unlock()
+	resp, err = tokenService.ValidateGitHubRegistryToken("SN1", &models.GitHubTokenValidationRequest{Token: issued.Token, CheckGitHub: true})
+	if err != nil {
+		t.Fatalf("ValidateGitHubRegistryToken: %v", err)
+	}
+	if resp.Valid || resp.Message != "Token was rejected by GitHub" {
+		t.Errorf("token revoked at GitHub = %+v, want rejected", resp)
+	}
+
+	// Revocation by the service is known without asking GitHub
+	tokenService.issuedTokens.MarkRevoked(issued.Token)
+	resp, err = tokenService.ValidateGitHubRegistryToken("SN1", &models.GitHubTokenValidationRequest{Token: issued.Token})
+	if err != nil {
+		t.Fatalf("ValidateGitHubRegistryToken: %v", err)
+	}
+	if resp.Valid || !resp.Revoked {
+		t.Errorf("revoked token = %+v, want invalid and revoked", resp)
+	}
+}
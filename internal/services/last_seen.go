@@ -0,0 +1,154 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+// maxPendingSightings bounds the sightings held between flushes; a full batch
+// is flushed early
+const maxPendingSightings = 10000
+
+// sightingRecorder collects device sightings off the request path and writes
+// them to the store in batches. Only the latest sighting of each device is
+// kept between flushes.
+type sightingRecorder struct {
+	store store.Store
+
+	mu      sync.Mutex
+	pending map[string]models.DeviceSighting
+	flushCh chan struct{}
+
+	// flushMu is held while a batch is written, so take never misses a
+	// sighting that is neither pending nor stored
+	flushMu sync.Mutex
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newSightingRecorder(deviceStore store.Store, interval time.Duration) *sightingRecorder {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	r := &sightingRecorder{
+		store:   deviceStore,
+		pending: make(map[string]models.DeviceSighting),
+		flushCh: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+// Record queues a sighting without blocking
+func (r *sightingRecorder) Record(sighting models.DeviceSighting) {
+	r.mu.Lock()
+	r.pending[sighting.SerialNumber] = sighting
+	full := len(r.pending) >= maxPendingSightings
+	r.mu.Unlock()
+
+	if full {
+		select {
+		case r.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes and returns a device's pending sighting, if any. Without one,
+// any sighting of the device already reached the store.
+func (r *sightingRecorder) take(serialNumber string) (models.DeviceSighting, bool) {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sighting, ok := r.pending[serialNumber]
+	delete(r.pending, serialNumber)
+	return sighting, ok
+}
+
+// Close stops the background flushes and writes what is still pending
+func (r *sightingRecorder) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.stopped
+}
+
+// run flushes pending sightings every interval, or sooner when the batch
+// fills, and once more when the recorder is closed
+func (r *sightingRecorder) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(r.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.flushCh:
+		case <-r.stop:
+			r.flush()
+			return
+		}
+		r.flush()
+	}
+}
+
+// flush writes the pending sightings. A failed batch is dropped; the devices'
+// next requests will be recorded again.
+func (r *sightingRecorder) flush() {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	if len(r.pending) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	batch := make([]models.DeviceSighting, 0, len(r.pending))
+	for _, sighting := range r.pending {
+		batch = append(batch, sighting)
+	}
+	r.pending = make(map[string]models.DeviceSighting)
+	r.mu.Unlock()
+
+	if err := r.store.RecordDeviceSightings(batch); err != nil {
+		log.Printf("Failed to record last-seen for %d device(s): %v", len(batch), err)
+	}
+}
+
+// RecordSeen notes an authenticated request from a device. The device record
+// is updated asynchronously, within DEVICE_LAST_SEEN_FLUSH_INTERVAL.
+func (s *DeviceService) RecordSeen(serialNumber, ip, clientVersion string) {
+	s.sightings.Record(models.DeviceSighting{
+		SerialNumber:  serialNumber,
+		SeenAt:        time.Now(),
+		IP:            ip,
+		ClientVersion: clientVersion,
+	})
+}
+
+// RecordHeartbeat stores the status a device reports and returns the device.
+// Its last-seen time is written at once rather than with the next batch, so
+// the returned device reflects this heartbeat.
+func (s *DeviceService) RecordHeartbeat(serialNumber string, heartbeat *models.DeviceHeartbeat) (*models.Device, error) {
+	heartbeat.ReceivedAt = time.Now().UTC()
+	if err := s.store.SetDeviceHeartbeat(serialNumber, heartbeat); err != nil {
+		return nil, err
+	}
+
+	// Write the sighting authentication queued for this request, with its
+	// address and client version
+	if sighting, ok := s.sightings.take(serialNumber); ok {
+		if err := s.store.RecordDeviceSightings([]models.DeviceSighting{sighting}); err != nil {
+			return nil, err
+		}
+	}
+	return s.store.GetDevice(serialNumber)
+}
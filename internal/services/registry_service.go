@@ -0,0 +1,325 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// ErrUnknownRegistry is returned for registry names that are not configured
+var ErrUnknownRegistry = errors.New("unknown registry")
+
+// ErrRegistryNotAllowed is returned when a device's fleet policy excludes a registry
+var ErrRegistryNotAllowed = errors.New("registry not allowed for device")
+
+// RegistryBackend issues pull credentials for one container registry
+type RegistryBackend interface {
+	// Credentials returns credentials the device can pull with
+	Credentials(req *models.GitHubRegistryTokenRequest) (*models.GitHubRegistryTokenResponse, error)
+}
+
+// RegistryService routes credential requests to the backend of each
+// configured registry
+type RegistryService struct {
+	registries      []config.RegistryConfig
+	backends        map[string]RegistryBackend
+	defaultRegistry string
+}
+
+// NewRegistryService creates a backend for every configured registry
+func NewRegistryService(cfg *config.Config, tokenService *TokenService) (*RegistryService, error) {
+	if err := cfg.ValidateRegistries(); err != nil {
+		return nil, err
+	}
+
+	s := &RegistryService{
+		registries:      cfg.RegistryConfigs(),
+		backends:        make(map[string]RegistryBackend),
+		defaultRegistry: cfg.DefaultRegistry,
+	}
+	if s.defaultRegistry == "" {
+		s.defaultRegistry = s.registries[0].Name
+	}
+
+	for _, reg := range s.registries {
+		switch reg.Type {
+		case config.RegistryTypeGitHubApp:
+			s.backends[reg.Name] = &gitHubAppBackend{registry: reg, tokenService: tokenService}
+		case config.RegistryTypeStatic:
+			s.backends[reg.Name] = &staticBackend{registry: reg}
+		case config.RegistryTypeTokenExchange:
+			s.backends[reg.Name] = newTokenExchangeBackend(reg, cfg.GitHubHTTPTimeout, cfg.GitHubGroupRepositories)
+		}
+	}
+	return s, nil
+}
+
+// Registries lists the configured registries without their secrets
+func (s *RegistryService) Registries() []models.RegistryInfo {
+	result := make([]models.RegistryInfo, 0, len(s.registries))
+	for _, reg := range s.registries {
+		result = append(result, models.RegistryInfo{
+			Name:    reg.Name,
+			Type:    reg.Type,
+			URL:     reg.URL,
+			Default: reg.Name == s.defaultRegistry,
+		})
+	}
+	return result
+}
+
+// AllowedRegistries lists the registries a fleet policy permits
+func (s *RegistryService) AllowedRegistries(policy *models.FleetPolicy) []models.RegistryInfo {
+	result := make([]models.RegistryInfo, 0, len(s.registries))
+	for _, reg := range s.Registries() {
+		if registryAllowed(policy, reg.Name) {
+			result = append(result, reg)
+		}
+	}
+	return result
+}
+
+// registryAllowed reports whether policy permits the named registry. Without
+// a policy or a registry list every registry is permitted.
+func registryAllowed(policy *models.FleetPolicy, name string) bool {
+	return policy == nil || len(policy.Registries) == 0 || containsString(policy.Registries, name)
+}
+
+// Credentials returns pull credentials for the named registry. An empty name
+// selects the default registry.
+func (s *RegistryService) Credentials(name string, req *models.GitHubRegistryTokenRequest) (*models.GitHubRegistryTokenResponse, error) {
+	if name == "" {
+		name = s.defaultRegistry
+	}
+	backend, ok := s.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRegistry, name)
+	}
+	if !registryAllowed(req.Policy, name) {
+		return nil, fmt.Errorf("%w: %s", ErrRegistryNotAllowed, name)
+	}
+	return backend.Credentials(req)
+}
+
+// gitHubAppBackend issues GitHub App installation tokens, e.g. for GHCR
+type gitHubAppBackend struct {
+	registry     config.RegistryConfig
+	tokenService *TokenService
+}
+
+func (b *gitHubAppBackend) Credentials(req *models.GitHubRegistryTokenRequest) (*models.GitHubRegistryTokenResponse, error) {
+	// In proxy mode the device only ever receives proxy credentials
+	if b.tokenService.config.RegistryProxyEnabled {
+		return b.tokenService.GetRegistryProxyCredentials(req.DeviceSerial)
+	}
+	token, err := b.tokenService.GetGitHubRegistryToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token service fills in the legacy registry; copy before rewriting
+	// so cached responses are left alone
+	credentials := *token
+	credentials.Registry = b.registry.URL
+	if b.registry.Username != "" {
+		credentials.Username = b.registry.Username
+	}
+	return &credentials, nil
+}
+
+// staticBackend hands out fixed basic auth credentials, e.g. a Harbor robot
+// account or a Distribution htpasswd user
+type staticBackend struct {
+	registry config.RegistryConfig
+}
+
+func (b *staticBackend) Credentials(req *models.GitHubRegistryTokenRequest) (*models.GitHubRegistryTokenResponse, error) {
+	// Fixed credentials can't be narrowed to recovery repositories
+	if req.Quarantined {
+		return nil, ErrDeviceQuarantined
+	}
+
+	// The credentials don't expire; the expiry tells devices when to re-fetch
+	// so a rotated password reaches them
+	return &models.GitHubRegistryTokenResponse{
+		Token:     b.registry.Password,
+		ExpiresAt: time.Now().Add(b.registry.CredentialTTL),
+		Registry:  b.registry.URL,
+		Username:  b.registry.Username,
+	}, nil
+}
+
+// tokenExchangeBackend trades the service's account for short-lived,
+// pull-only bearer tokens at the registry's token endpoint, as Docker Hub does
+type tokenExchangeBackend struct {
+	registry          config.RegistryConfig
+	groupRepositories map[string][]string
+	httpClient        *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*models.GitHubRegistryTokenResponse
+}
+
+// tokenExchangeResponse is the Docker token endpoint's response
+type tokenExchangeResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// tokenExchangeRefreshBefore is how long before expiry a cached token is replaced
+const tokenExchangeRefreshBefore = 30 * time.Second
+
+func newTokenExchangeBackend(reg config.RegistryConfig, timeout time.Duration, groupRepositories map[string][]string) *tokenExchangeBackend {
+	return &tokenExchangeBackend{
+		registry:          reg,
+		groupRepositories: groupRepositories,
+		httpClient:        &http.Client{Timeout: timeout},
+		tokens:            make(map[string]*models.GitHubRegistryTokenResponse),
+	}
+}
+
+func (b *tokenExchangeBackend) Credentials(req *models.GitHubRegistryTokenRequest) (*models.GitHubRegistryTokenResponse, error) {
+	// Group and fleet policy repositories narrow the configured list, the
+	// policy overriding the group, as they scope GitHub tokens
+	repositories := b.registry.Repositories
+	var allowed []string
+	if repos, ok := b.groupRepositories[req.Group]; ok && req.Group != "" {
+		allowed = repos
+	}
+	if req.Policy != nil && len(req.Policy.Repositories) > 0 {
+		allowed = req.Policy.Repositories
+	}
+	if len(allowed) > 0 {
+		repositories = nil
+		for _, repo := range b.registry.Repositories {
+			if containsString(allowed, repo) {
+				repositories = append(repositories, repo)
+			}
+		}
+		if len(repositories) == 0 && !req.Quarantined {
+			return nil, fmt.Errorf("%w: no repositories of registry %s", ErrRepositoryNotAllowed, b.registry.Name)
+		}
+	}
+	if req.Quarantined {
+		if len(b.registry.QuarantineRepositories) == 0 {
+			return nil, ErrDeviceQuarantined
+		}
+		repositories = b.registry.QuarantineRepositories
+	}
+	if len(repositories) == 0 {
+		return nil, fmt.Errorf("registry %s has no repositories configured", b.registry.Name)
+	}
+	if req.Repository != "" {
+		// Only configured repositories are exchanged, so the cache stays bounded
+		if !containsString(repositories, req.Repository) {
+			return nil, ErrRepositoryNotAllowed
+		}
+		repositories = []string{req.Repository}
+	}
+
+	scopes := make([]string, 0, len(repositories))
+	for _, repo := range repositories {
+		scopes = append(scopes, "repository:"+repo+":pull")
+	}
+	key := strings.Join(scopes, " ")
+
+	b.mu.Lock()
+	cached, ok := b.tokens[key]
+	b.mu.Unlock()
+	if ok && time.Until(cached.ExpiresAt) > tokenExchangeRefreshBefore {
+		return cached, nil
+	}
+
+	token, err := b.exchange(scopes)
+	if err != nil {
+		return nil, err
+	}
+	token.Repositories = repositories
+
+	b.mu.Lock()
+	for k, cached := range b.tokens {
+		if time.Now().After(cached.ExpiresAt) {
+			delete(b.tokens, k)
+		}
+	}
+	b.tokens[key] = token
+	b.mu.Unlock()
+	return token, nil
+}
+
+// exchange requests a token for scopes from the registry's token endpoint
+func (b *tokenExchangeBackend) exchange(scopes []string) (*models.GitHubRegistryTokenResponse, error) {
+	query := url.Values{}
+	if b.registry.Service != "" {
+		query.Set("service", b.registry.Service)
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+
+	authURL := b.registry.AuthURL
+	if strings.Contains(authURL, "?") {
+		authURL += "&" + query.Encode()
+	} else {
+		authURL += "?" + query.Encode()
+	}
+
+	httpReq, err := http.NewRequest("GET", authURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.registry.Username != "" {
+		httpReq.SetBasicAuth(b.registry.Username, b.registry.Password)
+	}
+
+	resp, err := b.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("registry %s token exchange failed: %w", b.registry.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry %s token exchange failed: %s", b.registry.Name, resp.Status)
+	}
+
+	var result tokenExchangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("registry %s returned an invalid token response: %w", b.registry.Name, err)
+	}
+
+	token := result.Token
+	if token == "" {
+		token = result.AccessToken
+	}
+	if token == "" {
+		return nil, fmt.Errorf("registry %s returned no token", b.registry.Name)
+	}
+
+	// The spec's default lifetime is 60 seconds
+	expiresIn := time.Duration(result.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 60 * time.Second
+	}
+	issuedAt := result.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	return &models.GitHubRegistryTokenResponse{
+		Token:     token,
+		TokenType: models.RegistryTokenTypeBearer,
+		ExpiresAt: issuedAt.Add(expiresIn),
+		Registry:  b.registry.URL,
+		Username:  b.registry.Username,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestTokenExchangeRepositories(t *testing.T) {
+	var scopes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes = r.URL.Query()["scope"]
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": "registry-token", "expires_in": 300})
+	}))
+	defer server.Close()
+
+	backend := newTokenExchangeBackend(config.RegistryConfig{
+		Name:                   "hub",
+		AuthURL:                server.URL,
+		Repositories:           []string{"example/app", "example/agent"},
+		QuarantineRepositories: []string{"example/recovery"},
+	}, time.Second, map[string][]string{"pilot": {"example/agent", "other/repo"}})
+
+	tests := []struct {
+		name   string
+		req    models.GitHubRegistryTokenRequest
+		scopes []string
+		err    error
+	}{
+		{
+			name:   "no group or policy",
+			req:    models.GitHubRegistryTokenRequest{},
+			scopes: []string{"repository:example/app:pull", "repository:example/agent:pull"},
+		},
+		{
+			name:   "group repositories narrow",
+			req:    models.GitHubRegistryTokenRequest{Group: "pilot"},
+			scopes: []string{"repository:example/agent:pull"},
+		},
+		{
+			name:   "policy overrides group",
+			req:    models.GitHubRegistryTokenRequest{Group: "pilot", Policy: &models.FleetPolicy{Repositories: []string{"example/app"}}},
+			scopes: []string{"repository:example/app:pull"},
+		},
+		{
+			name: "policy excludes requested repository",
+			req:  models.GitHubRegistryTokenRequest{Repository: "example/agent", Policy: &models.FleetPolicy{Repositories: []string{"example/app"}}},
+			err:  ErrRepositoryNotAllowed,
+		},
+		{
+			name: "policy lists none of the registry's repositories",
+			req:  models.GitHubRegistryTokenRequest{Policy: &models.FleetPolicy{Repositories: []string{"other/repo"}}},
+			err:  ErrRepositoryNotAllowed,
+		},
+		{
+			name:   "quarantine overrides policy",
+			req:    models.GitHubRegistryTokenRequest{Quarantined: true, Policy: &models.FleetPolicy{Repositories: []string{"other/repo"}}},
+			scopes: []string{"repository:example/recovery:pull"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scopes = nil
+			_, err := backend.Credentials(&tt.req)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Credentials() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Credentials() error = %v", err)
+			}
+			if !reflect.DeepEqual(scopes, tt.scopes) {
+				t.Errorf("exchanged scopes = %v, want %v", scopes, tt.scopes)
+			}
+		})
+	}
+}
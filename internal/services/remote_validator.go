@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// maxValidationResponseBytes bounds the inventory service responses read
+const maxValidationResponseBytes = 64 << 10
+
+// remoteValidator asks an external inventory service whether a device may
+// authenticate, caching its answers
+type remoteValidator struct {
+	url         string
+	token       string
+	httpClient  *http.Client
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	failOpen    bool
+
+	mu       sync.Mutex
+	results  map[string]remoteValidation
+	inflight map[string]*inflightValidation
+}
+
+// remoteValidation is a cached answer from the inventory service
+type remoteValidation struct {
+	response  *models.DeviceValidationResponse
+	expiresAt time.Time
+}
+
+// inflightValidation is a lookup that concurrent misses for the same device wait on
+type inflightValidation struct {
+	done     chan struct{}
+	response *models.DeviceValidationResponse
+	err      error
+}
+
+// newRemoteValidator creates a validator for DEVICE_VALIDATION_URL
+func newRemoteValidator(cfg *config.Config) *remoteValidator {
+	v := &remoteValidator{
+		url:         cfg.DeviceValidationURL,
+		token:       cfg.DeviceValidationToken,
+		httpClient:  &http.Client{Timeout: cfg.DeviceAuthTimeout},
+		positiveTTL: cfg.DeviceValidationCacheTTL,
+		negativeTTL: cfg.DeviceValidationNegativeCacheTTL,
+		failOpen:    cfg.DeviceValidationFailOpen,
+		results:     make(map[string]remoteValidation),
+		inflight:    make(map[string]*inflightValidation),
+	}
+
+	cleanupInterval := v.positiveTTL
+	if cleanupInterval <= 0 {
+		cleanupInterval = time.Minute
+	}
+	go v.cleanupExpired(cleanupInterval)
+	return v
+}
+
+// Validate returns the inventory service's verdict on a device. If the service
+// can't be reached an enrolled device is allowed under the fail-open policy;
+// otherwise the error is returned and the request is refused. Devices only the
+// inventory knows are never let in without its answer.
+func (v *remoteValidator) Validate(serialNumber string, enrolled bool) (*models.DeviceValidationResponse, error) {
+	v.mu.Lock()
+	if cached, ok := v.results[serialNumber]; ok && time.Now().Before(cached.expiresAt) {
+		v.mu.Unlock()
+		return cached.response, nil
+	}
+	call, ok := v.inflight[serialNumber]
+	if !ok {
+		call = &inflightValidation{done: make(chan struct{})}
+		v.inflight[serialNumber] = call
+		go v.runFetch(serialNumber, call)
+	}
+	v.mu.Unlock()
+
+	<-call.done
+	if call.err != nil {
+		if v.failOpen && enrolled {
+			log.Printf("Remote device validation failed for %s, allowing under fail-open policy: %v", serialNumber, call.err)
+			return &models.DeviceValidationResponse{
+				Valid:    true,
+				DeviceID: serialNumber,
+				Message:  "Device validation service unavailable",
+			}, nil
+		}
+		return nil, call.err
+	}
+	return call.response, nil
+}
+
+// runFetch asks the inventory service about a device and caches its answer
+func (v *remoteValidator) runFetch(serialNumber string, call *inflightValidation) {
+	resp, err := v.fetch(serialNumber)
+
+	v.mu.Lock()
+	if err == nil {
+		ttl := v.positiveTTL
+		if !resp.Valid {
+			ttl = v.negativeTTL
+		}
+		if ttl > 0 {
+			v.results[serialNumber] = remoteValidation{response: resp, expiresAt: time.Now().Add(ttl)}
+		}
+	}
+	delete(v.inflight, serialNumber)
+	v.mu.Unlock()
+
+	call.response = resp
+	call.err = err
+	close(call.done)
+}
+
+// Cached returns the unexpired verdict cached for a device, without asking
+// the inventory service
+func (v *remoteValidator) Cached(serialNumber string) (*models.DeviceValidationResponse, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cached, ok := v.results[serialNumber]
+	if !ok || !time.Now().Before(cached.expiresAt) {
+		return nil, false
+	}
+	return cached.response, true
+}
+
+// Invalidate forgets the cached verdict for a device
+func (v *remoteValidator) Invalidate(serialNumber string) {
+	v.mu.Lock()
+	delete(v.results, serialNumber)
+	v.mu.Unlock()
+}
+
+// fetch POSTs a DeviceValidationRequest to the inventory service
+func (v *remoteValidator) fetch(serialNumber string) (*models.DeviceValidationResponse, error) {
+	body, err := json.Marshal(models.DeviceValidationRequest{SerialNumber: serialNumber})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", v.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if v.token != "" {
+		req.Header.Set("Authorization", "Bearer "+v.token)
+	}
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("device validation request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device validation service returned %s", resp.Status)
+	}
+
+	var result models.DeviceValidationResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxValidationResponseBytes)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid device validation response: %w", err)
+	}
+	if result.DeviceID == "" {
+		result.DeviceID = serialNumber
+	}
+	return &result, nil
+}
+
+// cleanupExpired periodically removes expired verdicts
+func (v *remoteValidator) cleanupExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		v.mu.Lock()
+		now := time.Now()
+
+		for serial, result := range v.results {
+			if !now.Before(result.expiresAt) {
+				delete(v.results, serial)
+			}
+		}
+
+		v.mu.Unlock()
+	}
+}
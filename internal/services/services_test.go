@@ -0,0 +1,173 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/devicesig"
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/ARED-Group/dynamic-token-manager/internal/store"
+)
+
+// newTestServices returns device and token services backed by an in-memory
+// store, configured from the defaults plus env
+func newTestServices(t *testing.T, env map[string]string) (*DeviceService, *TokenService) {
+	t.Helper()
+
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("GITHUB_APP_ID", "")
+	t.Setenv("DEVICE_VALIDATION_URL", "")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg := config.Load()
+
+	tokenService, err := NewTokenService(cfg)
+	if err != nil {
+		t.Fatalf("NewTokenService: %v", err)
+	}
+	deviceService := NewDeviceService(cfg, store.NewMemoryStore())
+	t.Cleanup(func() { deviceService.Close() })
+	return deviceService, tokenService
+}
+
+// newSigningKey returns a fresh Ed25519 device key
+func newSigningKey(t *testing.T) *devicesig.SigningKey {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	key, err := devicesig.ParseSigningKey("ed25519:" + base64.StdEncoding.EncodeToString(private.Seed()))
+	if err != nil {
+		t.Fatalf("ParseSigningKey: %v", err)
+	}
+	return key
+}
+
+// registerDevice enrolls a device, with key's public half if key is set
+func registerDevice(t *testing.T, s *DeviceService, serialNumber string, key *devicesig.SigningKey) {
+	t.Helper()
+
+	req := &models.DeviceRegistrationRequest{SerialNumber: serialNumber}
+	if key != nil {
+		req.PublicKey = key.VerifyKeyString()
+	}
+	if _, err := s.RegisterDevice(req, "test"); err != nil {
+		t.Fatalf("RegisterDevice(%s): %v", serialNumber, err)
+	}
+}
+
+// fakeGitHub is an httptest stand-in for the GitHub API that mints
+// numbered installation tokens and remembers the ones revoked
+type fakeGitHub struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	minted  int
+	scopes  []github.TokenScope
+	revoked map[string]bool
+}
+
+// newFakeGitHub starts a fake GitHub API for installation 42
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+
+	f := &fakeGitHub{revoked: make(map[string]bool)}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "token ")
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/app/installations/42/access_tokens":
+		var scope github.TokenScope
+		json.NewDecoder(r.Body).Decode(&scope)
+		f.scopes = append(f.scopes, scope)
+		f.minted++
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":       fmt.Sprintf("ghs_%d", f.minted),
+			"expires_at":  time.Now().Add(time.Hour),
+			"permissions": scope.Permissions,
+		})
+	case r.Method == "DELETE" && r.URL.Path == "/installation/token":
+		f.revoked[token] = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && r.URL.Path == "/installation/repositories":
+		if f.revoked[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"total_count": 0, "repositories": []}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Minted returns how many tokens were minted
+func (f *fakeGitHub) Minted() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.minted
+}
+
+// Revoked reports whether token was revoked
+func (f *fakeGitHub) Revoked(token string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revoked[token]
+}
+
+// LastScope returns the scope of the most recently minted token
+func (f *fakeGitHub) LastScope() github.TokenScope {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scopes[len(f.scopes)-1]
+}
+
+// env configures a GitHub App talking to f, with a freshly generated
+// key written under a temporary directory
+func (f *fakeGitHub) env(t *testing.T) map[string]string {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "app.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(path, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	return map[string]string{
+		"GITHUB_APP_ID":           "123",
+		"GITHUB_INSTALLATION_ID":  "42",
+		"GITHUB_PRIVATE_KEY_PATH": path,
+		"GITHUB_API_URL":          f.server.URL,
+		"GITHUB_MAX_RETRIES":      "0",
+	}
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+// tokenFetchFunc fetches a fresh installation token from GitHub
+type tokenFetchFunc func() (*github.GitHubTokenResponse, error)
+
+// tokenCache caches GitHub installation tokens keyed by installation and scope.
+// Concurrent misses for the same key share a single upstream call, and entries
+// that are close to expiry are refreshed in the background while the current
+// token keeps being served. At most maxEntries tokens are kept; the one closest
+// to expiry is evicted to make room.
+type tokenCache struct {
+	ttl           time.Duration
+	refreshBefore time.Duration
+	cleanup       time.Duration
+	maxEntries    int
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*inflightFetch
+}
+
+type cacheEntry struct {
+	token     *github.GitHubTokenResponse
+	expiresAt time.Time
+	refreshAt time.Time
+}
+
+type inflightFetch struct {
+	done  chan struct{}
+	token *github.GitHubTokenResponse
+	err   error
+}
+
+// newTokenCache creates a token cache and starts its cleanup goroutine
+func newTokenCache(ttl, refreshBefore, cleanup time.Duration, maxEntries int) *tokenCache {
+	c := &tokenCache{
+		ttl:           ttl,
+		refreshBefore: refreshBefore,
+		cleanup:       cleanup,
+		maxEntries:    maxEntries,
+		entries:       make(map[string]*cacheEntry),
+		inflight:      make(map[string]*inflightFetch),
+	}
+
+	go c.cleanupExpired()
+
+	return c
+}
+
+// Get returns the cached token for key, calling fetch on a miss
+func (c *tokenCache) Get(key string, fetch tokenFetchFunc) (*github.GitHubTokenResponse, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expiresAt) {
+		if !now.Before(entry.refreshAt) {
+			// Refresh ahead of expiry without blocking the caller
+			c.startFetchLocked(key, fetch)
+		}
+		c.mu.Unlock()
+		return entry.token, nil
+	}
+	call := c.startFetchLocked(key, fetch)
+	c.mu.Unlock()
+
+	<-call.done
+	return call.token, call.err
+}
+
+// Refresh fetches a new token for key regardless of what is cached. A fetch
+// already in flight for key is joined, since it also yields a new token.
+func (c *tokenCache) Refresh(key string, fetch tokenFetchFunc) (*github.GitHubTokenResponse, error) {
+	c.mu.Lock()
+	call := c.startFetchLocked(key, fetch)
+	c.mu.Unlock()
+
+	<-call.done
+	return call.token, call.err
+}
+
+// Peek returns the unexpired token cached for key, or nil
+func (c *tokenCache) Peek(key string) *github.GitHubTokenResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expiresAt) {
+		return entry.token
+	}
+	return nil
+}
+
+// startFetchLocked joins an in-flight fetch for key or starts a new one.
+// c.mu must be held.
+func (c *tokenCache) startFetchLocked(key string, fetch tokenFetchFunc) *inflightFetch {
+	if call, ok := c.inflight[key]; ok {
+		return call
+	}
+
+	call := &inflightFetch{done: make(chan struct{})}
+	c.inflight[key] = call
+	go c.runFetch(key, fetch, call)
+
+	return call
+}
+
+// runFetch performs the upstream fetch and stores the result
+func (c *tokenCache) runFetch(key string, fetch tokenFetchFunc, call *inflightFetch) {
+	token, err := fetch()
+
+	c.mu.Lock()
+	if err == nil {
+		if _, ok := c.entries[key]; !ok {
+			c.makeRoomLocked()
+		}
+		c.entries[key] = c.newEntry(token)
+	} else if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expiresAt) {
+		// A background refresh failed; keep serving the current token
+		log.Printf("Background GitHub token refresh failed (expires: %v): %v", entry.expiresAt, err)
+	}
+	delete(c.inflight, key)
+	c.mu.Unlock()
+
+	call.token = token
+	call.err = err
+	close(call.done)
+}
+
+// newEntry computes the cache lifetime of a freshly fetched token
+func (c *tokenCache) newEntry(token *github.GitHubTokenResponse) *cacheEntry {
+	now := time.Now()
+
+	expiresAt := now.Add(c.ttl)
+	if !token.ExpiresAt.IsZero() && token.ExpiresAt.Before(expiresAt) {
+		expiresAt = token.ExpiresAt
+	}
+
+	refreshAt := expiresAt.Add(-c.refreshBefore)
+	if refreshAt.Before(now) {
+		refreshAt = now
+	}
+
+	return &cacheEntry{
+		token:     token,
+		expiresAt: expiresAt,
+		refreshAt: refreshAt,
+	}
+}
+
+// makeRoomLocked evicts entries until another one fits: expired entries first,
+// then the entry closest to expiry. c.mu must be held.
+func (c *tokenCache) makeRoomLocked() {
+	if c.maxEntries <= 0 || len(c.entries) < c.maxEntries {
+		return
+	}
+
+	now := time.Now()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+
+	for len(c.entries) >= c.maxEntries {
+		var oldestKey string
+		var oldest time.Time
+		for key, entry := range c.entries {
+			if oldestKey == "" || entry.expiresAt.Before(oldest) {
+				oldestKey, oldest = key, entry.expiresAt
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+}
+
+// InvalidateToken drops every entry currently serving token
+func (c *tokenCache) InvalidateToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if entry.token.Token == token {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// cleanupExpired removes expired entries from the cache
+func (c *tokenCache) cleanupExpired() {
+	ticker := time.NewTicker(c.cleanup)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		now := time.Now()
+
+		for key, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+
+		c.mu.Unlock()
+	}
+}
+
+// tokenCacheKey builds a cache key from an installation and the requested scope
+func tokenCacheKey(installationID string, permissions map[string]string, repositories []string) string {
+	perms := make([]string, 0, len(permissions))
+	for name, level := range permissions {
+		perms = append(perms, name+"="+level)
+	}
+	sort.Strings(perms)
+
+	repos := append([]string(nil), repositories...)
+	sort.Strings(repos)
+
+	return installationID + "|" + strings.Join(perms, ",") + "|" + strings.Join(repos, ",")
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/github"
+)
+
+func TestTokenCacheSharesConcurrentMisses(t *testing.T) {
+	cache := newTokenCache(time.Hour, time.Minute, time.Hour, 0)
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func() (*github.GitHubTokenResponse, error) {
+		fetches.Add(1)
+		<-release
+		return &github.GitHubTokenResponse{Token: "token-1", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := cache.Get("key", fetch)
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			tokens[i] = token.Token
+		}(i)
+	}
+
+	// Let every caller reach the cache before the fetch completes
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("upstream fetches = %d, want 1", n)
+	}
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("caller %d got %q, want token-1", i, token)
+		}
+	}
+
+	// A hit doesn't fetch again
+	if _, err := cache.Get("key", fetch); err != nil || fetches.Load() != 1 {
+		t.Errorf("cached Get fetched again (%d fetches, err %v)", fetches.Load(), err)
+	}
+}
+
+func TestTokenCacheRefreshesAheadOfExpiry(t *testing.T) {
+	// Tokens expire within refreshBefore, so every hit starts a refresh
+	cache := newTokenCache(time.Hour, 2*time.Hour, time.Hour, 0)
+
+	var fetches atomic.Int32
+	fetch := func() (*github.GitHubTokenResponse, error) {
+		n := fetches.Add(1)
+		return &github.GitHubTokenResponse{Token: fmt.Sprintf("token-%d", n), ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+
+	if token, err := cache.Get("key", fetch); err != nil || token.Token != "token-1" {
+		t.Fatalf("Get = %v, %v; want token-1", token, err)
+	}
+
+	// The current token is served while the new one is fetched
+	if token, err := cache.Get("key", fetch); err != nil || token.Token != "token-1" {
+		t.Fatalf("Get during refresh = %v, %v; want token-1", token, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if token := cache.Peek("key"); token != nil && token.Token == "token-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background refresh never replaced the token (cached %v)", cache.Peek("key"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTokenCacheKeepsTokenWhenRefreshFails(t *testing.T) {
+	cache := newTokenCache(time.Hour, 2*time.Hour, time.Hour, 0)
+
+	if _, err := cache.Get("key", func() (*github.GitHubTokenResponse, error) {
+		return &github.GitHubTokenResponse{Token: "token-1", ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	failed := make(chan struct{})
+	token, err := cache.Get("key", func() (*github.GitHubTokenResponse, error) {
+		defer close(failed)
+		return nil, fmt.Errorf("github unavailable")
+	})
+	if err != nil || token.Token != "token-1" {
+		t.Fatalf("Get = %v, %v; want token-1", token, err)
+	}
+
+	<-failed
+	time.Sleep(10 * time.Millisecond)
+	if token := cache.Peek("key"); token == nil || token.Token != "token-1" {
+		t.Errorf("cached token after a failed refresh = %v, want token-1", token)
+	}
+}
+
+func TestTokenCacheBound(t *testing.T) {
+	cache := newTokenCache(time.Hour, time.Minute, time.Hour, 2)
+
+	expiries := map[string]time.Duration{"soon": 10 * time.Minute, "later": 40 * time.Minute, "latest": 50 * time.Minute}
+	for _, key := range []string{"soon", "later", "latest"} {
+		expiresAt := time.Now().Add(expiries[key])
+		if _, err := cache.Get(key, func() (*github.GitHubTokenResponse, error) {
+			return &github.GitHubTokenResponse{Token: key, ExpiresAt: expiresAt}, nil
+		}); err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+	}
+
+	// The token closest to expiry made room for the third
+	if cache.Peek("soon") != nil {
+		t.Error("the entry closest to expiry was kept")
+	}
+	if cache.Peek("later") == nil || cache.Peek("latest") == nil {
+		t.Error("a newer entry was evicted")
+	}
+}
+
+func TestTokenCacheKey(t *testing.T) {
+	a := tokenCacheKey("1", map[string]string{"packages": "read", "metadata": "read"}, []string{"b", "a"})
+	b := tokenCacheKey("1", map[string]string{"metadata": "read", "packages": "read"}, []string{"a", "b"})
+	if a != b {
+		t.Errorf("keys for the same scope differ: %q and %q", a, b)
+	}
+	if c := tokenCacheKey("2", map[string]string{"packages": "read", "metadata": "read"}, []string{"a", "b"}); c == a {
+		t.Error("keys for different installations are equal")
+	}
+}
@@ -1,7 +1,12 @@
 package services
 
 import (
+	"crypto"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ARED-Group/dynamic-token-manager/internal/config"
@@ -10,32 +15,151 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// ErrRepositoryNotAllowed is returned when a device asks for a repository
+// outside of the scope configured for it
+var ErrRepositoryNotAllowed = errors.New("repository not allowed for device")
+
+// ErrOrganizationNotAllowed is returned when a device asks for an organization
+// it may not obtain tokens for
+var ErrOrganizationNotAllowed = errors.New("organization not allowed for device")
+
+// ErrScopeNotAllowed is returned when a device asks for a token scope its
+// fleet policy doesn't grant
+var ErrScopeNotAllowed = errors.New("scope not allowed for device")
+
+// ErrDeviceQuarantined is returned when a quarantined device asks for
+// credentials no recovery repository is configured for
+var ErrDeviceQuarantined = errors.New("device is quarantined")
+
+// RefreshCooldownError is returned when a token scope is force refreshed too often
+type RefreshCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RefreshCooldownError) Error() string {
+	return fmt.Sprintf("token refresh cooldown active, retry in %v", e.RetryAfter.Round(time.Second))
+}
+
+// registrySessionTokenType marks tokens used as registry proxy passwords
+const registrySessionTokenType = "registry"
+
+// deviceSessionTokenType marks tokens a device authenticates with after
+// answering a challenge
+const deviceSessionTokenType = "device_session"
+
+// ErrReservedTokenType is returned when a client asks for a token type the
+// service only issues itself
+var ErrReservedTokenType = errors.New("token type is reserved")
+
 type TokenService struct {
-	config    *config.Config
-	githubApp *github.App
+	config       *config.Config
+	githubApp    *github.App
+	tokenCache   *tokenCache
+	issuedTokens *issuedTokenStore
+
+	refreshMu   sync.Mutex
+	lastRefresh map[string]time.Time
+
+	// Account of GITHUB_INSTALLATION_ID when no organization is configured
+	defaultOrgMu        sync.Mutex
+	defaultOrg          string
+	defaultOrgCheckedAt time.Time
 }
 
 func NewTokenService(cfg *config.Config) (*TokenService, error) {
 	var githubApp *github.App
-	var err error
 
+	var keyStamp string
 	if cfg.GitHubAppID != "" {
-		githubApp, err = github.NewApp(cfg.GitHubAppID, cfg.GitHubInstallationID, cfg.GitHubPrivateKeyPath)
+		signers, stamp, err := newGitHubSigners(cfg)
 		if err != nil {
+			return nil, fmt.Errorf("failed to load GitHub App key: %w", err)
+		}
+		keyStamp = stamp
+
+		githubApp, err = github.NewApp(cfg.GitHubAppID, cfg.GitHubInstallationID, signers[0],
+			github.WithBaseURL(cfg.GitHubAPIURL),
+			github.WithHTTPClient(github.NewHTTPClient(cfg.GitHubHTTPTimeout)),
+			github.WithUserAgent(cfg.GitHubUserAgent),
+			github.WithInstallationCacheTTL(cfg.GitHubInstallationCacheTTL),
+			github.WithRetry(cfg.GitHubMaxRetries, cfg.GitHubRetryBaseDelay, cfg.GitHubMaxRetryWait),
+			github.WithRetryBudget(cfg.GitHubRetryBudget),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GitHub app: %w", err)
+		}
+		if err := githubApp.SetSigners(signers...); err != nil {
 			return nil, fmt.Errorf("failed to create GitHub app: %w", err)
 		}
 	}
 
-	return &TokenService{
-		config:    cfg,
-		githubApp: githubApp,
-	}, nil
+	s := &TokenService{
+		config:       cfg,
+		githubApp:    githubApp,
+		tokenCache:   newTokenCache(cfg.GitHubTokenCacheTTL, cfg.GitHubTokenRefreshBefore, 5*time.Minute, cfg.GitHubTokenCacheMaxEntries),
+		issuedTokens: newIssuedTokenStore(10 * time.Minute),
+		lastRefresh:  make(map[string]time.Time),
+	}
+
+	// Only key files can be rotated in place
+	if githubApp != nil && keyStamp != "" {
+		go s.watchGitHubKeys(keyStamp)
+	}
+
+	return s, nil
 }
 
-// GenerateToken creates a new JWT token
+// newGitHubSigners returns the signers for the GitHub App key selected by
+// GITHUB_PRIVATE_KEY_SOURCE, active key first. For key files it also returns
+// a stamp used to detect later changes.
+func newGitHubSigners(cfg *config.Config) ([]crypto.Signer, string, error) {
+	switch cfg.GitHubPrivateKeySource {
+	case "", "file":
+		return loadGitHubKeys(cfg.GitHubPrivateKeyPath)
+	case "env":
+		key, err := github.ParsePrivateKeyBase64(cfg.GitHubPrivateKey)
+		if err != nil {
+			return nil, "", err
+		}
+		return []crypto.Signer{key}, "", nil
+	case "remote":
+		signer, err := github.NewRemoteSigner(cfg.GitHubSignerAddress, cfg.GitHubSignerTimeout, cfg.GitHubSignerSecret)
+		if err != nil {
+			return nil, "", err
+		}
+		return []crypto.Signer{signer}, "", nil
+	default:
+		return nil, "", fmt.Errorf("unknown private key source: %s", cfg.GitHubPrivateKeySource)
+	}
+}
+
+// GenerateToken creates a new JWT token. The device's fleet policy, if any,
+// limits its scopes and sets its lifetime.
 func (s *TokenService) GenerateToken(req *models.TokenRequest) (*models.TokenResponse, error) {
+	if req.TokenType == registrySessionTokenType || req.TokenType == deviceSessionTokenType {
+		return nil, fmt.Errorf("%w: %s", ErrReservedTokenType, req.TokenType)
+	}
+
+	ttl := s.config.TokenExpiration
+	if req.Policy != nil {
+		if len(req.Policy.AllowedScopes) > 0 {
+			for _, scope := range req.Scopes {
+				if !containsString(req.Policy.AllowedScopes, scope) {
+					return nil, fmt.Errorf("%w: %s", ErrScopeNotAllowed, scope)
+				}
+			}
+		}
+		if req.Policy.TokenTTL > 0 {
+			ttl = time.Duration(req.Policy.TokenTTL) * time.Second
+		}
+	}
+	return s.generateToken(req, ttl)
+}
+
+// generateToken creates a new JWT token valid for ttl
+func (s *TokenService) generateToken(req *models.TokenRequest, ttl time.Duration) (*models.TokenResponse, error) {
 	now := time.Now()
-	expiry := now.Add(s.config.TokenExpiration)
+	expiry := now.Add(ttl)
 
 	claims := jwt.MapClaims{
 		"device_serial": req.DeviceSerial,
@@ -86,32 +210,500 @@ func (s *TokenService) GetGitHubRegistryToken(req *models.GitHubRegistryTokenReq
 		return nil, fmt.Errorf("GitHub App not configured")
 	}
 
-	// Get GitHub installation token
-	githubToken, err := s.githubApp.GetInstallationToken()
+	installationID, scope, err := s.registryTokenScope(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get GitHub installation token, served from cache when possible
+	key := tokenCacheKey(installationID, scope.Permissions, scope.Repositories)
+	githubToken, err := s.tokenCache.Get(key, func() (*github.GitHubTokenResponse, error) {
+		return s.githubApp.GetInstallationToken(installationID, scope)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get GitHub token: %w", err)
 	}
+	s.issuedTokens.Record(githubToken, installationID, req.DeviceSerial)
+
+	return s.registryTokenResponse(githubToken), nil
+}
+
+// RefreshGitHubRegistryToken bypasses the cache and replaces the cached token
+// for the device's scope with a newly minted one. Each scope may be force
+// refreshed at most once per GitHubRefreshCooldown, whichever device asks. If
+// revokePrevious is set, the superseded token is revoked at GitHub unless it
+// was also delivered to another device.
+func (s *TokenService) RefreshGitHubRegistryToken(req *models.GitHubRegistryTokenRequest, revokePrevious bool) (*models.GitHubRegistryTokenResponse, error) {
+	if s.githubApp == nil {
+		return nil, fmt.Errorf("GitHub App not configured")
+	}
+
+	installationID, scope, err := s.registryTokenScope(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key := tokenCacheKey(installationID, scope.Permissions, scope.Repositories)
+	if err := s.checkRefreshCooldown(key); err != nil {
+		return nil, err
+	}
+
+	previous := s.tokenCache.Peek(key)
+	githubToken, err := s.tokenCache.Refresh(key, func() (*github.GitHubTokenResponse, error) {
+		return s.githubApp.GetInstallationToken(installationID, scope)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh GitHub token: %w", err)
+	}
+	s.recordRefresh(key)
+	s.issuedTokens.Record(githubToken, installationID, req.DeviceSerial)
+
+	if revokePrevious && previous != nil && previous.Token != githubToken.Token {
+		s.revokeSuperseded(previous.Token, req.DeviceSerial)
+	}
+
+	return s.registryTokenResponse(githubToken), nil
+}
+
+// revokeSuperseded revokes a token replaced by a forced refresh, provided no
+// device other than deviceSerial received it. Shared tokens are left to expire.
+func (s *TokenService) revokeSuperseded(token, deviceSerial string) {
+	if record, ok := s.issuedTokens.Lookup(token); ok {
+		for serial := range record.Devices {
+			if serial != deviceSerial {
+				log.Printf("Not revoking superseded GitHub token for device %s: shared with other devices", deviceSerial)
+				return
+			}
+		}
+	}
+
+	if err := s.githubApp.RevokeInstallationToken(token); err != nil {
+		log.Printf("Failed to revoke superseded GitHub token for device %s: %v", deviceSerial, err)
+		return
+	}
+	s.issuedTokens.MarkRevoked(token)
+}
+
+// GetRegistryProxyCredentials issues the credentials a device uses to log in
+// to the registry proxy: its serial as username and a registry session token
+// as password. The GitHub token stays on the server.
+func (s *TokenService) GetRegistryProxyCredentials(deviceSerial string) (*models.GitHubRegistryTokenResponse, error) {
+	token, err := s.generateToken(&models.TokenRequest{
+		DeviceSerial: deviceSerial,
+		TokenType:    registrySessionTokenType,
+	}, s.config.RegistryProxySessionTTL)
+	if err != nil {
+		return nil, err
+	}
 
 	return &models.GitHubRegistryTokenResponse{
-		Token:     githubToken.Token,
-		ExpiresAt: githubToken.ExpiresAt,
-		Registry:  s.config.RegistryURL,
-		Username:  s.config.RegistryUsername,
+		Token:     token.Token,
+		ExpiresAt: token.ExpiresAt,
+		Registry:  s.config.RegistryProxyHost,
+		Username:  deviceSerial,
 	}, nil
 }
 
-// RefreshToken refreshes an existing token
-func (s *TokenService) RefreshToken(tokenString string) (*models.TokenResponse, error) {
+// ValidateRegistrySessionToken checks the password a device presents to the
+// registry token endpoint and returns its expiry
+func (s *TokenService) ValidateRegistrySessionToken(deviceSerial, tokenString string) (time.Time, error) {
+	claims, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if tokenType, _ := (*claims)["token_type"].(string); tokenType != registrySessionTokenType {
+		return time.Time{}, fmt.Errorf("not a registry session token")
+	}
+	if serial, _ := (*claims)["device_serial"].(string); serial != deviceSerial {
+		return time.Time{}, fmt.Errorf("registry session token issued to another device")
+	}
+
+	expiry, err := claims.GetExpirationTime()
+	if err != nil || expiry == nil {
+		return time.Time{}, fmt.Errorf("registry session token has no expiry")
+	}
+	return expiry.Time, nil
+}
+
+// IssueDeviceSession issues the session token a device presents as a bearer
+// token once it has answered a challenge
+func (s *TokenService) IssueDeviceSession(deviceSerial string) (*models.TokenResponse, error) {
+	return s.generateToken(&models.TokenRequest{
+		DeviceSerial: deviceSerial,
+		TokenType:    deviceSessionTokenType,
+	}, s.config.DeviceSessionTTL)
+}
+
+// ValidateDeviceSessionToken checks a device session token and returns the
+// serial it was issued to
+func (s *TokenService) ValidateDeviceSessionToken(tokenString string) (string, error) {
+	claims, err := s.ValidateToken(tokenString)
+	if err != nil {
+		return "", err
+	}
+
+	if tokenType, _ := (*claims)["token_type"].(string); tokenType != deviceSessionTokenType {
+		return "", fmt.Errorf("not a device session token")
+	}
+	serial, _ := (*claims)["device_serial"].(string)
+	if serial == "" {
+		return "", fmt.Errorf("device session token has no device serial")
+	}
+	return serial, nil
+}
+
+// checkRefreshCooldown enforces the force-refresh cooldown of a cache key
+func (s *TokenService) checkRefreshCooldown(key string) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	if last, ok := s.lastRefresh[key]; ok {
+		if wait := s.config.GitHubRefreshCooldown - time.Since(last); wait > 0 {
+			return &RefreshCooldownError{RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// recordRefresh starts the cooldown of a cache key after a successful refresh
+func (s *TokenService) recordRefresh(key string) {
+	now := time.Now()
+
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	s.lastRefresh[key] = now
+
+	// Forget keys whose cooldown has long passed
+	for k, last := range s.lastRefresh {
+		if now.Sub(last) > s.config.GitHubRefreshCooldown {
+			delete(s.lastRefresh, k)
+		}
+	}
+}
+
+// registryTokenScope resolves the installation and scope serving req
+func (s *TokenService) registryTokenScope(req *models.GitHubRegistryTokenRequest) (string, *github.TokenScope, error) {
+	installationID, err := s.resolveInstallation(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	scope, err := s.githubTokenScope(req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return installationID, scope, nil
+}
+
+// registryTokenResponse converts a GitHub token into the API response
+func (s *TokenService) registryTokenResponse(githubToken *github.GitHubTokenResponse) *models.GitHubRegistryTokenResponse {
+	return &models.GitHubRegistryTokenResponse{
+		Token:               githubToken.Token,
+		ExpiresAt:           githubToken.ExpiresAt,
+		Registry:            s.config.RegistryURL,
+		Username:            s.config.RegistryUsername,
+		Permissions:         githubToken.Permissions,
+		RepositorySelection: githubToken.RepositorySelection,
+		Repositories:        githubToken.Repositories,
+	}
+}
+
+// ValidateGitHubRegistryToken checks a registry token against the service's
+// record of issued tokens and, if requested, against GitHub itself
+func (s *TokenService) ValidateGitHubRegistryToken(deviceSerial string, req *models.GitHubTokenValidationRequest) (*models.GitHubTokenValidationResponse, error) {
+	record, ok := s.issuedTokens.Lookup(req.Token)
+	if !ok && s.config.RegistryProxyEnabled {
+		// In proxy mode devices hold registry session tokens instead
+		if expiry, err := s.ValidateRegistrySessionToken(deviceSerial, req.Token); err == nil {
+			return &models.GitHubTokenValidationResponse{
+				Valid:            true,
+				Message:          "Registry session token is valid",
+				ExpiresAt:        &expiry,
+				RemainingSeconds: int64(time.Until(expiry).Seconds()),
+				IssuedToDevice:   true,
+			}, nil
+		}
+	}
+	if _, issuedToDevice := record.Devices[deviceSerial]; !ok || !issuedToDevice {
+		// Tokens delivered to other devices are reported like unknown ones,
+		// so a device can't learn anything about them
+		return &models.GitHubTokenValidationResponse{
+			Valid:   false,
+			Message: "Token was not issued to this device",
+		}, nil
+	}
+
+	remaining := time.Until(record.ExpiresAt)
+	resp := &models.GitHubTokenValidationResponse{
+		ExpiresAt:      &record.ExpiresAt,
+		Permissions:    record.Permissions,
+		Repositories:   record.Repositories,
+		IssuedToDevice: true,
+		Revoked:        record.Revoked,
+	}
+
+	switch {
+	case record.Revoked:
+		resp.Message = "Token has been revoked"
+		return resp, nil
+	case remaining <= 0:
+		resp.Message = "Token has expired"
+		return resp, nil
+	}
+
+	resp.RemainingSeconds = int64(remaining.Seconds())
+
+	if req.CheckGitHub && s.githubApp != nil {
+		accepted, err := s.githubApp.CheckInstallationToken(req.Token)
+		if err != nil {
+			return nil, err
+		}
+		resp.GitHubChecked = true
+		if !accepted {
+			resp.Message = "Token was rejected by GitHub"
+			return resp, nil
+		}
+	}
+
+	resp.Valid = true
+	resp.Message = "Token is valid"
+	return resp, nil
+}
+
+// RevokeDeviceTokens stops handing out every live GitHub token delivered to a
+// device. Tokens no other device holds are revoked at GitHub; tokens shared
+// with a device for which stillEntitled reports true are only evicted from the
+// cache and left to expire, so those devices keep working and get a new token
+// on their next request. It returns how many tokens were revoked and evicted.
+func (s *TokenService) RevokeDeviceTokens(deviceSerial string, stillEntitled func(serialNumber string) bool) (int, int, error) {
+	revoked, evicted, err := s.RevokeTokens(func(serial string) bool { return serial == deviceSerial }, stillEntitled)
+	if err != nil {
+		return revoked, evicted, fmt.Errorf("device %s: %w", deviceSerial, err)
+	}
+	return revoked, evicted, nil
+}
+
+// RevokeTokens is RevokeDeviceTokens for every device affected reports true
+// for, such as all the devices of a fleet whose policy narrowed. A token is
+// only left to expire if a device that is neither affected nor no longer
+// entitled holds it.
+func (s *TokenService) RevokeTokens(affected, stillEntitled func(serialNumber string) bool) (int, int, error) {
+	if s.githubApp == nil {
+		return 0, 0, fmt.Errorf("GitHub App not configured")
+	}
+
+	var errs []error
+	revoked, evicted := 0, 0
+	for _, record := range s.issuedTokens.HeldBy(affected) {
+		// Stop handing the token out before revoking it
+		s.tokenCache.InvalidateToken(record.token)
+
+		if sharedWithEntitledDevice(record, affected, stillEntitled) {
+			evicted++
+			continue
+		}
+
+		if err := s.githubApp.RevokeInstallationToken(record.token); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.issuedTokens.MarkRevoked(record.token)
+		revoked++
+	}
+
+	if len(errs) > 0 {
+		return revoked, evicted, fmt.Errorf("failed to revoke %d token(s): %w", len(errs), errors.Join(errs...))
+	}
+	return revoked, evicted, nil
+}
+
+// sharedWithEntitledDevice reports whether record was also delivered to a
+// device outside affected that may still use it
+func sharedWithEntitledDevice(record issuedToken, affected, stillEntitled func(string) bool) bool {
+	for serial := range record.Devices {
+		if !affected(serial) && stillEntitled(serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveInstallation picks the GitHub App installation serving req
+func (s *TokenService) resolveInstallation(req *models.GitHubRegistryTokenRequest) (string, error) {
+	org, err := s.selectOrganization(req)
+	if err != nil {
+		return "", err
+	}
+
+	if s.config.GitHubInstallationID != "" && (org == "" || strings.EqualFold(org, s.defaultOrganization())) {
+		return s.config.GitHubInstallationID, nil
+	}
+	if org == "" {
+		org = s.config.GitHubOrganization
+	}
+	if org == "" {
+		return "", fmt.Errorf("no GitHub App installation configured")
+	}
+
+	return s.githubApp.ResolveInstallation(org)
+}
+
+// selectOrganization picks the organization for req. A device group mapped to
+// an organization, by its fleet policy or GITHUB_GROUP_ORGANIZATIONS, is
+// pinned to it; otherwise the device may request any
+// configured organization. "" means the default installation.
+func (s *TokenService) selectOrganization(req *models.GitHubRegistryTokenRequest) (string, error) {
+	org := req.Organization
+	groupOrg := s.config.GitHubGroupOrganizations[req.Group]
+	if req.Group == "" {
+		groupOrg = ""
+	}
+	if req.Policy != nil && req.Policy.Organization != "" {
+		groupOrg = req.Policy.Organization
+	}
+
+	switch {
+	case groupOrg != "":
+		if org != "" && !strings.EqualFold(org, groupOrg) {
+			return "", fmt.Errorf("%w: %s", ErrOrganizationNotAllowed, org)
+		}
+		org = groupOrg
+	case org != "":
+		if !s.isOrganizationAllowed(org) {
+			return "", fmt.Errorf("%w: %s", ErrOrganizationNotAllowed, org)
+		}
+	}
+
+	return org, nil
+}
+
+// AuthorizeRegistryPull checks, without calling GitHub, whether the device in
+// req may pull from req's organization and repository
+func (s *TokenService) AuthorizeRegistryPull(req *models.GitHubRegistryTokenRequest) error {
+	if _, err := s.selectOrganization(req); err != nil {
+		return err
+	}
+	_, err := s.githubTokenScope(req)
+	return err
+}
+
+// isOrganizationAllowed reports whether devices may select org per request
+func (s *TokenService) isOrganizationAllowed(org string) bool {
+	if strings.EqualFold(org, s.defaultOrganization()) {
+		return true
+	}
+	for _, allowed := range s.config.GitHubOrganizations {
+		if strings.EqualFold(org, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultOrganization returns the organization of the default installation:
+// GITHUB_ORGANIZATION, or else the account GITHUB_INSTALLATION_ID belongs to,
+// looked up once and retried at most once a minute while GitHub is unreachable
+func (s *TokenService) defaultOrganization() string {
+	if s.config.GitHubOrganization != "" || s.config.GitHubInstallationID == "" || s.githubApp == nil {
+		return s.config.GitHubOrganization
+	}
+
+	s.defaultOrgMu.Lock()
+	defer s.defaultOrgMu.Unlock()
+
+	if s.defaultOrg == "" && time.Since(s.defaultOrgCheckedAt) > time.Minute {
+		s.defaultOrgCheckedAt = time.Now()
+		installation, err := s.githubApp.GetInstallation(s.config.GitHubInstallationID)
+		if err != nil {
+			log.Printf("Failed to look up the account of GitHub installation %s: %v", s.config.GitHubInstallationID, err)
+		} else {
+			s.defaultOrg = installation.Account.Login
+		}
+	}
+	return s.defaultOrg
+}
+
+// githubTokenScope determines the repositories and permissions a registry
+// token for req may carry. Group repositories override the global default,
+// fleet policy repositories narrow those (or apply alone when neither is
+// set), quarantine overrides all, and a requested repository narrows the
+// scope further when one of them applies.
+func (s *TokenService) githubTokenScope(req *models.GitHubRegistryTokenRequest) (*github.TokenScope, error) {
+	allowed := s.config.GitHubTokenRepositories
+	if repos, ok := s.config.GitHubGroupRepositories[req.Group]; ok && req.Group != "" {
+		allowed = repos
+	}
+	if req.Policy != nil && len(req.Policy.Repositories) > 0 {
+		// A policy can't grant repositories the group or default withholds
+		if len(allowed) > 0 {
+			var narrowed []string
+			for _, repo := range allowed {
+				if containsString(req.Policy.Repositories, repo) {
+					narrowed = append(narrowed, repo)
+				}
+			}
+			if len(narrowed) == 0 && !req.Quarantined {
+				return nil, fmt.Errorf("%w: no repositories of fleet policy", ErrRepositoryNotAllowed)
+			}
+			allowed = narrowed
+		} else {
+			allowed = req.Policy.Repositories
+		}
+	}
+	if req.Quarantined {
+		// Quarantined devices only ever get the recovery repositories
+		if len(s.config.GitHubQuarantineRepositories) == 0 {
+			return nil, ErrDeviceQuarantined
+		}
+		allowed = s.config.GitHubQuarantineRepositories
+	}
+
+	repositories := allowed
+	if req.Repository != "" && len(allowed) > 0 {
+		// Only configured names narrow the token; without a list the device
+		// already gets the installation-wide token, and minting one per
+		// arbitrary name would only grow the cache and hit GitHub
+		if !containsString(allowed, req.Repository) {
+			return nil, fmt.Errorf("%w: %s", ErrRepositoryNotAllowed, req.Repository)
+		}
+		repositories = []string{req.Repository}
+	}
+
+	return &github.TokenScope{
+		Repositories: repositories,
+		Permissions:  s.config.GitHubTokenPermissions,
+	}, nil
+}
+
+// containsString reports whether list contains value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshToken refreshes an existing token issued to deviceSerial, applying
+// policy, the device's current fleet policy, as GenerateToken does
+func (s *TokenService) RefreshToken(tokenString, deviceSerial string, policy *models.FleetPolicy) (*models.TokenResponse, error) {
 	claims, err := s.ValidateToken(tokenString)
 	if err != nil {
 		return nil, fmt.Errorf("invalid token for refresh: %w", err)
 	}
 
 	// Extract device serial from existing token
-	deviceSerial, ok := (*claims)["device_serial"].(string)
+	tokenSerial, ok := (*claims)["device_serial"].(string)
 	if !ok {
 		return nil, fmt.Errorf("invalid device serial in token")
 	}
+	if tokenSerial != deviceSerial {
+		return nil, fmt.Errorf("token was not issued to this device")
+	}
 
 	// Extract scopes
 	scopesInterface, ok := (*claims)["scopes"]
@@ -131,5 +723,6 @@ func (s *TokenService) RefreshToken(tokenString string) (*models.TokenResponse,
 		DeviceSerial: deviceSerial,
 		TokenType:    "refresh",
 		Scopes:       scopes,
+		Policy:       policy,
 	})
 }
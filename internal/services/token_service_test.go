@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestRefreshTokenPolicy(t *testing.T) {
+	_, tokenService := newTestServices(t, nil)
+
+	issued, err := tokenService.GenerateToken(&models.TokenRequest{DeviceSerial: "ARED-001", Scopes: []string{"telemetry:write"}})
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+
+	policy := &models.FleetPolicy{TokenTTL: 60}
+	refreshed, err := tokenService.RefreshToken(issued.Token, "ARED-001", policy)
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if ttl := time.Until(refreshed.ExpiresAt); ttl > time.Minute {
+		t.Errorf("refreshed token lives %v, want at most the policy's 60s", ttl)
+	}
+
+	if _, err := tokenService.RefreshToken(issued.Token, "ARED-002", nil); err == nil {
+		t.Error("RefreshToken accepted another device's token")
+	}
+
+	policy = &models.FleetPolicy{AllowedScopes: []string{"status:read"}}
+	if _, err := tokenService.RefreshToken(issued.Token, "ARED-001", policy); err == nil {
+		t.Error("RefreshToken kept a scope the policy no longer allows")
+	}
+}
+
+func TestRefreshGitHubRegistryToken(t *testing.T) {
+	gh := newFakeGitHub(t)
+	env := gh.env(t)
+	env["GITHUB_REFRESH_COOLDOWN"] = "1h"
+	_, tokenService := newTestServices(t, env)
+
+	req := &models.GitHubRegistryTokenRequest{DeviceSerial: "SN1"}
+	cached, err := tokenService.GetGitHubRegistryToken(req)
+	if err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+
+	// A forced refresh bypasses and replaces the cached token
+	refreshed, err := tokenService.RefreshGitHubRegistryToken(req, true)
+	if err != nil {
+		t.Fatalf("RefreshGitHubRegistryToken: %v", err)
+	}
+	if refreshed.Token == cached.Token {
+		t.Fatalf("refresh returned the cached token %s", cached.Token)
+	}
+	if !gh.Revoked(cached.Token) {
+		t.Errorf("superseded token %s was not revoked", cached.Token)
+	}
+	if token, err := tokenService.GetGitHubRegistryToken(req); err != nil || token.Token != refreshed.Token {
+		t.Errorf("GetGitHubRegistryToken after refresh = %v, %v; want %s", token, err, refreshed.Token)
+	}
+
+	// The scope is in its cooldown, whichever device asks
+	var cooldownErr *RefreshCooldownError
+	if _, err := tokenService.RefreshGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN2"}, false); !errors.As(err, &cooldownErr) || cooldownErr.RetryAfter <= 0 {
+		t.Errorf("second refresh error = %v, want a RefreshCooldownError", err)
+	}
+	if minted := gh.Minted(); minted != 2 {
+		t.Errorf("minted %d tokens, want 2", minted)
+	}
+}
+
+func TestRefreshGitHubRegistryTokenKeepsSharedTokens(t *testing.T) {
+	gh := newFakeGitHub(t)
+	_, tokenService := newTestServices(t, gh.env(t))
+
+	shared, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN1"})
+	if err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+	if _, err := tokenService.GetGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN2"}); err != nil {
+		t.Fatalf("GetGitHubRegistryToken: %v", err)
+	}
+
+	if _, err := tokenService.RefreshGitHubRegistryToken(&models.GitHubRegistryTokenRequest{DeviceSerial: "SN1"}, true); err != nil {
+		t.Fatalf("RefreshGitHubRegistryToken: %v", err)
+	}
+	if gh.Revoked(shared.Token) {
+		t.Error("a token another device holds was revoked")
+	}
+}
+
+func TestGitHubTokenPolicyRepositories(t *testing.T) {
+	gh := newFakeGitHub(t)
+	env := gh.env(t)
+	env["GITHUB_TOKEN_REPOSITORIES"] = "app,agent"
+	env["GITHUB_GROUP_REPOSITORIES"] = "pilot=agent|other"
+	_, tokenService := newTestServices(t, env)
+
+	tests := []struct {
+		name         string
+		req          models.GitHubRegistryTokenRequest
+		repositories []string
+		err          error
+	}{
+		{
+			name:         "policy narrows the configured repositories",
+			req:          models.GitHubRegistryTokenRequest{Policy: &models.FleetPolicy{Repositories: []string{"app", "other"}}},
+			repositories: []string{"app"},
+		},
+		{
+			name:         "policy narrows the group repositories",
+			req:          models.GitHubRegistryTokenRequest{Group: "pilot", Policy: &models.FleetPolicy{Repositories: []string{"other", "app"}}},
+			repositories: []string{"other"},
+		},
+		{
+			name: "policy lists none of the group repositories",
+			req:  models.GitHubRegistryTokenRequest{Group: "pilot", Policy: &models.FleetPolicy{Repositories: []string{"app"}}},
+			err:  ErrRepositoryNotAllowed,
+		},
+		{
+			name: "policy excludes requested repository",
+			req:  models.GitHubRegistryTokenRequest{Repository: "agent", Policy: &models.FleetPolicy{Repositories: []string{"app"}}},
+			err:  ErrRepositoryNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.DeviceSerial = "SN1"
+			_, err := tokenService.GetGitHubRegistryToken(&tt.req)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("GetGitHubRegistryToken() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetGitHubRegistryToken() error = %v", err)
+			}
+			if repositories := gh.LastScope().Repositories; !reflect.DeepEqual(repositories, tt.repositories) {
+				t.Errorf("minted for %v, want %v", repositories, tt.repositories)
+			}
+		})
+	}
+}
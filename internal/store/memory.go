@@ -0,0 +1,385 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// MemoryStore keeps the device registry in memory. It is meant for tests and
+// local development; everything is lost on restart.
+type MemoryStore struct {
+	mu               sync.RWMutex
+	devices          map[string]*models.Device
+	enrollmentTokens map[string]*memoryEnrollmentToken
+	statusEvents     []*models.DeviceStatusEvent
+	fleets           map[string]*models.Fleet
+}
+
+// memoryEnrollmentToken is an enrollment token and the hash of its secret
+type memoryEnrollmentToken struct {
+	token *models.EnrollmentToken
+	hash  string
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		devices:          make(map[string]*models.Device),
+		enrollmentTokens: make(map[string]*memoryEnrollmentToken),
+		fleets:           make(map[string]*models.Fleet),
+	}
+}
+
+func (s *MemoryStore) GetDevice(serialNumber string) (*models.Device, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	device, ok := s.devices[serialNumber]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyDevice(device), nil
+}
+
+func (s *MemoryStore) CreateDevice(device *models.Device, event *models.DeviceStatusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createDevice(device, event)
+}
+
+// createDevice adds a device and records event; the caller holds the write lock
+func (s *MemoryStore) createDevice(device *models.Device, event *models.DeviceStatusEvent) error {
+	if _, ok := s.devices[device.SerialNumber]; ok {
+		return ErrAlreadyExists
+	}
+
+	now := time.Now().UTC()
+	if device.Status == "" {
+		device.Status = models.DeviceStatusActive
+	}
+	device.CreatedAt = now
+	device.UpdatedAt = now
+	s.devices[device.SerialNumber] = copyDevice(device)
+	s.recordEvent(event, "", device.Status, now)
+	return nil
+}
+
+// recordEvent fills in and appends event unless it is nil; the caller holds
+// the write lock
+func (s *MemoryStore) recordEvent(event *models.DeviceStatusEvent, fromStatus, toStatus string, now time.Time) {
+	if event == nil {
+		return
+	}
+	event.ID = int64(len(s.statusEvents) + 1)
+	event.FromStatus = fromStatus
+	event.ToStatus = toStatus
+	event.CreatedAt = now
+
+	recorded := *event
+	s.statusEvents = append(s.statusEvents, &recorded)
+}
+
+func (s *MemoryStore) UpdateDevice(serialNumber string, update *models.DeviceUpdateRequest, event *models.DeviceStatusEvent) (*models.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.devices[serialNumber]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if update.Fleet != nil {
+		existing.Fleet = *update.Fleet
+	}
+	if update.HardwareModel != nil {
+		existing.HardwareModel = *update.HardwareModel
+	}
+	if update.PublicKey != nil {
+		existing.PublicKey = *update.PublicKey
+	}
+	if update.RequireClientCert != nil {
+		existing.RequireClientCert = *update.RequireClientCert
+	}
+	existing.UpdatedAt = time.Now().UTC()
+	s.recordEvent(event, existing.Status, existing.Status, existing.UpdatedAt)
+	return copyDevice(existing), nil
+}
+
+func (s *MemoryStore) DeleteDevice(serialNumber string, event *models.DeviceStatusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[serialNumber]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.devices, serialNumber)
+	s.recordEvent(event, device.Status, "", time.Now().UTC())
+	return nil
+}
+
+func (s *MemoryStore) SetDeviceStatus(event *models.DeviceStatusEvent, check func(*models.Device) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[event.SerialNumber]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := check(copyDevice(device)); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	s.recordEvent(event, device.Status, event.ToStatus, now)
+	device.Status = event.ToStatus
+	device.UpdatedAt = now
+	return nil
+}
+
+func (s *MemoryStore) ListDeviceStatusEvents(serialNumber string) ([]*models.DeviceStatusEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []*models.DeviceStatusEvent
+	for i := len(s.statusEvents) - 1; i >= 0; i-- {
+		if s.statusEvents[i].SerialNumber == serialNumber {
+			event := *s.statusEvents[i]
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) RecordDeviceSightings(sightings []models.DeviceSighting) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sighting := range sightings {
+		device, ok := s.devices[sighting.SerialNumber]
+		if !ok || (device.LastSeenAt != nil && !device.LastSeenAt.Before(sighting.SeenAt)) {
+			continue
+		}
+		seenAt := sighting.SeenAt.UTC()
+		device.LastSeenAt = &seenAt
+		device.LastSeenIP = sighting.IP
+		if sighting.ClientVersion != "" {
+			device.ClientVersion = sighting.ClientVersion
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetDeviceHeartbeat(serialNumber string, heartbeat *models.DeviceHeartbeat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[serialNumber]
+	if !ok {
+		return ErrNotFound
+	}
+	device.Heartbeat = copyHeartbeat(heartbeat)
+	return nil
+}
+
+func (s *MemoryStore) ListDevices(filter models.DeviceFilter) ([]*models.Device, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []*models.Device
+	for _, device := range s.devices {
+		if filter.Status != "" && device.Status != filter.Status {
+			continue
+		}
+		if filter.Fleet != "" && device.Fleet != filter.Fleet {
+			continue
+		}
+		if filter.HardwareModel != "" && device.HardwareModel != filter.HardwareModel {
+			continue
+		}
+		if !filter.NotSeenSince.IsZero() && device.LastSeenAt != nil && !device.LastSeenAt.Before(filter.NotSeenSince) {
+			continue
+		}
+		matches = append(matches, device)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].SerialNumber < matches[j].SerialNumber
+	})
+
+	total := len(matches)
+	page := make([]*models.Device, 0, filter.Limit)
+	for i := filter.Offset; i < total && len(page) < filter.Limit; i++ {
+		page = append(page, copyDevice(matches[i]))
+	}
+	return page, total, nil
+}
+
+func (s *MemoryStore) CreateEnrollmentToken(token *models.EnrollmentToken, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.enrollmentTokens[token.ID]; ok {
+		return ErrAlreadyExists
+	}
+	token.CreatedAt = time.Now().UTC()
+	stored := *token
+	s.enrollmentTokens[token.ID] = &memoryEnrollmentToken{token: &stored, hash: tokenHash}
+	return nil
+}
+
+func (s *MemoryStore) ListEnrollmentTokens() ([]*models.EnrollmentToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]*models.EnrollmentToken, 0, len(s.enrollmentTokens))
+	for _, entry := range s.enrollmentTokens {
+		token := *entry.token
+		tokens = append(tokens, &token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (s *MemoryStore) DeleteEnrollmentToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.enrollmentTokens[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.enrollmentTokens, id)
+	return nil
+}
+
+func (s *MemoryStore) EnrollDevice(tokenHash string, device *models.Device, event *models.DeviceStatusEvent, check func(*models.EnrollmentToken) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entry *memoryEnrollmentToken
+	for _, candidate := range s.enrollmentTokens {
+		if candidate.hash == tokenHash {
+			entry = candidate
+			break
+		}
+	}
+	if entry == nil {
+		return ErrNotFound
+	}
+
+	token := *entry.token
+	if err := check(&token); err != nil {
+		return err
+	}
+	if err := s.createDevice(device, event); err != nil {
+		return err
+	}
+
+	usedAt := time.Now().UTC()
+	entry.token.UsedAt = &usedAt
+	entry.token.UsedBy = device.SerialNumber
+	return nil
+}
+
+func (s *MemoryStore) GetFleet(name string) (*models.Fleet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fleet, ok := s.fleets[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyFleet(fleet), nil
+}
+
+func (s *MemoryStore) CreateFleet(fleet *models.Fleet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.fleets[fleet.Name]; ok {
+		return ErrAlreadyExists
+	}
+	now := time.Now().UTC()
+	fleet.CreatedAt = now
+	fleet.UpdatedAt = now
+	s.fleets[fleet.Name] = copyFleet(fleet)
+	return nil
+}
+
+func (s *MemoryStore) UpdateFleet(fleet *models.Fleet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.fleets[fleet.Name]
+	if !ok {
+		return ErrNotFound
+	}
+	fleet.CreatedAt = existing.CreatedAt
+	fleet.UpdatedAt = time.Now().UTC()
+	s.fleets[fleet.Name] = copyFleet(fleet)
+	return nil
+}
+
+func (s *MemoryStore) DeleteFleet(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.fleets[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.fleets, name)
+	return nil
+}
+
+func (s *MemoryStore) ListFleets() ([]*models.Fleet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fleets := make([]*models.Fleet, 0, len(s.fleets))
+	for _, fleet := range s.fleets {
+		fleets = append(fleets, copyFleet(fleet))
+	}
+	sort.Slice(fleets, func(i, j int) bool {
+		return fleets[i].Name < fleets[j].Name
+	})
+	return fleets, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// copyDevice returns a copy so callers can't modify stored devices
+func copyDevice(device *models.Device) *models.Device {
+	c := *device
+	if device.LastSeenAt != nil {
+		lastSeen := *device.LastSeenAt
+		c.LastSeenAt = &lastSeen
+	}
+	c.Heartbeat = copyHeartbeat(device.Heartbeat)
+	return &c
+}
+
+// copyHeartbeat returns a deep copy of a heartbeat, or nil
+func copyHeartbeat(heartbeat *models.DeviceHeartbeat) *models.DeviceHeartbeat {
+	if heartbeat == nil {
+		return nil
+	}
+	c := *heartbeat
+	c.Images = append([]models.ImageStatus(nil), heartbeat.Images...)
+	return &c
+}
+
+// copyFleet returns a copy so callers can't modify stored fleets
+func copyFleet(fleet *models.Fleet) *models.Fleet {
+	c := *fleet
+	c.Policy.Registries = append([]string(nil), fleet.Policy.Registries...)
+	c.Policy.Repositories = append([]string(nil), fleet.Policy.Repositories...)
+	c.Policy.AllowedScopes = append([]string(nil), fleet.Policy.AllowedScopes...)
+	return &c
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	s := NewMemoryStore()
+	mustCreateDevice(t, s, "SN1")
+
+	device, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	device.Status = models.DeviceStatusSuspended
+
+	device, err = s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.Status != models.DeviceStatusActive {
+		t.Errorf("status = %q after modifying a returned copy, want active", device.Status)
+	}
+}
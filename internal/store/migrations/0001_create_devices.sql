@@ -0,0 +1,13 @@
+CREATE TABLE devices (
+    serial_number  TEXT PRIMARY KEY,
+    status         TEXT NOT NULL DEFAULT 'active',
+    fleet          TEXT NOT NULL DEFAULT '',
+    hardware_model TEXT NOT NULL DEFAULT '',
+    public_key     TEXT NOT NULL DEFAULT '',
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at   TIMESTAMPTZ
+);
+
+CREATE INDEX devices_status_idx ON devices (status);
+CREATE INDEX devices_fleet_idx ON devices (fleet);
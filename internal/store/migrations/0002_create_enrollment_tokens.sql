@@ -0,0 +1,10 @@
+CREATE TABLE enrollment_tokens (
+    id             TEXT PRIMARY KEY,
+    token_hash     TEXT NOT NULL UNIQUE,
+    fleet          TEXT NOT NULL DEFAULT '',
+    serial_pattern TEXT NOT NULL DEFAULT '',
+    expires_at     TIMESTAMPTZ NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    used_at        TIMESTAMPTZ,
+    used_by        TEXT NOT NULL DEFAULT ''
+);
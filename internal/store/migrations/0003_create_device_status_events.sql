@@ -0,0 +1,11 @@
+CREATE TABLE device_status_events (
+    id            BIGSERIAL PRIMARY KEY,
+    serial_number TEXT NOT NULL,
+    from_status   TEXT NOT NULL,
+    to_status     TEXT NOT NULL,
+    actor         TEXT NOT NULL,
+    reason        TEXT NOT NULL DEFAULT '',
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX device_status_events_serial_idx ON device_status_events (serial_number, id);
@@ -0,0 +1,6 @@
+ALTER TABLE devices
+    ADD COLUMN last_seen_ip   TEXT NOT NULL DEFAULT '',
+    ADD COLUMN client_version TEXT NOT NULL DEFAULT '',
+    ADD COLUMN heartbeat      JSONB;
+
+CREATE INDEX devices_last_seen_at_idx ON devices (last_seen_at);
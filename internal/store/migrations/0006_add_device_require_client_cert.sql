@@ -0,0 +1,2 @@
+ALTER TABLE devices
+    ADD COLUMN require_client_cert BOOLEAN NOT NULL DEFAULT FALSE;
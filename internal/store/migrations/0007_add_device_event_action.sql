@@ -0,0 +1,2 @@
+ALTER TABLE device_status_events
+    ADD COLUMN action TEXT NOT NULL DEFAULT 'status_changed';
@@ -0,0 +1,534 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is Postgres' error code for duplicate keys
+const uniqueViolation = "23505"
+
+// PostgresStore keeps the device registry in Postgres
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// NewPostgresStore connects to databaseURL and applies pending migrations
+func NewPostgresStore(databaseURL string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db.SetMaxOpenConns(10)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// deviceColumns lists the columns scanDevice reads, in order
+const deviceColumns = `serial_number, status, fleet, hardware_model, public_key, require_client_cert, created_at,
+	updated_at, last_seen_at, last_seen_ip, client_version, heartbeat`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDevice reads a device selected with deviceColumns
+func scanDevice(row rowScanner) (*models.Device, error) {
+	var device models.Device
+	var lastSeen sql.NullTime
+	var heartbeat []byte
+	err := row.Scan(&device.SerialNumber, &device.Status, &device.Fleet, &device.HardwareModel,
+		&device.PublicKey, &device.RequireClientCert, &device.CreatedAt, &device.UpdatedAt, &lastSeen,
+		&device.LastSeenIP, &device.ClientVersion, &heartbeat)
+	if err != nil {
+		return nil, err
+	}
+	if lastSeen.Valid {
+		device.LastSeenAt = &lastSeen.Time
+	}
+	if heartbeat != nil {
+		device.Heartbeat = &models.DeviceHeartbeat{}
+		if err := json.Unmarshal(heartbeat, device.Heartbeat); err != nil {
+			return nil, fmt.Errorf("invalid heartbeat for device %s: %w", device.SerialNumber, err)
+		}
+	}
+	return &device, nil
+}
+
+func (s *PostgresStore) GetDevice(serialNumber string) (*models.Device, error) {
+	row := s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE serial_number = $1`, serialNumber)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return device, err
+}
+
+func (s *PostgresStore) CreateDevice(device *models.Device, event *models.DeviceStatusEvent) error {
+	if device.Status == "" {
+		device.Status = models.DeviceStatusActive
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		INSERT INTO devices (serial_number, status, fleet, hardware_model, public_key, require_client_cert)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at`,
+		device.SerialNumber, device.Status, device.Fleet, device.HardwareModel, device.PublicKey, device.RequireClientCert,
+	).Scan(&device.CreatedAt, &device.UpdatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertDeviceEvent(tx, event, "", device.Status); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertDeviceEvent fills in event and records it in tx, unless it is nil
+func insertDeviceEvent(tx *sql.Tx, event *models.DeviceStatusEvent, fromStatus, toStatus string) error {
+	if event == nil {
+		return nil
+	}
+	event.FromStatus = fromStatus
+	event.ToStatus = toStatus
+	return tx.QueryRow(`
+		INSERT INTO device_status_events (serial_number, action, from_status, to_status, actor, reason)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		event.SerialNumber, event.Action, event.FromStatus, event.ToStatus, event.Actor, event.Reason,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+func (s *PostgresStore) UpdateDevice(serialNumber string, update *models.DeviceUpdateRequest, event *models.DeviceStatusEvent) (*models.Device, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// NULL parameters leave their column as it is
+	row := tx.QueryRow(`
+		UPDATE devices
+		SET fleet = COALESCE($2::text, fleet),
+			hardware_model = COALESCE($3::text, hardware_model),
+			public_key = COALESCE($4::text, public_key),
+			require_client_cert = COALESCE($5::boolean, require_client_cert),
+			updated_at = now()
+		WHERE serial_number = $1
+		RETURNING `+deviceColumns,
+		serialNumber, update.Fleet, update.HardwareModel, update.PublicKey, update.RequireClientCert,
+	)
+	updated, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := insertDeviceEvent(tx, event, updated.Status, updated.Status); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (s *PostgresStore) DeleteDevice(serialNumber string, event *models.DeviceStatusEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`DELETE FROM devices WHERE serial_number = $1 RETURNING status`, serialNumber).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertDeviceEvent(tx, event, status, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) SetDeviceStatus(event *models.DeviceStatusEvent, check func(*models.Device) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the device so concurrent changes record the right previous status
+	row := tx.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE serial_number = $1 FOR UPDATE`, event.SerialNumber)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := check(device); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE devices SET status = $2, updated_at = now() WHERE serial_number = $1`, event.SerialNumber, event.ToStatus); err != nil {
+		return err
+	}
+	if err := insertDeviceEvent(tx, event, device.Status, event.ToStatus); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) ListDeviceStatusEvents(serialNumber string) ([]*models.DeviceStatusEvent, error) {
+	rows, err := s.db.Query(`
+		SELECT id, serial_number, action, from_status, to_status, actor, reason, created_at
+		FROM device_status_events
+		WHERE serial_number = $1
+		ORDER BY id DESC`, serialNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.DeviceStatusEvent
+	for rows.Next() {
+		var event models.DeviceStatusEvent
+		err := rows.Scan(&event.ID, &event.SerialNumber, &event.Action, &event.FromStatus, &event.ToStatus,
+			&event.Actor, &event.Reason, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) RecordDeviceSightings(sightings []models.DeviceSighting) error {
+	serials := make([]string, len(sightings))
+	seenAt := make([]string, len(sightings))
+	ips := make([]string, len(sightings))
+	versions := make([]string, len(sightings))
+	for i, sighting := range sightings {
+		serials[i] = sighting.SerialNumber
+		seenAt[i] = sighting.SeenAt.UTC().Format(time.RFC3339Nano)
+		ips[i] = sighting.IP
+		versions[i] = sighting.ClientVersion
+	}
+
+	// One statement for the whole batch; a version is only replaced when the
+	// device sent one
+	_, err := s.db.Exec(`
+		UPDATE devices d
+		SET last_seen_at = v.seen_at,
+		    last_seen_ip = v.ip,
+		    client_version = CASE WHEN v.version <> '' THEN v.version ELSE d.client_version END
+		FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::text[]) AS v(serial_number, seen_at, ip, version)
+		WHERE d.serial_number = v.serial_number
+		  AND (d.last_seen_at IS NULL OR d.last_seen_at < v.seen_at)`,
+		pq.Array(serials), pq.Array(seenAt), pq.Array(ips), pq.Array(versions))
+	return err
+}
+
+func (s *PostgresStore) SetDeviceHeartbeat(serialNumber string, heartbeat *models.DeviceHeartbeat) error {
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec(`UPDATE devices SET heartbeat = $2 WHERE serial_number = $1`, serialNumber, data)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+func (s *PostgresStore) ListDevices(filter models.DeviceFilter) ([]*models.Device, int, error) {
+	var conditions []string
+	var args []interface{}
+	addCondition := func(column, value string) {
+		if value != "" {
+			args = append(args, value)
+			conditions = append(conditions, column+" = $"+strconv.Itoa(len(args)))
+		}
+	}
+	addCondition("status", filter.Status)
+	addCondition("fleet", filter.Fleet)
+	addCondition("hardware_model", filter.HardwareModel)
+	if !filter.NotSeenSince.IsZero() {
+		args = append(args, filter.NotSeenSince)
+		conditions = append(conditions, "(last_seen_at IS NULL OR last_seen_at < $"+strconv.Itoa(len(args))+")")
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT count(*) FROM devices`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	rows, err := s.db.Query(`SELECT `+deviceColumns+` FROM devices`+where+
+		` ORDER BY serial_number LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	devices := make([]*models.Device, 0, filter.Limit)
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, total, rows.Err()
+}
+
+// enrollmentTokenColumns lists the columns scanEnrollmentToken reads, in order
+const enrollmentTokenColumns = `id, fleet, serial_pattern, expires_at, created_at, used_at, used_by`
+
+// scanEnrollmentToken reads an enrollment token selected with enrollmentTokenColumns
+func scanEnrollmentToken(row rowScanner) (*models.EnrollmentToken, error) {
+	var token models.EnrollmentToken
+	var usedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.Fleet, &token.SerialPattern, &token.ExpiresAt,
+		&token.CreatedAt, &usedAt, &token.UsedBy)
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	return &token, nil
+}
+
+func (s *PostgresStore) CreateEnrollmentToken(token *models.EnrollmentToken, tokenHash string) error {
+	err := s.db.QueryRow(`
+		INSERT INTO enrollment_tokens (id, token_hash, fleet, serial_pattern, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`,
+		token.ID, tokenHash, token.Fleet, token.SerialPattern, token.ExpiresAt,
+	).Scan(&token.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *PostgresStore) ListEnrollmentTokens() ([]*models.EnrollmentToken, error) {
+	rows, err := s.db.Query(`SELECT ` + enrollmentTokenColumns + ` FROM enrollment_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*models.EnrollmentToken
+	for rows.Next() {
+		token, err := scanEnrollmentToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *PostgresStore) DeleteEnrollmentToken(id string) error {
+	result, err := s.db.Exec(`DELETE FROM enrollment_tokens WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+func (s *PostgresStore) EnrollDevice(tokenHash string, device *models.Device, event *models.DeviceStatusEvent, check func(*models.EnrollmentToken) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the token so concurrent enrollments can't both use it
+	row := tx.QueryRow(`SELECT `+enrollmentTokenColumns+` FROM enrollment_tokens WHERE token_hash = $1 FOR UPDATE`, tokenHash)
+	token, err := scanEnrollmentToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := check(token); err != nil {
+		return err
+	}
+
+	if device.Status == "" {
+		device.Status = models.DeviceStatusActive
+	}
+	err = tx.QueryRow(`
+		INSERT INTO devices (serial_number, status, fleet, hardware_model, public_key, require_client_cert)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, updated_at`,
+		device.SerialNumber, device.Status, device.Fleet, device.HardwareModel, device.PublicKey, device.RequireClientCert,
+	).Scan(&device.CreatedAt, &device.UpdatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := insertDeviceEvent(tx, event, "", device.Status); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE enrollment_tokens SET used_at = now(), used_by = $2 WHERE id = $1`, token.ID, device.SerialNumber); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fleetColumns lists the columns scanFleet reads, in order
+const fleetColumns = `name, description, policy, created_at, updated_at`
+
+// scanFleet reads a fleet selected with fleetColumns
+func scanFleet(row rowScanner) (*models.Fleet, error) {
+	var fleet models.Fleet
+	var policy []byte
+	if err := row.Scan(&fleet.Name, &fleet.Description, &policy, &fleet.CreatedAt, &fleet.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(policy, &fleet.Policy); err != nil {
+		return nil, fmt.Errorf("invalid policy for fleet %s: %w", fleet.Name, err)
+	}
+	return &fleet, nil
+}
+
+func (s *PostgresStore) GetFleet(name string) (*models.Fleet, error) {
+	row := s.db.QueryRow(`SELECT `+fleetColumns+` FROM fleets WHERE name = $1`, name)
+	fleet, err := scanFleet(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return fleet, err
+}
+
+func (s *PostgresStore) CreateFleet(fleet *models.Fleet) error {
+	policy, err := json.Marshal(fleet.Policy)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.QueryRow(`
+		INSERT INTO fleets (name, description, policy)
+		VALUES ($1, $2, $3)
+		RETURNING created_at, updated_at`,
+		fleet.Name, fleet.Description, policy,
+	).Scan(&fleet.CreatedAt, &fleet.UpdatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *PostgresStore) UpdateFleet(fleet *models.Fleet) error {
+	policy, err := json.Marshal(fleet.Policy)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.QueryRow(`
+		UPDATE fleets SET description = $2, policy = $3, updated_at = now()
+		WHERE name = $1
+		RETURNING created_at, updated_at`,
+		fleet.Name, fleet.Description, policy,
+	).Scan(&fleet.CreatedAt, &fleet.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) DeleteFleet(name string) error {
+	result, err := s.db.Exec(`DELETE FROM fleets WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	return requireRow(result)
+}
+
+func (s *PostgresStore) ListFleets() ([]*models.Fleet, error) {
+	rows, err := s.db.Query(`SELECT ` + fleetColumns + ` FROM fleets ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fleets []*models.Fleet
+	for rows.Next() {
+		fleet, err := scanFleet(rows)
+		if err != nil {
+			return nil, err
+		}
+		fleets = append(fleets, fleet)
+	}
+	return fleets, rows.Err()
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// requireRow returns ErrNotFound if a statement affected no rows
+func requireRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build postgres
+
+package store
+
+import (
+	"os"
+	"testing"
+)
+
+// Run with: DATABASE_URL=postgres://... go test -tags postgres ./internal/store
+// The tests truncate every table in that database.
+
+// openTestPostgres connects to DATABASE_URL and empties the registry
+func openTestPostgres(t *testing.T) *PostgresStore {
+	t.Helper()
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("DATABASE_URL not set")
+	}
+
+	s, err := NewPostgresStore(databaseURL)
+	if err != nil {
+		t.Fatalf("NewPostgresStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if _, err := s.db.Exec(`TRUNCATE devices, enrollment_tokens, device_status_events, fleets`); err != nil {
+		t.Fatalf("failed to empty tables: %v", err)
+	}
+	return s
+}
+
+func TestPostgresStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) Store {
+		return openTestPostgres(t)
+	})
+}
+
+func TestPostgresMigrationsAreIdempotent(t *testing.T) {
+	s := openTestPostgres(t)
+
+	if err := migrate(s.db); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	var applied int
+	if err := s.db.QueryRow(`SELECT count(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatalf("failed to count applied migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(migrations))
+	}
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/config"
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when a record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when creating a record that already exists
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// Store persists the device registry
+type Store interface {
+	// GetDevice returns the device with the given serial number
+	GetDevice(serialNumber string) (*models.Device, error)
+	// CreateDevice enrolls a new device and, with it, records event unless it
+	// is nil. Like all methods taking an event, it fills in the event's
+	// FromStatus, ToStatus, ID and CreatedAt.
+	CreateDevice(device *models.Device, event *models.DeviceStatusEvent) error
+	// UpdateDevice sets the fields present in update, in one atomic write with
+	// event, and returns the updated device. It never changes a device's status.
+	UpdateDevice(serialNumber string, update *models.DeviceUpdateRequest, event *models.DeviceStatusEvent) (*models.Device, error)
+	// DeleteDevice removes a device from the registry and records event
+	DeleteDevice(serialNumber string, event *models.DeviceStatusEvent) error
+	// SetDeviceStatus atomically changes a device's status to event.ToStatus
+	// and records event. check sees the device before the change and may
+	// reject it; its error is returned as is.
+	SetDeviceStatus(event *models.DeviceStatusEvent, check func(*models.Device) error) error
+	// ListDeviceStatusEvents returns a device's events, newest first. History
+	// outlives the device.
+	ListDeviceStatusEvents(serialNumber string) ([]*models.DeviceStatusEvent, error)
+	// RecordDeviceSightings updates when, from where and with which client
+	// devices were last seen. Unknown devices and sightings older than the
+	// recorded one are ignored.
+	RecordDeviceSightings(sightings []models.DeviceSighting) error
+	// SetDeviceHeartbeat stores the status a device last reported
+	SetDeviceHeartbeat(serialNumber string, heartbeat *models.DeviceHeartbeat) error
+	// ListDevices returns one page of the devices matching filter, ordered by
+	// serial number, and the total number of matches
+	ListDevices(filter models.DeviceFilter) ([]*models.Device, int, error)
+
+	// CreateEnrollmentToken stores an enrollment token under the hash of its secret
+	CreateEnrollmentToken(token *models.EnrollmentToken, tokenHash string) error
+	// ListEnrollmentTokens returns all enrollment tokens, newest first
+	ListEnrollmentTokens() ([]*models.EnrollmentToken, error)
+	// DeleteEnrollmentToken removes an enrollment token
+	DeleteEnrollmentToken(id string) error
+	// EnrollDevice atomically consumes the enrollment token with tokenHash,
+	// creates device and records event. check may reject the token or adjust
+	// device and event before they are written; its error is returned as is.
+	EnrollDevice(tokenHash string, device *models.Device, event *models.DeviceStatusEvent, check func(*models.EnrollmentToken) error) error
+
+	// GetFleet returns the fleet with the given name
+	GetFleet(name string) (*models.Fleet, error)
+	// CreateFleet adds a fleet
+	CreateFleet(fleet *models.Fleet) error
+	// UpdateFleet replaces a fleet's description and policy
+	UpdateFleet(fleet *models.Fleet) error
+	// DeleteFleet removes a fleet
+	DeleteFleet(name string) error
+	// ListFleets returns all fleets ordered by name
+	ListFleets() ([]*models.Fleet, error)
+
+	Close() error
+}
+
+// Open opens the store selected by DEVICE_STORE
+func Open(cfg *config.Config) (Store, error) {
+	switch cfg.DeviceStore {
+	case "memory":
+		log.Printf("Device registry is kept in memory and will be lost on restart")
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(cfg.DatabaseURL)
+	default:
+		return nil, fmt.Errorf("unknown DEVICE_STORE: %s", cfg.DeviceStore)
+	}
+}
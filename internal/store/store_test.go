@@ -0,0 +1,387 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ARED-Group/dynamic-token-manager/internal/models"
+)
+
+// runStoreTests runs the behaviour every Store implementation shares.
+// newStore returns an empty store.
+func runStoreTests(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Devices", func(t *testing.T) { testDevices(t, newStore(t)) })
+	t.Run("ListDevices", func(t *testing.T) { testListDevices(t, newStore(t)) })
+	t.Run("DeviceStatus", func(t *testing.T) { testDeviceStatus(t, newStore(t)) })
+	t.Run("Enrollment", func(t *testing.T) { testEnrollment(t, newStore(t)) })
+	t.Run("Sightings", func(t *testing.T) { testSightings(t, newStore(t)) })
+	t.Run("Heartbeat", func(t *testing.T) { testHeartbeat(t, newStore(t)) })
+	t.Run("Fleets", func(t *testing.T) { testFleets(t, newStore(t)) })
+}
+
+// mustCreateDevice enrolls an active device or fails the test
+func mustCreateDevice(t *testing.T, s Store, serialNumber string) *models.Device {
+	t.Helper()
+
+	device := &models.Device{SerialNumber: serialNumber, Fleet: "default", HardwareModel: "rpi4"}
+	if err := s.CreateDevice(device, nil); err != nil {
+		t.Fatalf("CreateDevice(%s): %v", serialNumber, err)
+	}
+	return device
+}
+
+func testDevices(t *testing.T, s Store) {
+	created := mustCreateDevice(t, s, "SN1")
+	if created.Status != models.DeviceStatusActive {
+		t.Errorf("new device status = %q, want %q", created.Status, models.DeviceStatusActive)
+	}
+	if created.CreatedAt.IsZero() || created.UpdatedAt.IsZero() {
+		t.Errorf("CreateDevice did not set timestamps: %+v", created)
+	}
+
+	if err := s.CreateDevice(&models.Device{SerialNumber: "SN1"}, nil); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("duplicate CreateDevice error = %v, want ErrAlreadyExists", err)
+	}
+
+	device, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.Fleet != "default" || device.HardwareModel != "rpi4" {
+		t.Errorf("GetDevice = %+v, want fleet default and model rpi4", device)
+	}
+
+	// Status changes aren't undone by updates of other fields
+	suspend := &models.DeviceStatusEvent{SerialNumber: "SN1", ToStatus: models.DeviceStatusSuspended}
+	if err := s.SetDeviceStatus(suspend, func(*models.Device) error { return nil }); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+
+	model, key, requireCert := "rpi5", "hmac:c2VjcmV0", true
+	updated, err := s.UpdateDevice("SN1", &models.DeviceUpdateRequest{HardwareModel: &model, PublicKey: &key, RequireClientCert: &requireCert}, nil)
+	if err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	device, err = s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice after update: %v", err)
+	}
+	for _, d := range []*models.Device{updated, device} {
+		if d.HardwareModel != "rpi5" || d.PublicKey != "hmac:c2VjcmV0" || !d.RequireClientCert || d.Fleet != "default" || d.Status != models.DeviceStatusSuspended {
+			t.Errorf("updated device = %+v, want model, key and certificate requirement changed, fleet and status kept", d)
+		}
+	}
+
+	if _, err := s.UpdateDevice("missing", &models.DeviceUpdateRequest{HardwareModel: &model}, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateDevice(missing) error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteDevice("SN1", nil); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if _, err := s.GetDevice("SN1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetDevice after delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteDevice("SN1", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteDevice error = %v, want ErrNotFound", err)
+	}
+}
+
+func testListDevices(t *testing.T, s Store) {
+	for _, serial := range []string{"SN3", "SN1", "SN2"} {
+		mustCreateDevice(t, s, serial)
+	}
+	other := &models.Device{SerialNumber: "SN4", Fleet: "lab"}
+	if err := s.CreateDevice(other, nil); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+
+	page, total, err := s.ListDevices(models.DeviceFilter{Limit: 2})
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if total != 4 || len(page) != 2 || page[0].SerialNumber != "SN1" || page[1].SerialNumber != "SN2" {
+		t.Errorf("first page = %d devices of %d starting %v, want SN1, SN2 of 4", len(page), total, serials(page))
+	}
+
+	page, _, err = s.ListDevices(models.DeviceFilter{Limit: 10, Offset: 2})
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if got := serials(page); len(got) != 2 || got[0] != "SN3" || got[1] != "SN4" {
+		t.Errorf("second page = %v, want [SN3 SN4]", got)
+	}
+
+	page, total, err = s.ListDevices(models.DeviceFilter{Fleet: "lab", Limit: 10})
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if total != 1 || len(page) != 1 || page[0].SerialNumber != "SN4" {
+		t.Errorf("fleet filter = %v of %d, want [SN4]", serials(page), total)
+	}
+}
+
+func testDeviceStatus(t *testing.T, s Store) {
+	created := &models.DeviceStatusEvent{SerialNumber: "SN1", Action: models.DeviceEventRegistered, Actor: "admin"}
+	if err := s.CreateDevice(&models.Device{SerialNumber: "SN1"}, created); err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	if created.ToStatus != models.DeviceStatusActive || created.ID == 0 {
+		t.Errorf("creation event = %+v, want ToStatus active and ID set", created)
+	}
+
+	event := &models.DeviceStatusEvent{
+		SerialNumber: "SN1",
+		Action:       models.DeviceEventStatusChanged,
+		ToStatus:     models.DeviceStatusSuspended,
+		Actor:        "admin",
+		Reason:       "lost",
+	}
+	if err := s.SetDeviceStatus(event, func(*models.Device) error { return nil }); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+	if event.FromStatus != models.DeviceStatusActive || event.ID == 0 || event.CreatedAt.IsZero() {
+		t.Errorf("recorded event = %+v, want FromStatus active, ID and CreatedAt set", event)
+	}
+
+	device, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.Status != models.DeviceStatusSuspended {
+		t.Errorf("status = %q, want suspended", device.Status)
+	}
+
+	// A rejected change leaves the device and its history alone
+	rejected := errors.New("rejected")
+	err = s.SetDeviceStatus(&models.DeviceStatusEvent{SerialNumber: "SN1", ToStatus: models.DeviceStatusActive},
+		func(device *models.Device) error {
+			if device.Status != models.DeviceStatusSuspended {
+				t.Errorf("check saw status %q, want suspended", device.Status)
+			}
+			return rejected
+		})
+	if err != rejected {
+		t.Errorf("SetDeviceStatus error = %v, want the check's error", err)
+	}
+
+	second := &models.DeviceStatusEvent{SerialNumber: "SN1", Action: models.DeviceEventStatusChanged, ToStatus: models.DeviceStatusActive, Actor: "admin"}
+	if err := s.SetDeviceStatus(second, func(*models.Device) error { return nil }); err != nil {
+		t.Fatalf("SetDeviceStatus: %v", err)
+	}
+
+	err = s.SetDeviceStatus(&models.DeviceStatusEvent{SerialNumber: "missing", ToStatus: models.DeviceStatusActive},
+		func(*models.Device) error { return nil })
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetDeviceStatus(missing) error = %v, want ErrNotFound", err)
+	}
+
+	// History is newest first and outlives the device
+	deleted := &models.DeviceStatusEvent{SerialNumber: "SN1", Action: models.DeviceEventDeleted, Actor: "admin"}
+	if err := s.DeleteDevice("SN1", deleted); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	events, err := s.ListDeviceStatusEvents("SN1")
+	if err != nil {
+		t.Fatalf("ListDeviceStatusEvents: %v", err)
+	}
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	want := []string{models.DeviceEventDeleted, models.DeviceEventStatusChanged, models.DeviceEventStatusChanged, models.DeviceEventRegistered}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Fatalf("history actions = %v, want %v", actions, want)
+	}
+	if events[0].FromStatus != models.DeviceStatusActive || events[0].ToStatus != "" ||
+		events[1].ToStatus != models.DeviceStatusActive || events[2].Reason != "lost" {
+		t.Errorf("history = %+v, want the deletion, reactivation, suspension and registration", events)
+	}
+}
+
+func testEnrollment(t *testing.T, s Store) {
+	token := &models.EnrollmentToken{ID: "tok1", Fleet: "lab", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+	if err := s.CreateEnrollmentToken(token, "hash1"); err != nil {
+		t.Fatalf("CreateEnrollmentToken: %v", err)
+	}
+	if err := s.CreateEnrollmentToken(token, "hash2"); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("duplicate CreateEnrollmentToken error = %v, want ErrAlreadyExists", err)
+	}
+
+	rejected := errors.New("rejected")
+	err := s.EnrollDevice("hash1", &models.Device{SerialNumber: "SN1"}, nil, func(*models.EnrollmentToken) error { return rejected })
+	if err != rejected {
+		t.Errorf("EnrollDevice error = %v, want the check's error", err)
+	}
+	if _, err := s.GetDevice("SN1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rejected enrollment created a device: %v", err)
+	}
+
+	device := &models.Device{SerialNumber: "SN1"}
+	event := &models.DeviceStatusEvent{SerialNumber: "SN1", Action: models.DeviceEventEnrolled}
+	err = s.EnrollDevice("hash1", device, event, func(token *models.EnrollmentToken) error {
+		device.Fleet = token.Fleet
+		event.Actor = "enrollment-token:" + token.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EnrollDevice: %v", err)
+	}
+	if events, err := s.ListDeviceStatusEvents("SN1"); err != nil || len(events) != 1 || events[0].Actor != "enrollment-token:tok1" {
+		t.Errorf("enrollment history = %+v, %v; want one event by enrollment-token:tok1", events, err)
+	}
+	enrolled, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if enrolled.Fleet != "lab" {
+		t.Errorf("enrolled fleet = %q, want lab", enrolled.Fleet)
+	}
+
+	tokens, err := s.ListEnrollmentTokens()
+	if err != nil {
+		t.Fatalf("ListEnrollmentTokens: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].UsedBy != "SN1" || tokens[0].UsedAt == nil {
+		t.Errorf("tokens = %+v, want tok1 used by SN1", tokens)
+	}
+
+	if err := s.EnrollDevice("unknown", &models.Device{SerialNumber: "SN2"}, nil, func(*models.EnrollmentToken) error { return nil }); !errors.Is(err, ErrNotFound) {
+		t.Errorf("EnrollDevice(unknown) error = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteEnrollmentToken("tok1"); err != nil {
+		t.Fatalf("DeleteEnrollmentToken: %v", err)
+	}
+	if err := s.DeleteEnrollmentToken("tok1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteEnrollmentToken error = %v, want ErrNotFound", err)
+	}
+}
+
+func testSightings(t *testing.T, s Store) {
+	mustCreateDevice(t, s, "SN1")
+	mustCreateDevice(t, s, "SN2")
+
+	seen := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+	err := s.RecordDeviceSightings([]models.DeviceSighting{
+		{SerialNumber: "SN1", SeenAt: seen, IP: "10.0.0.1", ClientVersion: "1.0"},
+		{SerialNumber: "unknown", SeenAt: seen, IP: "10.0.0.2"},
+	})
+	if err != nil {
+		t.Fatalf("RecordDeviceSightings: %v", err)
+	}
+
+	// Older sightings never move last-seen backwards
+	err = s.RecordDeviceSightings([]models.DeviceSighting{
+		{SerialNumber: "SN1", SeenAt: seen.Add(-time.Hour), IP: "10.0.0.9", ClientVersion: "0.9"},
+	})
+	if err != nil {
+		t.Fatalf("RecordDeviceSightings: %v", err)
+	}
+
+	device, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.LastSeenAt == nil || !device.LastSeenAt.Equal(seen) || device.LastSeenIP != "10.0.0.1" || device.ClientVersion != "1.0" {
+		t.Errorf("device = %+v, want last seen %v from 10.0.0.1 with 1.0", device, seen)
+	}
+
+	// SN2 was never seen and SN1 not in the last 30 seconds
+	page, _, err := s.ListDevices(models.DeviceFilter{NotSeenSince: time.Now().Add(-30 * time.Second), Limit: 10})
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if got := serials(page); len(got) != 2 {
+		t.Errorf("stale devices = %v, want [SN1 SN2]", got)
+	}
+	page, _, err = s.ListDevices(models.DeviceFilter{NotSeenSince: seen.Add(-time.Second), Limit: 10})
+	if err != nil {
+		t.Fatalf("ListDevices: %v", err)
+	}
+	if got := serials(page); len(got) != 1 || got[0] != "SN2" {
+		t.Errorf("stale devices = %v, want [SN2]", got)
+	}
+}
+
+func testHeartbeat(t *testing.T, s Store) {
+	mustCreateDevice(t, s, "SN1")
+
+	heartbeat := &models.DeviceHeartbeat{
+		Images:        []models.ImageStatus{{Name: "ghcr.io/example/app:1", Digest: "sha256:abc"}},
+		UptimeSeconds: 42,
+		ReceivedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	if err := s.SetDeviceHeartbeat("SN1", heartbeat); err != nil {
+		t.Fatalf("SetDeviceHeartbeat: %v", err)
+	}
+	if err := s.SetDeviceHeartbeat("missing", heartbeat); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetDeviceHeartbeat(missing) error = %v, want ErrNotFound", err)
+	}
+
+	device, err := s.GetDevice("SN1")
+	if err != nil {
+		t.Fatalf("GetDevice: %v", err)
+	}
+	if device.Heartbeat == nil || device.Heartbeat.UptimeSeconds != 42 || len(device.Heartbeat.Images) != 1 {
+		t.Errorf("heartbeat = %+v, want the stored heartbeat", device.Heartbeat)
+	}
+}
+
+func testFleets(t *testing.T, s Store) {
+	fleet := &models.Fleet{
+		Name:   "beta",
+		Policy: models.FleetPolicy{Registries: []string{"ghcr"}, TokenTTL: 600},
+	}
+	if err := s.CreateFleet(fleet); err != nil {
+		t.Fatalf("CreateFleet: %v", err)
+	}
+	if err := s.CreateFleet(fleet); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("duplicate CreateFleet error = %v, want ErrAlreadyExists", err)
+	}
+
+	fleet.Description = "beta testers"
+	fleet.Policy.Repositories = []string{"edge-agent-beta"}
+	if err := s.UpdateFleet(fleet); err != nil {
+		t.Fatalf("UpdateFleet: %v", err)
+	}
+	got, err := s.GetFleet("beta")
+	if err != nil {
+		t.Fatalf("GetFleet: %v", err)
+	}
+	if got.Description != "beta testers" || len(got.Policy.Repositories) != 1 || got.Policy.TokenTTL != 600 {
+		t.Errorf("fleet = %+v, want the updated fleet", got)
+	}
+
+	if err := s.CreateFleet(&models.Fleet{Name: "alpha"}); err != nil {
+		t.Fatalf("CreateFleet: %v", err)
+	}
+	fleets, err := s.ListFleets()
+	if err != nil {
+		t.Fatalf("ListFleets: %v", err)
+	}
+	if len(fleets) != 2 || fleets[0].Name != "alpha" || fleets[1].Name != "beta" {
+		t.Errorf("fleets = %+v, want alpha then beta", fleets)
+	}
+
+	if err := s.DeleteFleet("beta"); err != nil {
+		t.Fatalf("DeleteFleet: %v", err)
+	}
+	if _, err := s.GetFleet("beta"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetFleet after delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.UpdateFleet(&models.Fleet{Name: "beta"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("UpdateFleet(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+// serials lists the serial numbers of devices
+func serials(devices []*models.Device) []string {
+	result := make([]string, 0, len(devices))
+	for _, device := range devices {
+		result = append(result, device.SerialNumber)
+	}
+	return result
+}
@@ -32,14 +32,22 @@ func main() {
 	router := mux.NewRouter()
 	
 	// Setup routes
-	if err := api.SetupRoutes(router, cfg); err != nil {
+	closeServices, err := api.SetupRoutes(router, cfg)
+	if err != nil {
 		log.Fatalf("Failed to setup routes: %v", err)
 	}
 	
+	// TLS, optionally with device client certificates
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	
 	// Create server
 	srv := &http.Server{
 		Addr:         ":" + cfg.Port,
 		Handler:      router,
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  time.Duration(cfg.ServerReadTimeout) * time.Second,
 		WriteTimeout: time.Duration(cfg.ServerWriteTimeout) * time.Second,
 		IdleTimeout:  time.Duration(cfg.ServerIdleTimeout) * time.Second,
@@ -52,7 +60,14 @@ func main() {
 		log.Printf("GitHub App ID: %s", cfg.GitHubAppID)
 		log.Printf("Device Auth Enabled: %t", cfg.DeviceAuthEnabled)
 		
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			log.Printf("TLS enabled (client certificates: %t)", tlsConfig.ClientCAs != nil)
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
 	}()
@@ -71,5 +86,9 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 	
+	if err := closeServices(); err != nil {
+		log.Printf("Failed to close services: %v", err)
+	}
+	
 	log.Println("Server exited")
 }